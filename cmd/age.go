@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// ageHeader starts the header of a binary age file.
+const ageHeader = "age-encryption.org/"
+
+// parseAgeRecipient parses an age X25519 public key (age1...) or an SSH
+// public key line (ssh-ed25519 or ssh-rsa).
+func parseAgeRecipient(s string) (age.Recipient, error) {
+	if strings.HasPrefix(s, "age1") {
+		return age.ParseX25519Recipient(s)
+	}
+
+	return agessh.ParseRecipient(s)
+}
+
+// readAgeRecipients parses the recipients given directly and those listed one
+// per line, with '#' comments, in the recipients files.
+func readAgeRecipients(recipients []string, paths []string) ([]age.Recipient, error) {
+	var parsed []age.Recipient
+
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				recipients = append(recipients, line)
+			}
+		}
+	}
+
+	for _, s := range recipients {
+		r, err := parseAgeRecipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient '%s': %s", s, err)
+		}
+
+		parsed = append(parsed, r)
+	}
+
+	return parsed, nil
+}
+
+// readAgeIdentities reads the age identity files, which hold age secret keys
+// (AGE-SECRET-KEY-1...) or an SSH private key. The passphrase of an encrypted
+// SSH key is taken from the key source, and only asked for if the key is
+// needed.
+func readAgeIdentities(paths []string, keys *keySource) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Contains(b, []byte("PRIVATE KEY-----")) {
+			ids, err := age.ParseIdentities(bytes.NewReader(b))
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %s", path, err)
+			}
+
+			identities = append(identities, ids...)
+			continue
+		}
+
+		id, err := agessh.ParseIdentity(b)
+
+		if missing, ok := err.(*ssh.PassphraseMissingError); ok {
+			var (
+				keyPath = path
+				pub     crypto.PublicKey
+			)
+
+			if k, ok := missing.PublicKey.(ssh.CryptoPublicKey); ok {
+				pub = k.CryptoPublicKey()
+			}
+
+			id, err = agessh.NewEncryptedSSHIdentity(missing.PublicKey, b, func() ([]byte, error) {
+				pass, err := keys.passphrase(keyPath, pub)
+				if err == nil && pass == nil {
+					err = fmt.Errorf("SSH key %s is encrypted and no passphrase source was given", keyPath)
+				}
+
+				return pass, err
+			})
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", path, err)
+		}
+
+		identities = append(identities, id)
+	}
+
+	return identities, nil
+}
+
+// isAgeEncrypted reports whether the data in br is an age file, binary or
+// ascii armored.
+func isAgeEncrypted(br *bufio.Reader) bool {
+	start, _ := br.Peek(len(armor.Header))
+
+	return bytes.HasPrefix(start, []byte(ageHeader)) || bytes.Equal(start, []byte(armor.Header))
+}
+
+// ageRecipients describes the recipient stanzas in the header of the binary
+// age file in br, without consuming it. X25519 stanzas do not identify their
+// recipient; SSH stanzas carry a tag derived from the recipient's key.
+func ageRecipients(br *bufio.Reader) []string {
+	header, _ := br.Peek(br.Size())
+
+	var recipients []string
+
+	for _, line := range strings.Split(string(header), "\n")[1:] {
+		if !strings.HasPrefix(line, "-> ") {
+			if strings.HasPrefix(line, "---") {
+				break
+			}
+
+			continue
+		}
+
+		args := strings.Fields(line[3:])
+
+		switch {
+		case len(args) == 0:
+		case strings.HasPrefix(args[0], "ssh-") && len(args) > 1:
+			recipients = append(recipients, args[0]+" "+args[1])
+		default:
+			recipients = append(recipients, args[0])
+		}
+	}
+
+	return recipients
+}
+
+// ageDecryptReader returns a reader of the decrypted contents of the age file
+// in br, using the first identity that matches a recipient.
+func ageDecryptReader(br *bufio.Reader, identities []age.Identity) (io.Reader, error) {
+	var r io.Reader = br
+
+	if start, _ := br.Peek(len(armor.Header)); bytes.Equal(start, []byte(armor.Header)) {
+		r = armor.NewReader(br)
+	}
+
+	return age.Decrypt(r, identities...)
+}
+
+// packageRecipients describes who the encrypted package in br is encrypted
+// for, without consuming it beyond its header.
+func packageRecipients(br *bufio.Reader) ([]string, error) {
+	if isAgeEncrypted(br) {
+		return ageRecipients(br), nil
+	}
+
+	ids, err := messageRecipients(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyIDStrings(ids), nil
+}
+
+// decryptPackage returns a reader of the decrypted contents of the age or
+// OpenPGP encrypted package in br, using the age identities or the private key
+// of the key source, and describes the recipients the package is encrypted
+// for.
+func decryptPackage(br *bufio.Reader, keys *keySource) (io.Reader, []string, error) {
+	if isAgeEncrypted(br) {
+		recipients := ageRecipients(br)
+
+		if len(keys.AgeIdentities) == 0 {
+			return nil, recipients, fmt.Errorf("package is age encrypted, give an age identity")
+		}
+
+		identities, err := readAgeIdentities(keys.AgeIdentities, keys)
+		if err != nil {
+			return nil, recipients, err
+		}
+
+		r, err := ageDecryptReader(br, identities)
+
+		return r, recipients, err
+	}
+
+	if keys.KeyPath == "" && keys.KeyID == "" {
+		return nil, nil, fmt.Errorf("package is OpenPGP encrypted, give its private key")
+	}
+
+	keyring, err := keys.Keyring()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, ids, err := decryptReader(br, keyring)
+
+	return r, keyIDStrings(ids), err
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeSSHKey writes a new unencrypted RSA private key to a file in dir,
+// returning its path and the authorized_keys line of its public key.
+func writeSSHKey(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "id_rsa")
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err = ioutil.WriteFile(keyPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPath, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		src          = writeTestDir(t, dir, testDataset)
+		idPath       = filepath.Join(dir, "age.key")
+		recipsPath   = filepath.Join(dir, "recipients.txt")
+		sshPath, pub = writeSSHKey(t, dir)
+	)
+
+	if err = ioutil.WriteFile(idPath, []byte("# created: now\n"+id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(recipsPath, []byte("# the site\n"+id.Recipient().String()+"\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := readAgeRecipients([]string{pub}, []string{recipsPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recipients) != 2 {
+		t.Fatalf("read %d recipients, expected 2", len(recipients))
+	}
+
+	packagePath := filepath.Join(dir, "package.tar.zst.age")
+
+	encrypter := func(w io.Writer) (io.WriteCloser, error) {
+		return age.Encrypt(w, recipients...)
+	}
+
+	if err = packTar(src, formatTarZst, packagePath, 0, encrypter, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(b))
+
+	if !isAgeEncrypted(br) {
+		t.Error("package is not detected as age encrypted")
+	}
+
+	if described, err := packageRecipients(br); err != nil || len(described) != 2 || !strings.HasPrefix(described[0], "ssh-rsa ") || described[1] != "X25519" {
+		t.Errorf("recipients are %q, %v", described, err)
+	}
+
+	// Either identity decrypts the package, and the format is detected.
+	for _, identity := range []string{idPath, sshPath} {
+		dst := filepath.Join(dir, "dst-"+filepath.Base(identity))
+
+		err = unpackTar(context.Background(), bytes.NewReader(b), "", dst, &keySource{AgeIdentities: []string{identity}})
+		if err != nil {
+			t.Errorf("%s: %s", filepath.Base(identity), err)
+			continue
+		}
+
+		checkTestDir(t, dst, testDataset)
+	}
+
+	// Another identity cannot.
+	other, _ := age.GenerateX25519Identity()
+	otherPath := filepath.Join(dir, "other.key")
+
+	ioutil.WriteFile(otherPath, []byte(other.String()+"\n"), 0600)
+
+	if err = unpackTar(context.Background(), bytes.NewReader(b), "", filepath.Join(dir, "other"), &keySource{AgeIdentities: []string{otherPath}}); err == nil {
+		t.Error("no error decrypting with another identity")
+	}
+
+	if _, err = readAgeRecipients([]string{"age1invalid"}, nil); err == nil {
+		t.Error("no error for an invalid recipient")
+	}
+}
+
+func TestAgeArmored(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	aw := armor.NewWriter(&buf)
+
+	w, err := age.Encrypt(aw, id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("person_id\n1\n"))
+	w.Close()
+	aw.Close()
+
+	br := bufio.NewReader(&buf)
+
+	if !isAgeEncrypted(br) {
+		t.Fatal("armored file is not detected as age encrypted")
+	}
+
+	r, err := ageDecryptReader(br, []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "person_id\n1\n" {
+		t.Errorf("decrypted %q, %v", b, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -15,9 +16,47 @@ var annotateCmd = &cobra.Command{
 
 Collect metadata by prompting the user to input any values not given in the
 flags and then calculating the checksums of data files in the directory. Data
-files are matched to tables in the data model by name and the user is prompted
-to enter the table for any data file with a name that does not match a table
-in the model. Any existing metadata file in the directory is overwritten.`,
+files are matched to tables in the data model by name. If a file name does not
+match a table, the file's header row is scored against the fields of every
+table and a confident best match is used. Otherwise the user is prompted to
+enter the table, with the best candidates and their match scores listed. Any
+existing metadata file in the directory is overwritten.
+
+If a mapping file is given, its rules are used to match data files to tables
+before falling back to the file names. Each line of the mapping file has the
+form 'PATTERN -> TABLE', where PATTERN is a shell glob matched against the file
+name or, if enclosed in slashes, a regular expression. Blank lines and lines
+starting with '#' are ignored. For example:
+
+    *_visits_*.csv -> visit_occurrence
+    /^pers(on)?_\d+\.csv$/ -> person
+
+If the non-interactive flag is given, the user is never prompted. Instead, the
+command fails if a required value is not given in the flags or a data file
+cannot be matched to a table, listing the best candidates.
+
+If the update flag is given, the existing metadata file is read and updated
+instead of overwritten. Values already in the file, such as the site and ETL
+URL, are kept unless given in the flags. Checksums are only recomputed for
+files whose size or modification time differs from that recorded in the
+metadata file, records are added for new files and removed for deleted files,
+and the changes are reported.
+
+Checksums are calculated with the algorithm given by the checksum flag (one of
+sha256, sha512 or blake3) and recorded per file in the metadata file, hashing
+as many files concurrently as given by the jobs flag. The row count, byte size,
+header columns and detected encoding of each file are recorded along with its
+checksum, and are verified by validate and load.
+
+If the datapackage flag is given, a Frictionless Data Package descriptor
+(datapackage.json) is also written to DATADIR, describing each file as a
+tabular data resource with a table schema derived from the model's fields and
+foreign keys. Checksums are written as the resources' hash property, except
+blake3 checksums, which that property does not allow and which are written to
+custom checksum and checksum-algorithm properties instead. The validate and
+load commands read the descriptor in place of the metadata file when the
+latter is missing. With the update flag, an existing descriptor is used as the
+starting point in the same way.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		// TODO: Handle errors with more grace.
@@ -30,13 +69,20 @@ in the model. Any existing metadata file in the directory is overwritten.`,
 
 		// Enforce single data directory argument.
 		if len(args) != 1 {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryUsage, log.Fields{
 				"args": args,
-			}).Fatal("annotate requires 1 argument")
+			}, "annotate requires 1 argument")
 		}
 
 		arg = args[0]
 
+		if err = dataset.CheckWriteChecksumAlgorithm(viper.GetString("checksum")); err != nil {
+			fatal(dataset.CategoryOf(err), log.Fields{
+				"checksum": viper.GetString("checksum"),
+				"error":    err,
+			}, "invalid checksum algorithm")
+		}
+
 		// Notify that dataset annotation is beggining on this directory.
 		log.WithFields(log.Fields{
 			"directory": arg,
@@ -67,10 +113,10 @@ in the model. Any existing metadata file in the directory is overwritten.`,
 
 		// Fatal and exit if the object creation fails.
 		if err != nil {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryOther, log.Fields{
 				"directory": arg,
 				"error":     err,
-			}).Fatal("error creating DataDirectory object")
+			}, "error creating DataDirectory object")
 		}
 
 		// On debug, notify that metadata population is about to occur.
@@ -78,17 +124,65 @@ in the model. Any existing metadata file in the directory is overwritten.`,
 			"directory": arg,
 		}).Debug("populating metadata from data and user input")
 
-		// This function asks for user input, checking it against the data
-		// model, to fill in the needed metadata values and then iterates
-		// over the files in the directory. If the file name doesn't match
-		// a table in the model, the user is asked to input the table name.
-		// The checksums are calculated for each file.
-		// TODO: Move the metadata filling routines up to this level.
-		if err = d.PopulateMetadataFromData(); err != nil {
-			log.WithFields(log.Fields{
+		var mapping tableMapping
+
+		if viper.GetString("mapping") != "" {
+			if mapping, err = readTableMapping(viper.GetString("mapping")); err != nil {
+				fatal(dataset.CategoryConfiguration, log.Fields{
+					"mapping": viper.GetString("mapping"),
+					"error":   err,
+				}, "error reading table mapping file")
+			}
+		}
+
+		opts := &metadataOptions{
+			Attrs: dataset.Attrs{
+				Site:         viper.GetString("site"),
+				Model:        viper.GetString("model"),
+				ModelVersion: viper.GetString("modelv"),
+				DataVersion:  viper.GetString("datav"),
+				Etl:          viper.GetString("etl"),
+			},
+			Service:     viper.GetString("service"),
+			Mapping:     mapping,
+			Interactive: !viper.GetBool("noninteractive"),
+			Algorithm:   viper.GetString("checksum"),
+			Jobs:        viper.GetInt("jobs"),
+		}
+
+		if viper.GetBool("update") {
+
+			// Read the existing records and bring them up to date.
+			if err = dataset.ReadMetadata(d); err != nil {
+				fatal(dataset.CategoryFormat, log.Fields{
+					"directory": arg,
+					"error":     err,
+				}, "error reading existing metadata file")
+			}
+
+			var changes *metadataChanges
+
+			if changes, err = updateMetadata(d, opts); err == nil {
+				logMetadataChanges(arg, changes)
+			}
+
+		} else {
+
+			// Ask for user input, unless disabled, to fill in the needed
+			// metadata values, checking them against the data model, and
+			// then iterate over the files in the directory. Files are
+			// matched to tables by the mapping rules or their names,
+			// asking the user if neither matches. The checksums of the
+			// files are calculated concurrently.
+			err = populateMetadata(d, opts)
+
+		}
+
+		if err != nil {
+			fatal(dataset.CategoryOf(err), log.Fields{
 				"directory": arg,
 				"error":     err,
-			}).Fatal("error populating metadata")
+			}, "error populating metadata")
 		}
 
 		// On debug, notify that the file is being written.
@@ -97,13 +191,35 @@ in the model. Any existing metadata file in the directory is overwritten.`,
 			"file":      d.FilePath,
 		}).Debug("writing metadata to file")
 
-		// This function simply writes the csv metadata file into the data
-		// directory. It overwrites any existing file.
-		if err = d.WriteMetadataToFile(); err != nil {
-			log.WithFields(log.Fields{
+		// Write the csv metadata file into the data directory, including
+		// the checksum algorithm and file statistics columns. It overwrites
+		// any existing file.
+		if err = writeMetadataFile(d); err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
 				"directory": arg,
 				"error":     err,
-			}).Fatal("error writing metadata to file")
+			}, "error writing metadata to file")
+		}
+
+		// Also describe the dataset as a Frictionless Data Package if
+		// requested, with table schemas from the model.
+		if viper.GetBool("datapackage") {
+			log.WithFields(log.Fields{
+				"directory": arg,
+				"file":      dataset.DataPackageFile,
+			}).Debug("writing data package descriptor")
+
+			m, err := dataset.FetchModel(d.RecordMaps[0]["cdm"], d.RecordMaps[0]["cdm-version"], viper.GetString("service"))
+			if err == nil {
+				err = dataset.WriteDataPackage(d, m)
+			}
+
+			if err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"directory": arg,
+					"error":     err,
+				}, "error writing data package descriptor")
+			}
 		}
 
 		// Notify that the process is complete for this directory.
@@ -123,10 +239,36 @@ func init() {
 	annotateCmd.Flags().String("datav", "", "Dataset version number.")
 	annotateCmd.Flags().String("etl", "", "URL of the ETL code used to create the dataset.")
 	annotateCmd.Flags().String("site", "", "Name of the organization or site that created the dataset.")
+	annotateCmd.Flags().Bool("non-interactive", false, "Fail instead of prompting for missing values or tables.")
+	annotateCmd.Flags().String("mapping", "", "Path to a file of 'PATTERN -> TABLE' rules mapping file names to tables.")
+	annotateCmd.Flags().Bool("update", false, "Update the existing metadata file instead of overwriting it.")
+	annotateCmd.Flags().String("checksum", dataset.DefaultChecksumAlgorithm, "Checksum algorithm [sha256|sha512|blake3].")
+	annotateCmd.Flags().Bool("datapackage", false, "Also write a Frictionless datapackage.json descriptor.")
+
+	// Add the shared flags annotate uses.
+	addSharedFlags(annotateCmd, "model", "modelv", "service", "jobs")
+}
+
+// logMetadataChanges reports the files added, removed and changed by an
+// update of the metadata file.
+func logMetadataChanges(dir string, changes *metadataChanges) {
+	for _, name := range changes.Added {
+		log.WithFields(log.Fields{"file": name}).Info("added metadata record")
+	}
+
+	for _, name := range changes.Removed {
+		log.WithFields(log.Fields{"file": name}).Info("removed metadata record")
+	}
 
-	// Bind viper keys to the flag values.
-	viper.BindPFlag("datav", annotateCmd.Flags().Lookup("datav"))
-	viper.BindPFlag("etl", annotateCmd.Flags().Lookup("etl"))
-	viper.BindPFlag("site", annotateCmd.Flags().Lookup("site"))
+	for _, name := range changes.Changed {
+		log.WithFields(log.Fields{"file": name}).Info("updated checksum")
+	}
 
+	log.WithFields(log.Fields{
+		"directory": dir,
+		"added":     len(changes.Added),
+		"removed":   len(changes.Removed),
+		"changed":   len(changes.Changed),
+		"unchanged": len(changes.Unchanged),
+	}).Info("metadata changes")
 }
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Package formats. The datapackage format is whatever datapackage.Pack
+// produces; the tar formats are standard, streamable archives.
+const (
+	formatDataPackage = "datapackage"
+	formatTarGz       = "tar.gz"
+	formatTarZst      = "tar.zst"
+)
+
+// encryptedExts are stripped from a package path before detecting its format.
+var encryptedExts = []string{".gpg", ".pgp", ".age"}
+
+// packageFormat returns the package format given by the flag or, if the flag
+// is empty, implied by the extension of the package path. Paths without a tar
+// extension use the datapackage format.
+func packageFormat(flag string, packagePath string) (string, error) {
+	switch strings.ToLower(flag) {
+	case formatDataPackage, formatTarGz, formatTarZst:
+		return strings.ToLower(flag), nil
+	case "tgz":
+		return formatTarGz, nil
+	case "tzst":
+		return formatTarZst, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown package format '%s', choose from: %s, %s, %s", flag, formatDataPackage, formatTarGz, formatTarZst)
+	}
+
+	name := strings.ToLower(packagePath)
+
+	for _, ext := range encryptedExts {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return formatTarGz, nil
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return formatTarZst, nil
+	}
+
+	return formatDataPackage, nil
+}
+
+// sniffFormat detects the compression of a tar package from its first bytes,
+// returning an empty format if it is not recognized.
+func sniffFormat(r *bufio.Reader) string {
+	magic, _ := r.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return formatTarGz
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatTarZst
+	}
+
+	return ""
+}
+
+// writeTar writes the files under dir to w as a tar archive compressed in the
+// given format, followed by the extra files, named by their path relative to
+// dir, which replace any files under dir of the same name.
+func writeTar(w io.Writer, dir string, format string, extra map[string][]byte) error {
+	var (
+		cw  io.WriteCloser
+		err error
+	)
+
+	switch format {
+	case formatTarGz:
+		cw = gzip.NewWriter(w)
+	case formatTarZst:
+		if cw, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot stream the %s format", format)
+	}
+
+	tw := tar.NewWriter(cw)
+
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if _, ok := extra[filepath.ToSlash(rel)]; ok && !info.IsDir() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(extra[name])),
+			ModTime:  time.Now(),
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err = tw.Write(extra[name]); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return cw.Close()
+}
+
+// decompressReader returns a reader of the tar archive compressed in the
+// given format in br. If the format is empty it is detected from the data.
+func decompressReader(br *bufio.Reader, format string) (io.ReadCloser, error) {
+	if format == "" {
+		if format = sniffFormat(br); format == "" {
+			return nil, fmt.Errorf("package is not a gzip or zstd compressed tar archive")
+		}
+	}
+
+	switch format {
+	case formatTarGz:
+		return gzip.NewReader(br)
+	case formatTarZst:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return zr.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("cannot stream the %s format", format)
+}
+
+// readTar extracts the tar archive compressed in the given format from r into
+// dir, refusing members that would be written outside of it. If the format is
+// empty it is detected from the data.
+func readTar(r io.Reader, dir string, format string) error {
+	cr, err := decompressReader(bufio.NewReader(r), format)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(cr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(filepath.Clean(name), ".."+string(filepath.Separator)) {
+			return fmt.Errorf("package member '%s' is outside of the output directory", hdr.Name)
+		}
+
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tr, target, os.FileMode(hdr.Mode).Perm())
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The archive ends before the stream does. Read the rest so that the
+	// checks made at its end, such as the gzip checksum and the integrity
+	// check of an encrypted package, are not skipped.
+	_, err = io.Copy(ioutil.Discard, cr)
+
+	return err
+}
+
+// extractFile writes the contents of r to a new file at target. The partial
+// file is removed if the copy fails, such as when it is interrupted.
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(target)
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageFormat(t *testing.T) {
+	tests := []struct {
+		flag   string
+		path   string
+		format string
+	}{
+		{"", "package.tar.gz", formatTarGz},
+		{"", "package.TGZ", formatTarGz},
+		{"", "package.tar.gz.gpg", formatTarGz},
+		{"", "package.tar.zst", formatTarZst},
+		{"", "package.tzst.age", formatTarZst},
+		{"", "package.zip", formatDataPackage},
+		{"", "", formatDataPackage},
+		{"tgz", "package.zip", formatTarGz},
+		{"TAR.ZST", "", formatTarZst},
+		{"datapackage", "package.tar.gz", formatDataPackage},
+	}
+
+	for _, test := range tests {
+		format, err := packageFormat(test.flag, test.path)
+		if err != nil {
+			t.Errorf("packageFormat(%q, %q): unexpected error: %s", test.flag, test.path, err)
+		} else if format != test.format {
+			t.Errorf("packageFormat(%q, %q) = %q, expected %q", test.flag, test.path, format, test.format)
+		}
+	}
+
+	if _, err := packageFormat("zip", "package.zip"); err == nil {
+		t.Error("no error for an unknown format")
+	}
+}
+
+// writeTestDir writes the files, named by their slash separated paths, under
+// a new directory in dir.
+func writeTestDir(t *testing.T, dir string, files map[string]string) string {
+	src := filepath.Join(dir, "src")
+
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return src
+}
+
+// checkTestDir checks that the files under dir are the given ones.
+func checkTestDir(t *testing.T, dir string, files map[string]string) {
+	found := 0
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+
+		data, ok := files[filepath.ToSlash(rel)]
+		if !ok {
+			t.Errorf("unexpected file %s", rel)
+			return nil
+		}
+
+		found++
+
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != data {
+			t.Errorf("%s is %q, %v, expected %q", rel, b, err, data)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found != len(files) {
+		t.Errorf("found %d files, expected %d", found, len(files))
+	}
+}
+
+var testDataset = map[string]string{
+	"metadata.csv":         "organization,filename\nseattle,person.csv\n",
+	"person.csv":           "person_id\n1\n2\n",
+	"extra/visit.csv":      "visit_id\n10\n",
+	"extra/deeper/obs.csv": "",
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, testDataset)
+
+	for _, format := range []string{formatTarGz, formatTarZst} {
+		packagePath := filepath.Join(dir, "package."+format)
+
+		if err = packTar(src, format, packagePath, 0, nil, nil); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		f, err := os.Open(packagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sniffed := sniffFormat(bufio.NewReader(f)); sniffed != format {
+			t.Errorf("%s: detected format %q", format, sniffed)
+		}
+
+		f.Close()
+
+		// The format is detected when not given, as when reading stdin.
+		for _, readFormat := range []string{format, ""} {
+			dst := filepath.Join(dir, "dst-"+format+"-"+readFormat)
+
+			if f, err = os.Open(packagePath); err != nil {
+				t.Fatal(err)
+			}
+
+			err = readTar(f, dst, readFormat)
+			f.Close()
+
+			if err != nil {
+				t.Errorf("%s, read as %q: %s", format, readFormat, err)
+				continue
+			}
+
+			checkTestDir(t, dst, testDataset)
+		}
+	}
+}
+
+func TestReadTarChecksEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, testDataset)
+
+	var buf bytes.Buffer
+
+	if err = writeTar(&buf, src, formatTarGz, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the gzip checksum, which follows the end of the archive.
+	b := buf.Bytes()
+	b[len(b)-8] ^= 0xff
+
+	if err = readTar(bytes.NewReader(b), filepath.Join(dir, "dst"), formatTarGz); err != gzip.ErrChecksum {
+		t.Errorf("error %v reading a package with a bad checksum, expected %v", err, gzip.ErrChecksum)
+	}
+}
+
+func TestReadTarOutside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../escape.csv", "a/../../escape.csv", "/escape.csv"} {
+		var buf bytes.Buffer
+
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+		gz.Close()
+
+		if err = readTar(&buf, filepath.Join(dir, "dst"), formatTarGz); err == nil {
+			t.Errorf("%s: no error extracting a member outside of the output directory", name)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "escape.csv")); !os.IsNotExist(err) {
+		t.Error("a member was extracted outside of the output directory")
+	}
+}
@@ -1,11 +1,20 @@
 package cmd
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	log "github.com/Sirupsen/logrus"
 
+	"filippo.io/age"
+	"github.com/infomodels/datadirectory"
 	"github.com/infomodels/datapackage"
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
 )
 
 var compressCmd = &cobra.Command{
@@ -15,16 +24,57 @@ var compressCmd = &cobra.Command{
 
 Compress the dataset in DATADIR into a package at the filename specified with
 the output flag. If no output is specified, the data is sent to stdout. If
-keyemail is specified, a key registry is searched for a public key and it is
-used to encrypt the data. If keypath is specified, the ascii encoded file at
-that path is used to encrypt the file. Keypath overrides keyemail and if
-neither is given the data is packaged without encryption.`,
+keypath is specified, the public keys in the ascii encoded file at that path
+are used to encrypt the data. If keyemail is specified, the public key of that
+address is looked up on the keyserver and used to encrypt the data. The lookup
+must find exactly one key with a user ID of the address, or compress fails; if
+the keyserver holds several, give the intended one with keypath instead. If
+neither is given the data is packaged without encryption.
+
+The keypath and keyemail flags may be repeated (or given comma-separated
+values), and combined, to encrypt a single package for several recipients, any
+of whom can decrypt it. Multiple recipients require one of the tar formats.
+
+As an alternative to OpenPGP, tar packages can be encrypted with age for the
+recipients given by age-recipient, either age public keys (age1...) or SSH
+public keys (ssh-ed25519 or ssh-rsa lines), and those listed one per line in
+the age-recipients-file files. Such packages are conventionally named with a
+'.age' extension.
+
+If sign-key is given, the ascii armored private key at that path (decrypted
+with the contents of sign-keypass, if needed) is used to write detached
+signatures of the metadata file and of the package itself. The metadata
+signature is added to tar packages; the datapackage format cannot carry it, so
+it is written next to the package, to the output path with '.metadata.csv.sig'
+(or '.datapackage.json.sig') appended, where expand finds it. Nothing is
+written to DATADIR. The package signature is written to the output path with
+'.sig' appended. Instead of
+sign-key, sign-key-id loads the signing key from the GnuPG home directory, and
+the sign-keypass-env, sign-keypass-command, sign-keypass-agent and
+sign-keypass-prompt flags give other sources of its passphrase, as described
+for the key flags of expand. Signing requires an output path. Recipients check
+the signatures with the verify-key flag of expand and validate.
+
+The package format is given by the format flag or implied by the output
+extension: '.tar.gz' (or '.tgz') produces a gzip compressed tar archive and
+'.tar.zst' (or '.tzst') a zstd compressed one, optionally followed by '.gpg'
+when encrypted. Anything else uses the datapackage format. The tar formats are
+streamed, so they can be written to stdout, and are encrypted as a binary
+OpenPGP message.
+
+If volume-size is given (e.g. '50G', in bytes or with a K, M, G or T suffix),
+the package is split into volumes of at most that size, numbered by appending
+'.001', '.002' and so on to the output path, and a manifest listing each
+volume's size and checksum is written to the output path with '.manifest'
+appended. When signing, the manifest is signed instead of the package. Give
+expand the manifest or the first volume to reassemble the package.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		// TODO: Handle errors with more grace.
 
 		var (
 			d       *datapackage.DataPackage
+			signer  *openpgp.Entity
 			arg     string
 			encrypt = false
 			err     error
@@ -32,15 +82,26 @@ neither is given the data is packaged without encryption.`,
 
 		// Enforce single data directory argument.
 		if len(args) != 1 {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryUsage, log.Fields{
 				"args": args,
-			}).Fatal("compress requires 1 argument")
+			}, "compress requires 1 argument")
 		}
 
 		arg = args[0]
 
+		keyPaths := viper.GetStringSlice("keypath")
+		keyEmails := viper.GetStringSlice("keyemail")
+
+		ageRecipients := viper.GetStringSlice("agerecipient")
+		ageRecipientsFiles := viper.GetStringSlice("agerecipientsfile")
+		useAge := len(ageRecipients) > 0 || len(ageRecipientsFiles) > 0
+
+		if useAge && (len(keyPaths) > 0 || len(keyEmails) > 0) {
+			fatal(dataset.CategoryUsage, nil, "age recipients cannot be combined with keypath or keyemail")
+		}
+
 		// Determine if encryption will happen for logging.
-		if viper.GetString("keypath") != "" || viper.GetString("keyemail") != "" {
+		if len(keyPaths) > 0 || len(keyEmails) > 0 || useAge {
 			encrypt = true
 		}
 
@@ -54,33 +115,211 @@ neither is given the data is packaged without encryption.`,
 		// and all the arguements being used.
 		log.WithFields(log.Fields{
 			"PackagePath":    viper.GetString("output"),
-			"KeyPath":        viper.GetString("keypath"),
-			"PublicKeyEmail": viper.GetString("keyemail"),
+			"KeyPath":        keyPaths,
+			"PublicKeyEmail": keyEmails,
 		}).Debug("creating new DataPackage object")
 
-		// Create DataPackage object using all information given. It will
-		// handle all the encryption mechanics if those values are given.
-		d = &datapackage.DataPackage{
-			PackagePath:    viper.GetString("output"),
-			KeyPath:        viper.GetString("keypath"),
-			PublicKeyEmail: viper.GetString("keyemail"),
+		// Sign the metadata file before packing so that its signature is
+		// included in the package, leaving the data directory untouched.
+		var (
+			metadataSig  []byte
+			metadataName string
+		)
+
+		signKeys := viperKeySource("sign-", "signkey", "signkeypass")
+
+		if !signKeys.Empty() {
+			if viper.GetString("output") == "" {
+				fatal(dataset.CategoryUsage, nil, "compress requires an output path to sign the package")
+			}
+
+			if signer, err = readSigningKey(signKeys); err != nil {
+				fatal(dataset.CategoryConfiguration, log.Fields{
+					"key":   signKeys.String(),
+					"error": err,
+				}, "error reading signing key")
+			}
+
+			dd, err := datadirectory.New(&datadirectory.Config{DataDirPath: arg})
+			if err == nil {
+				metadataName = filepath.Base(dataset.MetadataPath(dd))
+				metadataSig, err = detachSign(dataset.MetadataPath(dd), signer)
+			}
+
+			if err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"directory": arg,
+					"error":     err,
+				}, "error signing metadata file")
+			}
+		}
+
+		packagePath := viper.GetString("output")
+
+		var volumeSize int64
+
+		if viper.GetString("volumesize") != "" {
+			if packagePath == "" {
+				fatal(dataset.CategoryUsage, nil, "compress requires an output path to split the package into volumes")
+			}
+
+			if volumeSize, err = parseSize(viper.GetString("volumesize")); err != nil {
+				fatal(dataset.CategoryUsage, log.Fields{
+					"error": err,
+				}, "error parsing volume size")
+			}
+		}
+
+		format, err := packageFormat(viper.GetString("format"), packagePath)
+		if err != nil {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"error": err,
+			}, "error determining package format")
+		}
+
+		if format == formatDataPackage {
+
+			if len(keyPaths)+len(keyEmails) > 1 {
+				fatal(dataset.CategoryUsage, log.Fields{
+					"format": format,
+				}, "multiple recipients require a tar format")
+			}
+
+			if useAge {
+				fatal(dataset.CategoryUsage, log.Fields{
+					"format": format,
+				}, "age encryption requires a tar format")
+			}
+
+			keyPath := firstString(keyPaths)
+
+			// Look up a keyemail recipient as for the tar formats and hand
+			// its key to the library in a file, rather than letting the
+			// library search its own key registry.
+			if len(keyEmails) > 0 {
+				recipients, err := recipientKeys(nil, keyEmails, viper.GetString("keyserver"))
+				if err == nil {
+					keyPath, err = writePublicKeys(recipients)
+				}
+
+				if err != nil {
+					fatal(dataset.CategoryConfiguration, log.Fields{
+						"error": err,
+					}, "error reading recipient public keys")
+				}
+			}
+
+			// Create DataPackage object using all information given. It
+			// will handle all the encryption mechanics if those values are
+			// given.
+			d = &datapackage.DataPackage{
+				PackagePath: packagePath,
+				KeyPath:     keyPath,
+			}
+
+			err = d.Pack(arg)
+
+			if len(keyEmails) > 0 {
+				os.Remove(keyPath)
+			}
+
+			if err == nil && volumeSize > 0 {
+				_, err = splitPackage(packagePath, format, volumeSize)
+			}
+
+			// The format cannot carry the metadata signature, so it is
+			// written next to the package for expand to put in place.
+			if err == nil && metadataSig != nil {
+				err = ioutil.WriteFile(metadataSignaturePath(packagePath, metadataName), metadataSig, 0644)
+			}
+
+		} else {
+
+			var encrypter func(io.Writer) (io.WriteCloser, error)
+
+			if useAge {
+				recipients, err := readAgeRecipients(ageRecipients, ageRecipientsFiles)
+				if err != nil {
+					fatal(dataset.CategoryConfiguration, log.Fields{
+						"error": err,
+					}, "error reading age recipients")
+				}
+
+				encrypter = func(w io.Writer) (io.WriteCloser, error) {
+					return age.Encrypt(w, recipients...)
+				}
+			} else if encrypt {
+				recipients, err := recipientKeys(keyPaths, keyEmails, viper.GetString("keyserver"))
+				if err != nil {
+					fatal(dataset.CategoryConfiguration, log.Fields{
+						"error": err,
+					}, "error reading recipient public keys")
+				}
+
+				for _, e := range recipients {
+					log.WithFields(log.Fields{
+						"recipient": dataset.EntityName(e),
+						"keyId":     keyIDString(e.PrimaryKey.KeyId),
+					}).Debug("encrypting for recipient")
+				}
+
+				encrypter = func(w io.Writer) (io.WriteCloser, error) {
+					return encryptWriter(w, recipients)
+				}
+			}
+
+			var extra map[string][]byte
+			if metadataSig != nil {
+				extra = map[string][]byte{metadataName + dataset.SignatureExt: metadataSig}
+			}
+
+			err = packTar(arg, format, packagePath, volumeSize, encrypter, extra)
+
 		}
 
 		// Fatal and exit if compression fails.
-		// TODO: Fix .tar.gz compatibility.
-		if err = d.Pack(arg); err != nil {
-			log.WithFields(log.Fields{
+		if err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
 				"directory": arg,
-				"package":   d.PackagePath,
+				"package":   packagePath,
+				"format":    format,
 				"encrypt":   encrypt,
 				"error":     err,
-			}).Fatal("error compressing dataset")
+			}, "error compressing dataset")
+		}
+
+		// The manifest of a package split into volumes stands in for it.
+		signedPath := packagePath
+		if volumeSize > 0 {
+			signedPath = manifestPath(packagePath)
+
+			log.WithFields(log.Fields{
+				"package":  packagePath,
+				"manifest": signedPath,
+			}).Info("split package into volumes")
+		}
+
+		// Sign the finished package.
+		if signer != nil {
+			if err = signFile(signedPath, signer); err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"package": signedPath,
+					"error":   err,
+				}, "error signing package")
+			}
+
+			log.WithFields(log.Fields{
+				"package":   signedPath,
+				"signature": signedPath + dataset.SignatureExt,
+				"signer":    dataset.EntityName(signer),
+			}).Info("signed package")
 		}
 
 		// Notify that compression succeeded.
 		log.WithFields(log.Fields{
 			"directory": arg,
-			"package":   d.PackagePath,
+			"package":   packagePath,
+			"format":    format,
 		}).Info("finished dataset compression")
 
 	},
@@ -92,12 +331,71 @@ func init() {
 	RootCmd.AddCommand(compressCmd)
 
 	// Set up the compress-command-specific flags.
-	compressCmd.Flags().String("keypath", "", "Path to a public key file for encryption.")
-	compressCmd.Flags().String("keyemail", "", "Email associated with a public key for encryption.")
+	compressCmd.Flags().StringSlice("keypath", nil, "Path to a public key file for encryption. May be repeated.")
+	compressCmd.Flags().StringSlice("keyemail", nil, "Email associated with a public key for encryption. May be repeated.")
+	compressCmd.Flags().String("keyserver", "https://keys.openpgp.org", "HKP keyserver to look up keyemail public keys on.")
 	compressCmd.Flags().StringP("output", "o", "", "Compressed package output path.")
+	compressCmd.Flags().String("sign-key", "", "Path to an ascii armored private key file for signing.")
+	compressCmd.Flags().String("sign-keypass", "", "Path to a signing key password file.")
+	compressCmd.Flags().String("volume-size", "", "Split the package into volumes of at most this size, e.g. 50G.")
+	addKeySourceFlags(compressCmd.Flags(), "sign-")
+	compressCmd.Flags().StringSlice("age-recipient", nil, "age or SSH public key to encrypt for with age. May be repeated.")
+	compressCmd.Flags().StringSlice("age-recipients-file", nil, "Path to a file of age or SSH public keys to encrypt for with age. May be repeated.")
+
+	// Add the shared flags compress uses.
+	addSharedFlags(compressCmd, "format")
+}
+
+// packTar streams the dataset in dir as a tar package in the given format to
+// the package path, or to stdout if it is empty, adding the extra files (see
+// writeTar). If the volume size is not zero, the package is split into volumes
+// of that size. If encrypter is not nil, the package is written through the
+// writer it returns.
+func packTar(dir string, format string, packagePath string, volumeSize int64, encrypter func(io.Writer) (io.WriteCloser, error), extra map[string][]byte) (err error) {
+	var w io.Writer = os.Stdout
+
+	if volumeSize > 0 {
+		vw := newVolumeWriter(packagePath, format, volumeSize)
+
+		// Closing writes the manifest, which must not fail silently.
+		defer func() {
+			if cerr := vw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+
+		w = vw
+	} else if packagePath != "" {
+		f, err := os.Create(packagePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	if encrypter == nil {
+		return writeTar(w, dir, format, extra)
+	}
+
+	ew, err := encrypter(w)
+	if err != nil {
+		return err
+	}
+
+	if err = writeTar(ew, dir, format, extra); err != nil {
+		return err
+	}
+
+	return ew.Close()
+}
+
+// firstString returns the first string of the slice, or an empty string.
+func firstString(strs []string) string {
+	if len(strs) == 0 {
+		return ""
+	}
 
-	// Bind viper keys to the flag values.
-	viper.BindPFlag("keypath", compressCmd.Flags().Lookup("keypath"))
-	viper.BindPFlag("keyemail", compressCmd.Flags().Lookup("keyemail"))
-	viper.BindPFlag("output", compressCmd.Flags().Lookup("output"))
+	return strs[0]
 }
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigFile is the name of the configuration file read from the home
+// directory if no config flag is given.
+const defaultConfigFile = ".infomodels.yaml"
+
+// configFilePath returns the path of the configuration file to read, and
+// whether it must exist: the path given by the config flag, or else the
+// default file in the home directory.
+func configFilePath() (string, bool) {
+	if p := viper.GetString("config"); p != "" {
+		return p, true
+	}
+
+	return filepath.Join(os.Getenv("HOME"), defaultConfigFile), false
+}
+
+// profileSettings returns the settings of the YAML configuration file for the
+// profile: the top-level settings, overridden by those of the profile. If no
+// profile is given, the file's default profile, if any, is used.
+//
+//	searchPath: dcc
+//	profile: nemours-dev
+//	profiles:
+//	  nemours-prod:
+//	    dburi: postgres://etl@db/pedsnet
+//	    searchPath: nemours_pedsnet
+func profileSettings(b []byte, profile string) (map[string]interface{}, error) {
+	var file map[string]interface{}
+
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{})
+
+	var profiles map[interface{}]interface{}
+
+	for name, v := range file {
+		switch name {
+		case "profile":
+			if profile == "" {
+				profile = fmt.Sprint(v)
+			}
+
+		case "profiles":
+			var ok bool
+
+			if profiles, ok = v.(map[interface{}]interface{}); !ok && v != nil {
+				return nil, fmt.Errorf("profiles must map profile names to settings")
+			}
+
+		default:
+			settings[flagKey(name)] = v
+		}
+	}
+
+	if profile == "" {
+		return settings, nil
+	}
+
+	p, ok := profiles[profile]
+	if !ok {
+		var names []string
+
+		for name := range profiles {
+			names = append(names, fmt.Sprint(name))
+		}
+
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("unknown profile '%s', choose from: %s", profile, strings.Join(names, ", "))
+	}
+
+	values, ok := p.(map[interface{}]interface{})
+	if !ok && p != nil {
+		return nil, fmt.Errorf("profile '%s' must map settings to values", profile)
+	}
+
+	for name, v := range values {
+		settings[flagKey(fmt.Sprint(name))] = v
+	}
+
+	return settings, nil
+}
+
+// readConfigFile reads the settings of the configuration file and selected
+// profile into viper, below the flags and environment variables and above the
+// defaults. The default file need not exist.
+func readConfigFile() error {
+	p, required := configFilePath()
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) && !required {
+		if viper.GetString("profile") != "" {
+			return fmt.Errorf("profile '%s' given without a configuration file", viper.GetString("profile"))
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	settings, err := profileSettings(b, viper.GetString("profile"))
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+
+	if b, err = yaml.Marshal(settings); err != nil {
+		return err
+	}
+
+	viper.SetConfigType("yaml")
+
+	return viper.ReadConfig(bytes.NewReader(b))
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfigFile = `loglvl: warn
+searchPath: dcc
+skip-indexes: true
+profile: nemours-dev
+profiles:
+  nemours-prod:
+    dburi: postgres://etl@prod/pedsnet
+    searchPath: nemours_pedsnet
+    keypath: [/keys/a.asc, /keys/b.asc]
+  nemours-dev:
+    dburi: postgres://etl@dev/pedsnet
+  empty:
+`
+
+func TestProfileSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		profile  string
+		settings map[string]interface{}
+		err      string
+	}{
+		{
+			name:    "named profile",
+			file:    testConfigFile,
+			profile: "nemours-prod",
+			settings: map[string]interface{}{
+				"loglvl":      "warn",
+				"searchPath":  "nemours_pedsnet",
+				"skipindexes": true,
+				"dburi":       "postgres://etl@prod/pedsnet",
+				"keypath":     []interface{}{"/keys/a.asc", "/keys/b.asc"},
+			},
+		},
+		{
+			name: "default profile",
+			file: testConfigFile,
+			settings: map[string]interface{}{
+				"loglvl":      "warn",
+				"searchPath":  "dcc",
+				"skipindexes": true,
+				"dburi":       "postgres://etl@dev/pedsnet",
+			},
+		},
+		{
+			name:    "empty profile",
+			file:    testConfigFile,
+			profile: "empty",
+			settings: map[string]interface{}{
+				"loglvl":      "warn",
+				"searchPath":  "dcc",
+				"skipindexes": true,
+			},
+		},
+		{
+			name:     "no profiles",
+			file:     "model: pedsnet-core\nmodelv: 2.3.0\n",
+			settings: map[string]interface{}{"model": "pedsnet-core", "modelv": "2.3.0"},
+		},
+		{
+			name:     "empty file",
+			file:     "",
+			settings: map[string]interface{}{},
+		},
+		{
+			name:    "unknown profile",
+			file:    testConfigFile,
+			profile: "seattle",
+			err:     "unknown profile 'seattle', choose from: empty, nemours-dev, nemours-prod",
+		},
+		{
+			name:    "profile without profiles",
+			file:    "model: pedsnet-core\n",
+			profile: "seattle",
+			err:     "unknown profile",
+		},
+		{
+			name: "profiles not a map",
+			file: "profiles: [a, b]\n",
+			err:  "profiles must map",
+		},
+		{
+			name:    "profile not a map",
+			file:    "profiles: {a: b}\n",
+			profile: "a",
+			err:     "profile 'a' must map",
+		},
+		{
+			name: "not yaml",
+			file: "dburi: [\n",
+			err:  "yaml",
+		},
+	}
+
+	for _, test := range tests {
+		settings, err := profileSettings([]byte(test.file), test.profile)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, expected one containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(settings, test.settings) {
+			t.Errorf("%s: settings %v, expected %v", test.name, settings, test.settings)
+		}
+	}
+}
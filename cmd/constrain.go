@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
-	"github.com/infomodels/database"
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"time"
 )
 
 var constrainCmd = &cobra.Command{
@@ -22,79 +28,150 @@ The required searchPath switch is a PostgreSQL search_path value
 containing a comma-separated list of schema names. The first schema in
 the list is the primary schema in which the constraints will be
 added. Additional schemas may be required if the tables have
-foreign keys into tables located in other schemas.`,
+foreign keys into tables located in other schemas.
+
+If the check flag is given, no constraints are added. Instead, each foreign key
+in the model that is not yet enforced (its constraint is missing or NOT VALID)
+is checked for orphaned rows (rows whose key has no match in the
+referenced table) and the orphan counts and sample keys are reported. The
+command exits non-zero if any orphans are found.
+
+If the quarantine flag is given, orphaned rows are moved out of each table
+into a side table named <table>_orphans in the primary schema, repeating until
+no orphans remain, and the constraints are then added as usual.
+
+Adding foreign keys to very large tables checks every row while holding a lock
+that blocks writes. If the notValid flag is given, the constraints are instead
+created as NOT VALID, which only applies them to new rows. The existing rows are
+then checked in a separate step by running constrain with the validate flag,
+which validates the pending constraints concurrently (see the workers flag)
+while the tables remain queryable. Validation can be interrupted and re-run;
+constraints that were already validated are skipped.
+
+If constrain is interrupted by SIGINT or SIGTERM, the constraint being added is
+rolled back and an 'aborted' entry is recorded in the version_history table. It
+then exits with status 130 (SIGINT) or 143 (SIGTERM).`,
 
 	Run: func(cmd *cobra.Command, args []string) {
 
 		var (
-			db           *database.Database
-			dburi        string
-			searchPath   string
-			dmsaservice  string
-			dataModel    string
-			modelVersion string
-			err          error
+			ctx = signalContext()
+			err error
 		)
 
+		opts := dataset.ConstrainOptions{
+			DBURI:       viper.GetString("dburi"),
+			SearchPath:  viper.GetString("searchPath"),
+			Service:     viper.GetString("service"),
+			DMSAService: viper.GetString("dmsaservice"),
+			NotValid:    viper.GetBool("notValid"),
+			Samples:     viper.GetInt("samples"),
+		}
+
 		// Enforce required dburi.
-		dburi = viper.GetString("dburi")
-		if dburi == "" {
-			log.Fatal("constrain requires a dburi")
+		if opts.DBURI == "" {
+			fatal(dataset.CategoryUsage, nil, "constrain requires a dburi")
 		}
 
 		// Enforce required searchPath.
-		searchPath = viper.GetString("searchPath")
-		if searchPath == "" {
-			log.Fatal("constrain requires a searchPath")
+		if opts.SearchPath == "" {
+			fatal(dataset.CategoryUsage, nil, "constrain requires a searchPath")
 		}
 
-		dmsaservice = viper.GetString("dmsaservice")
-
-		dataModel, modelVersion, err = getModelAndVersion(dburi, searchPath)
+		opts.Model, opts.ModelVersion, err = dataset.ModelAndVersion(opts.DBURI, opts.SearchPath)
 		if err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Fatal("Failed to get model and version")
+			fatal(dataset.CategoryOf(err), log.Fields{"err": err.Error()}, "Failed to get model and version")
 		}
 
 		if viper.GetString("model") != "" {
-			dataModel = viper.GetString("model")
+			opts.Model = viper.GetString("model")
 		}
 
 		if viper.GetString("modelv") != "" {
-			modelVersion = viper.GetString("modelv")
+			opts.ModelVersion = viper.GetString("modelv")
 		}
 
 		logFields := log.Fields{
-			"dataModel":    dataModel,
-			"modelVersion": modelVersion,
-			"dburi":        dburi,
-			"searchPath":   searchPath,
-			"dmsaservice":  dmsaservice,
+			"dataModel":    opts.Model,
+			"modelVersion": opts.ModelVersion,
+			"dburi":        opts.DBURI,
+			"searchPath":   opts.SearchPath,
+			"dmsaservice":  opts.DMSAService,
 		}
 
-		db, err = database.Open(dataModel, modelVersion, dburi, searchPath, dmsaservice, "", "")
-		if err != nil {
-			logFields["err"] = err.Error()
-			log.WithFields(logFields).Fatal("Database Open failed")
+		if viper.GetBool("check") || viper.GetBool("quarantine") {
+
+			if viper.GetBool("undo") {
+				fatal(dataset.CategoryUsage, logFields, "check and quarantine cannot be combined with undo")
+			}
+
+			var reports []*dataset.OrphanReport
+
+			checkStart := time.Now()
+
+			if viper.GetBool("quarantine") {
+				reports, err = dataset.QuarantineOrphans(ctx, opts)
+			} else {
+				reports, err = dataset.CheckOrphans(ctx, opts)
+			}
+
+			if err != nil {
+				exitIfInterrupted(ctx, logFields)
+				logFields["err"] = err.Error()
+				fatal(dataset.CategoryOf(err), logFields, "error checking for orphaned rows")
+			}
+
+			printOrphans(reports)
+
+			elapsed := time.Since(checkStart)
+			logFields["durationMinutes"] = elapsed.Minutes()
+
+			if !viper.GetBool("quarantine") {
+				if len(reports) > 0 {
+					fatal(dataset.CategoryFormat, logFields, "orphaned rows found")
+				}
+
+				log.WithFields(logFields).Info("no orphaned rows found")
+				return
+			}
+
+			log.WithFields(logFields).Info("orphaned rows quarantined")
 		}
 
-		// TODO: add switches for database error sensitivities (normal/strict/force)
+		if viper.GetBool("validate") {
+
+			if viper.GetBool("undo") {
+				fatal(dataset.CategoryUsage, logFields, "validate cannot be combined with undo")
+			}
+
+			validateNotValidConstraints(ctx, opts, viper.GetInt("workers"), logFields)
+			return
+		}
 
 		if !viper.GetBool("undo") {
 
-			log.WithFields(logFields).Info("adding foreign key constraints")
+			if opts.NotValid {
+				log.WithFields(logFields).Info("adding NOT VALID foreign key constraints")
+			} else {
+				log.WithFields(logFields).Info("adding foreign key constraints")
+			}
 
-			constraintsStart := time.Now()
-			err = db.CreateConstraints("normal")
+			result, err := dataset.Constrain(ctx, opts)
 			if err != nil {
-				elapsed := time.Since(constraintsStart)
-				logFields["durationMinutes"] = elapsed.Minutes()
+				exitIfInterrupted(ctx, logFields)
 				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("error while adding constraints")
+				fatal(dataset.CategoryOf(err), logFields, "error while adding constraints")
 			}
 
-			elapsed := time.Since(constraintsStart)
-			logFields["durationMinutes"] = elapsed.Minutes()
-			log.WithFields(logFields).Info("constraints added")
+			logFields["durationMinutes"] = result.Duration.Minutes()
+			recordStep("constraints", result.Duration)
+
+			if opts.NotValid {
+				logFields["constraintsAdded"] = result.Added
+				log.WithFields(logFields).Info("NOT VALID constraints added, run constrain with --validate to validate them")
+			} else {
+				log.WithFields(logFields).Info("constraints added")
+			}
 
 		} else {
 
@@ -102,16 +179,17 @@ foreign keys into tables located in other schemas.`,
 			log.WithFields(logFields).Info("dropping constraints")
 
 			constraintsStart := time.Now()
-			err = db.DropConstraints("normal")
+			err = dataset.DropConstraints(ctx, opts)
+
+			elapsed := time.Since(constraintsStart)
+			logFields["durationMinutes"] = elapsed.Minutes()
+
 			if err != nil {
-				elapsed := time.Since(constraintsStart)
-				logFields["durationMinutes"] = elapsed.Minutes()
+				exitIfInterrupted(ctx, logFields)
 				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("error while dropping constraints")
+				fatal(dataset.CategoryOf(err), logFields, "error while dropping constraints")
 			}
 
-			elapsed := time.Since(constraintsStart)
-			logFields["durationMinutes"] = elapsed.Minutes()
 			log.WithFields(logFields).Info("constraints dropped")
 
 		}
@@ -124,16 +202,103 @@ func init() {
 	// Register this command under the top-level CLI command.
 	RootCmd.AddCommand(constrainCmd)
 
-	// Made these into global flags because I couldn't figure out how to use them in another subcommand also.
-	// // Set up the constrain-command-specific flags.
-	// constrainCmd.Flags().StringP("dburi", "d", "", "Database URI. Required.")
-	// //	constrainCmd.Flags().StringP("dbpass", "p", "", "Database password.")
-	// constrainCmd.Flags().StringP("searchPath", "s", "", "SearchPath indicating primary and optional secondary schemas. Required.")
-	// constrainCmd.Flags().Bool("undo", false, "Undo/drop all constraints.")
-
-	// // Bind viper keys to the flag values.
-	// viper.BindPFlag("dburi", constrainCmd.Flags().Lookup("dburi"))
-	// //	viper.BindPFlag("dbpass", constrainCmd.Flags().Lookup("dbpass"))
-	// viper.BindPFlag("searchPath", constrainCmd.Flags().Lookup("searchPath"))
-	// viper.BindPFlag("undo", constrainCmd.Flags().Lookup("undo"))
+	// Set up the constrain-command-specific flags.
+	constrainCmd.Flags().Bool("check", false, "Report orphaned rows for each foreign key instead of adding constraints.")
+	constrainCmd.Flags().Bool("quarantine", false, "Move orphaned rows into <table>_orphans tables before adding constraints.")
+	constrainCmd.Flags().Int("samples", 5, "Number of sample orphaned keys to report per foreign key.")
+	constrainCmd.Flags().Bool("validate", false, "Validate the NOT VALID foreign key constraints instead of adding constraints.")
+	constrainCmd.Flags().Int("workers", 4, "Number of constraints to validate concurrently.")
+
+	// Add the shared flags constrain uses.
+	addSharedFlags(constrainCmd, "dburi", "searchPath", "undo", "notValid", "model", "modelv", "service", "dmsaservice")
+	addSharedFlags(constrainCmd, metricsFlags...)
+}
+
+// printOrphans prints a table of the orphaned rows found for each foreign
+// key, if any.
+func printOrphans(reports []*dataset.OrphanReport) {
+	if len(reports) == 0 {
+		return
+	}
+
+	tw := tablewriter.NewWriter(os.Stdout)
+
+	tw.SetHeader([]string{
+		"constraint",
+		"table",
+		"field",
+		"references",
+		"orphans",
+		"samples",
+	})
+
+	for _, report := range reports {
+		fk := report.ForeignKey
+
+		tw.Append([]string{
+			fk.Name,
+			fk.SourceTable,
+			fk.SourceField,
+			fmt.Sprintf("%s.%s", fk.TargetTable, fk.TargetField),
+			fmt.Sprint(report.Count),
+			strings.Join(report.Samples, ", "),
+		})
+	}
+
+	tw.Render()
+}
+
+// validateNotValidConstraints validates all pending NOT VALID foreign key
+// constraints in the primary schema, logging progress as each one finishes.
+func validateNotValidConstraints(ctx context.Context, opts dataset.ConstrainOptions, workers int, logFields log.Fields) {
+	pending, err := dataset.PendingConstraints(ctx, opts)
+	if err != nil {
+		exitIfInterrupted(ctx, logFields)
+		logFields["err"] = err.Error()
+		fatal(dataset.CategoryOf(err), logFields, "error listing constraints to validate")
+	}
+
+	if len(pending) == 0 {
+		log.WithFields(logFields).Info("no constraints left to validate")
+		return
+	}
+
+	logFields["pending"] = len(pending)
+	logFields["workers"] = workers
+	log.WithFields(logFields).Info("validating foreign key constraints")
+
+	var (
+		start     = time.Now()
+		completed int
+	)
+
+	err = dataset.ValidateConstraints(ctx, opts, pending, workers, func(p dataset.PendingConstraint, err error) {
+		completed++
+
+		fields := log.Fields{
+			"constraint":      p.Name,
+			"table":           p.Table,
+			"completed":       completed,
+			"total":           len(pending),
+			"durationMinutes": time.Since(start).Minutes(),
+		}
+
+		if err != nil {
+			fields["err"] = err.Error()
+			log.WithFields(fields).Error("constraint validation failed")
+			return
+		}
+
+		log.WithFields(fields).Info("constraint validated")
+	})
+
+	logFields["durationMinutes"] = time.Since(start).Minutes()
+	recordStep("constraints", time.Since(start))
+	if err != nil {
+		exitIfInterrupted(ctx, logFields)
+		logFields["err"] = err.Error()
+		fatal(dataset.CategoryOf(err), logFields, "error while validating constraints")
+	}
+
+	log.WithFields(logFields).Info("constraints validated")
 }
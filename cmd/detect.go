@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+const (
+	// minTableScore is the lowest header match score at which a table is
+	// assigned to a file without asking.
+	minTableScore = 0.8
+
+	// minTableScoreMargin is how much the best match score must exceed the
+	// second best for the match to be considered unambiguous.
+	minTableScoreMargin = 0.1
+
+	// numTableCandidates is the number of best matches listed when the
+	// match is ambiguous.
+	numTableCandidates = 3
+)
+
+// tableScore is how well a file's header matches the fields of a table.
+type tableScore struct {
+	Table string
+	Score float64
+}
+
+func (s tableScore) String() string {
+	return fmt.Sprintf("%s (%.2f)", s.Table, s.Score)
+}
+
+// scoreTables scores the header against the fields of every table in the
+// model, returning the scores from best to worst. The score is the number of
+// columns shared by the header and the table divided by the number of distinct
+// columns in either, so 1 is an exact match.
+func scoreTables(header []string, m *dms.Model) []tableScore {
+	cols := make(map[string]bool, len(header))
+	for _, col := range header {
+		cols[col] = true
+	}
+
+	var scores []tableScore
+
+	for _, table := range m.Tables.List() {
+		var (
+			shared int
+			fields = table.Fields.Names()
+		)
+
+		for _, field := range fields {
+			if cols[strings.ToLower(field)] {
+				shared++
+			}
+		}
+
+		union := len(cols) + len(fields) - shared
+		if union == 0 {
+			continue
+		}
+
+		scores = append(scores, tableScore{
+			Table: table.Name,
+			Score: float64(shared) / float64(union),
+		})
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Score > scores[j].Score
+	})
+
+	return scores
+}
+
+// detectTable matches the header of the file against the model's tables. It
+// returns the table if the best match is confident, and otherwise the top
+// candidates.
+func detectTable(filePath string, m *dms.Model) (string, []tableScore, error) {
+	header, err := dataset.ReadHeader(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	scores := scoreTables(header, m)
+	if len(scores) == 0 {
+		return "", nil, nil
+	}
+
+	best := scores[0]
+
+	if best.Score >= minTableScore && (len(scores) == 1 || best.Score-scores[1].Score >= minTableScoreMargin) {
+		return best.Table, nil, nil
+	}
+
+	if len(scores) > numTableCandidates {
+		scores = scores[:numTableCandidates]
+	}
+
+	return "", scores, nil
+}
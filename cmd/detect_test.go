@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+// testModel returns a model with tables of the given fields, decoded as the
+// model is from the data models service.
+func testModel(t *testing.T, tables [][]string) *dms.Model {
+	type field struct {
+		Name string `json:"name"`
+	}
+
+	type table struct {
+		Name   string  `json:"name"`
+		Fields []field `json:"fields"`
+	}
+
+	var ts []table
+
+	for _, fields := range tables {
+		tbl := table{Name: fields[0]}
+
+		for _, f := range fields[1:] {
+			tbl.Fields = append(tbl.Fields, field{Name: f})
+		}
+
+		ts = append(ts, tbl)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"name":    "test",
+		"version": "1.0.0",
+		"tables":  ts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m dms.Model
+
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	return &m
+}
+
+// detectModelTables are two tables sharing person_id and site, and two tables
+// of which one has a single field more than the other.
+var detectModelTables = [][]string{
+	{"person", "person_id", "gender_concept_id", "year_of_birth", "birth_datetime", "site"},
+	{"visit_occurrence", "visit_occurrence_id", "person_id", "visit_start_date", "visit_end_date", "site"},
+	{"wide", "a", "b", "c", "d", "e", "f", "g", "h", "i", "j"},
+	{"wider", "a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"},
+}
+
+func TestScoreTables(t *testing.T) {
+	m := testModel(t, detectModelTables)
+
+	scores := scoreTables([]string{"person_id", "site", "visit_start_date"}, m)
+
+	expected := []tableScore{
+		{"visit_occurrence", 3.0 / 5},
+		{"person", 2.0 / 6},
+		{"wide", 0},
+		{"wider", 0},
+	}
+
+	if len(scores) != len(expected) {
+		t.Fatalf("got %d scores, expected %d", len(scores), len(expected))
+	}
+
+	for i, s := range scores {
+		if s.Table != expected[i].Table || math.Abs(s.Score-expected[i].Score) > 1e-9 {
+			t.Errorf("score %d is %s, expected %s", i, s, expected[i])
+		}
+	}
+}
+
+func TestDetectTable(t *testing.T) {
+	m := testModel(t, detectModelTables)
+
+	tests := []struct {
+		name       string
+		file       string
+		contents   string
+		table      string
+		candidates []string
+		err        bool
+	}{
+		{
+			name:     "exact match",
+			file:     "a.csv",
+			contents: "person_id,gender_concept_id,year_of_birth,birth_datetime,site\n1,2,3,4,5\n",
+			table:    "person",
+		},
+		{
+			name:     "case, spaces and byte order mark",
+			file:     "b.csv",
+			contents: "\ufeffPerson_ID, Gender_Concept_ID ,YEAR_OF_BIRTH,birth_datetime,Site\n",
+			table:    "person",
+		},
+		{
+			name:     "confident partial match",
+			file:     "c.csv",
+			contents: "person_id,gender_concept_id,year_of_birth,site\n",
+			table:    "person",
+		},
+		{
+			name:       "ambiguous match",
+			file:       "d.csv",
+			contents:   "person_id,site\n",
+			candidates: []string{"person", "visit_occurrence", "wide"},
+		},
+		{
+			name:       "best match too close to the next",
+			file:       "e.csv",
+			contents:   "a,b,c,d,e,f,g,h,i,j\n",
+			candidates: []string{"wide", "wider", "person"},
+		},
+		{
+			name:       "no match",
+			file:       "f.csv",
+			contents:   "foo,bar\n",
+			candidates: []string{"person", "visit_occurrence", "wide"},
+		},
+		{
+			name:     "gzip compressed",
+			file:     "g.csv.gz",
+			contents: "visit_occurrence_id,person_id,visit_start_date,visit_end_date,site\n",
+			table:    "visit_occurrence",
+		},
+		{
+			name: "empty file",
+			file: "h.csv",
+			err:  true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "detect-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		p := filepath.Join(dir, test.file)
+
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Ext(p) == ".gz" {
+			gz := gzip.NewWriter(f)
+			gz.Write([]byte(test.contents))
+			gz.Close()
+		} else {
+			f.WriteString(test.contents)
+		}
+
+		f.Close()
+
+		table, candidates, err := detectTable(p, m)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if table != test.table {
+			t.Errorf("%s: detected table '%s', expected '%s'", test.name, table, test.table)
+		}
+
+		var names []string
+
+		for _, c := range candidates {
+			names = append(names, c.Table)
+		}
+
+		if len(names) != len(test.candidates) {
+			t.Errorf("%s: candidates %v, expected %v", test.name, names, test.candidates)
+			continue
+		}
+
+		for i := range names {
+			if names[i] != test.candidates[i] {
+				t.Errorf("%s: candidates %v, expected %v", test.name, names, test.candidates)
+				break
+			}
+		}
+	}
+
+	if _, _, err := detectTable(filepath.Join(dir, "missing.csv"), m); err == nil {
+		t.Error("expected an error detecting the table of a missing file")
+	}
+}
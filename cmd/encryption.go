@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// readKeyring reads the ascii armored keyring at keyPath.
+func readKeyring(keyPath string) (openpgp.EntityList, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+// readPassphrase reads a key passphrase from a file, dropping any trailing
+// newline.
+func readPassphrase(passPath string) ([]byte, error) {
+	pass, err := ioutil.ReadFile(passPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(pass, "\r\n"), nil
+}
+
+// encryptWriter returns a writer that encrypts everything written to it for
+// the recipients, any of whom can decrypt it, and writes the binary OpenPGP
+// message to w. It must be closed to complete the message.
+func encryptWriter(w io.Writer, recipients openpgp.EntityList) (io.WriteCloser, error) {
+	return openpgp.Encrypt(w, recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+}
+
+// lookupPublicKey fetches the public key for an email address from an HKP
+// keyserver. Keys without a user ID of the address are ignored, and the lookup
+// fails unless exactly one key is left, so that a package is never encrypted
+// for keys the user did not pick.
+func lookupPublicKey(keyserver string, email string) (*openpgp.Entity, error) {
+	u := fmt.Sprintf("%s/pks/lookup?op=get&options=mr&search=%s", strings.TrimRight(keyserver, "/"), url.QueryEscape(email))
+
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no public key found for %s on %s: %s", email, keyserver, resp.Status)
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched openpgp.EntityList
+
+	for _, e := range keys {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, email) {
+				matched = append(matched, e)
+				break
+			}
+		}
+	}
+
+	switch len(matched) {
+	case 0:
+		return nil, fmt.Errorf("no public key found for %s on %s", email, keyserver)
+
+	case 1:
+		return matched[0], nil
+	}
+
+	return nil, fmt.Errorf("%d public keys found for %s on %s; give the intended key with keypath", len(matched), email, keyserver)
+}
+
+// recipientKeys collects the public keys of all recipients, read from the
+// ascii armored files at the key paths and looked up on the keyserver for the
+// key emails.
+func recipientKeys(keyPaths []string, keyEmails []string, keyserver string) (openpgp.EntityList, error) {
+	var recipients openpgp.EntityList
+
+	for _, keyPath := range keyPaths {
+		keys, err := readKeyring(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", keyPath, err)
+		}
+
+		recipients = append(recipients, keys...)
+	}
+
+	for _, email := range keyEmails {
+		key, err := lookupPublicKey(keyserver, email)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, key)
+	}
+
+	return recipients, nil
+}
+
+// writePublicKeys writes the public keys to a temporary ascii armored file and
+// returns its path, for the datapackage library, which reads keys from files.
+func writePublicKeys(keys openpgp.EntityList) (string, error) {
+	f, err := ioutil.TempFile("", "infomodels-key-")
+	if err != nil {
+		return "", err
+	}
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+
+	for _, e := range keys {
+		if err != nil {
+			break
+		}
+
+		err = e.Serialize(w)
+	}
+
+	if err == nil {
+		err = w.Close()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// keyIDString formats an OpenPGP key ID the way gpg does.
+func keyIDString(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// keyIDStrings formats OpenPGP key IDs.
+func keyIDStrings(ids []uint64) []string {
+	strs := make([]string, len(ids))
+
+	for i, id := range ids {
+		strs[i] = keyIDString(id)
+	}
+
+	return strs
+}
+
+// messageRecipients returns the IDs of the keys an OpenPGP message, binary or
+// ascii armored, is encrypted to. It returns no IDs if the data is not an
+// encrypted message.
+func messageRecipients(r io.Reader) ([]uint64, error) {
+	br := bufio.NewReader(r)
+
+	if start, _ := br.Peek(10); bytes.Equal(start, []byte("-----BEGIN")) {
+		block, err := armor.Decode(br)
+		if err != nil {
+			return nil, err
+		}
+
+		r = block.Body
+	} else {
+		r = br
+	}
+
+	var (
+		ids     []uint64
+		packets = packet.NewReader(r)
+	)
+
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			// Anything other than a message yields no recipients.
+			return ids, nil
+		}
+
+		ek, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			return ids, nil
+		}
+
+		ids = append(ids, ek.KeyId)
+	}
+}
+
+// decryptReader returns a reader of the decrypted contents of the binary
+// OpenPGP message read from r, using the private keys in the keyring, and the
+// IDs of the keys the message is encrypted to. The private keys must already
+// be decrypted, see keySource.Keyring.
+func decryptReader(r io.Reader, keyring openpgp.EntityList) (io.Reader, []uint64, error) {
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		return nil, errors.New("cannot decrypt the package's private key, give its passphrase")
+	}
+
+	md, err := openpgp.ReadMessage(r, keyring, prompt, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &messageBody{md: md}, md.EncryptedToKeyIds, nil
+}
+
+// messageBody reads the decrypted body of a message. The integrity of the
+// body (its MDC) and any signature made with a known key are checked when the
+// end of the body is read, so the body must be read to the end to trust it.
+type messageBody struct {
+	md *openpgp.MessageDetails
+}
+
+func (b *messageBody) Read(p []byte) (int, error) {
+	n, err := b.md.UnverifiedBody.Read(p)
+
+	if err == io.EOF && b.md.IsSigned && b.md.SignedBy != nil && b.md.SignatureError != nil {
+		return n, fmt.Errorf("package signature: %s", b.md.SignatureError)
+	}
+
+	return n, err
+}
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armoredPublicKeys returns the ascii armored public keys of the entities.
+func armoredPublicKeys(t *testing.T, entities ...*openpgp.Entity) []byte {
+	var buf bytes.Buffer
+
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entities {
+
+		// Serializing the private key signs the identities and subkeys,
+		// which serializing the public key requires.
+		if err = e.SerializePrivate(ioutil.Discard, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = e.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.Close()
+
+	return buf.Bytes()
+}
+
+// encryptionKeyIDs returns the sorted IDs of the keys messages are encrypted
+// to for the entities.
+func encryptionKeyIDs(entities ...*openpgp.Entity) []uint64 {
+	var ids []uint64
+
+	for _, e := range entities {
+		for _, s := range e.Subkeys {
+			ids = append(ids, s.PublicKey.KeyId)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	var (
+		alice   = testEntity(t, "alice")
+		bob     = testEntity(t, "bob")
+		mallory = testEntity(t, "mallory")
+		data    = []byte("person_id\n1\n2\n")
+		message bytes.Buffer
+	)
+
+	w, err := encryptWriter(&message, openpgp.EntityList{alice, bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write(data)
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := messageRecipients(bytes.NewReader(message.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if expected := encryptionKeyIDs(alice, bob); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("recipients are %v, expected %v", keyIDStrings(ids), keyIDStrings(expected))
+	}
+
+	// Each recipient can decrypt the message on their own.
+	for _, e := range []*openpgp.Entity{alice, bob} {
+		r, _, err := decryptReader(bytes.NewReader(message.Bytes()), openpgp.EntityList{e})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.PrimaryKey.KeyIdString(), err)
+			continue
+		}
+
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%s: decrypted %q, %v", e.PrimaryKey.KeyIdString(), b, err)
+		}
+	}
+
+	if _, _, err = decryptReader(bytes.NewReader(message.Bytes()), openpgp.EntityList{mallory}); err == nil {
+		t.Error("no error decrypting with the key of another recipient")
+	}
+
+	// Data that is not a message has no recipients.
+	if ids, err = messageRecipients(bytes.NewReader(data)); err != nil || len(ids) != 0 {
+		t.Errorf("recipients of unencrypted data are %v, %v", ids, err)
+	}
+}
+
+func TestMessageRecipientsArmored(t *testing.T) {
+	alice := testEntity(t, "alice")
+
+	var buf bytes.Buffer
+
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := encryptWriter(aw, openpgp.EntityList{alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("data"))
+	w.Close()
+	aw.Close()
+
+	ids, err := messageRecipients(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := encryptionKeyIDs(alice); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("recipients are %v, expected %v", keyIDStrings(ids), keyIDStrings(expected))
+	}
+}
+
+func TestRecipientKeys(t *testing.T) {
+	var (
+		alice = testEntity(t, "alice")
+		bob   = testEntity(t, "bob")
+		twin  = testEntity(t, "bob")
+	)
+
+	keys := map[string][]byte{
+		"alice@example.org": armoredPublicKeys(t, alice),
+		"bob@example.org":   armoredPublicKeys(t, bob, twin),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := keys[r.URL.Query().Get("search")]
+		if r.URL.Path != "/pks/lookup" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(key)
+	}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.Write(armoredPublicKeys(t, bob))
+	f.Close()
+
+	recipients, err := recipientKeys([]string{f.Name()}, []string{"alice@example.org"}, server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recipients) != 2 || recipients[0].PrimaryKey.KeyId != bob.PrimaryKey.KeyId || recipients[1].PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+		t.Errorf("recipients are %v", recipients)
+	}
+
+	// Lookups must find exactly one key.
+	for _, email := range []string{"bob@example.org", "eve@example.org"} {
+		if _, err = recipientKeys(nil, []string{email}, server.URL); err == nil {
+			t.Errorf("%s: no error looking up the key", email)
+		}
+	}
+
+	// The keys written for the datapackage library read back the same.
+	keyPath, err := writePublicKeys(recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyPath)
+
+	written, err := readKeyring(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(written) != 2 || written[0].PrivateKey != nil || written[1].PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+		t.Errorf("written keys are %v", written)
+	}
+}
+
+func TestKeyIDString(t *testing.T) {
+	if s := keyIDString(0xABCDEF); s != fmt.Sprintf("%016X", 0xABCDEF) || s != "0000000000ABCDEF" {
+		t.Errorf("keyIDString = %s", s)
+	}
+}
+
+func TestUnpackDataPackageDecrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		recipient   = testEntity(t, "recipient")
+		packagePath = filepath.Join(dir, "in", "package.zip")
+		out         = filepath.Join(dir, "out")
+		message     bytes.Buffer
+	)
+
+	w, err := encryptWriter(&message, openpgp.EntityList{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("not a zip file"))
+	w.Close()
+
+	os.Mkdir(filepath.Dir(packagePath), 0755)
+
+	if err = ioutil.WriteFile(packagePath, message.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An environment variable for the passphrase makes the package be
+	// decrypted before the library reads it.
+	keys := &keySource{KeyPath: writePrivateKey(t, dir, recipient), PassEnv: "INFOMODELS_TEST_PASS"}
+
+	unpackDataPackage(context.Background(), packagePath, out, keys)
+
+	// The decrypted package is neither left behind nor written next to
+	// the package.
+	for _, d := range []string{filepath.Dir(packagePath), out} {
+		infos, _ := ioutil.ReadDir(d)
+
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), ".package-") {
+				t.Errorf("temporary file %s left in %s", info.Name(), d)
+			}
+		}
+	}
+
+	if infos, _ := ioutil.ReadDir(filepath.Dir(packagePath)); len(infos) != 1 {
+		t.Errorf("%d files next to the package", len(infos))
+	}
+}
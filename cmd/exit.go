@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+// exitStatuses are the exit statuses of the commands by the category of their
+// failure, as documented in the help of the root command. Interrupted commands
+// exit with the status of the signal instead (see signalStatus).
+var exitStatuses = map[dataset.Category]int{
+	dataset.CategoryOther:         1,
+	dataset.CategoryUsage:         2,
+	dataset.CategoryConfiguration: 3,
+	dataset.CategoryService:       4,
+	dataset.CategoryChecksum:      5,
+	dataset.CategoryFormat:        6,
+	dataset.CategoryDatabase:      7,
+}
+
+// exitStatus is the status the process exits with after a fatal log entry.
+var exitStatus = 1
+
+func init() {
+
+	// Logrus exits with status 1 after a fatal log entry, after running its
+	// exit handlers, so this one exits with the status of the failure first.
+	log.RegisterExitHandler(func() {
+		os.Exit(exitStatus)
+	})
+}
+
+// fatal logs the message and fields with the category of the failure at the
+// fatal level, and exits with the category's status. The failure is counted in
+// the metrics, which are pushed first.
+func fatal(category dataset.Category, fields log.Fields, msg string) {
+	if fields == nil {
+		fields = log.Fields{}
+	}
+
+	failures.WithLabelValues(string(category)).Inc()
+	pushMetrics()
+
+	fields["category"] = category
+
+	if status, ok := exitStatuses[category]; ok {
+		exitStatus = status
+	}
+
+	log.WithFields(fields).Fatal(msg)
+}
+
+// statusCategory returns the category of the failure an infomodels process
+// exited with the status for, or CategoryOther if the status is not one of
+// exitStatuses.
+func statusCategory(status int) dataset.Category {
+	for category, s := range exitStatuses {
+		if s == status {
+			return category
+		}
+	}
+
+	return dataset.CategoryOther
+}
+
+// stepCategory returns the category of the failure of an infomodels process
+// run by runInfomodels from its exit status, or CategoryOther if it did not
+// exit with one.
+func stepCategory(err error) dataset.Category {
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			return statusCategory(ws.ExitStatus())
+		}
+	}
+
+	return dataset.CategoryOther
+}
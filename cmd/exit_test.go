@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+func TestExitStatuses(t *testing.T) {
+	seen := make(map[int]dataset.Category)
+
+	for category, status := range exitStatuses {
+		if other, ok := seen[status]; ok {
+			t.Errorf("%s and %s share the exit status %d", category, other, status)
+		}
+
+		seen[status] = category
+
+		if c := statusCategory(status); c != category {
+			t.Errorf("status %d is of category %s, expected %s", status, c, category)
+		}
+	}
+
+	if c := statusCategory(130); c != dataset.CategoryOther {
+		t.Errorf("status 130 is of category %s, expected %s", c, dataset.CategoryOther)
+	}
+}
+
+func TestStepCategory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	err := exec.Command("sh", "-c", "exit 4").Run()
+
+	if c := stepCategory(err); c != dataset.CategoryService {
+		t.Errorf("step exiting with status 4 is of category %s, expected %s", c, dataset.CategoryService)
+	}
+
+	if c := stepCategory(errors.New("executable file not found")); c != dataset.CategoryOther {
+		t.Errorf("step that did not run is of category %s, expected %s", c, dataset.CategoryOther)
+	}
+}
@@ -1,9 +1,19 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/infomodels/datapackage"
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -17,13 +27,53 @@ var expandCmd = &cobra.Command{
 Expand the DATAPACKAGE file into the directory specified in the required
 output flag. If keypath is given, use the keyring file (ascii encoded private
 and public keys) at keypath to decrypt the package. If keypasspath is given,
-use its contents as the keyring passcode.`,
+use its contents as the keyring passcode.
+
+Instead of keypath, key-id loads the private key with that ID from the GnuPG
+home directory (gnupg-home, $GNUPGHOME or ~/.gnupg): from a legacy secring.gpg
+keyring, or else by exporting it with gpg. Instead of keypasspath, the
+passphrase can be read from the environment variable named by keypass-env,
+from the output of keypass-command (run with an empty stdin, which may carry
+the package), from a running gpg-agent (keypass-agent) or from an interactive
+prompt (keypass-prompt), so it never has to be written to disk.
+
+Tar packages encrypted with age are decrypted with the age-identity files,
+which hold age secret keys (AGE-SECRET-KEY-1...) or SSH private keys. The
+passphrase of an encrypted SSH key comes from the keypass flags above.
+
+If verify-key is given, the detached signature written by compress next to the
+package (DATAPACKAGE.sig) is checked against the ascii armored public key(s) at
+that path before the package is expanded. The signature of the metadata file of
+a datapackage format package, written by compress next to it, is put next to
+the expanded metadata file for validate to check.
+
+The package format is given by the format flag or implied by the package
+extension, as described for compress. If DATAPACKAGE is '-', a tar package is
+read from stdin and its compression detected from the data. Encrypted tar
+packages are decrypted with the keyring at keypath while they are read. The key
+IDs of all the recipients an encrypted package is encrypted for are logged.
+
+If DATAPACKAGE is the manifest ('.manifest') or first volume ('.001') of a
+package split into volumes by compress, the volumes are reassembled in order
+and each is checked against the size and checksum in the manifest as it is
+read. The package is extracted into a staging directory in the output
+directory, whose contents are moved into place only once every volume has been
+checked. The signature of such a package is that of its manifest.
+
+If verify is given, the metadata file of the expanded dataset is read and the
+checksums (and any sizes, row counts, columns and encodings) it records are
+checked against the data files. If validate is given, the data files are also
+validated against the format of their tables in the model definition, as the
+validate command does. Expand exits with a non-zero status if any check
+fails.
+
+If expand is interrupted by SIGINT or SIGTERM, the file being extracted is
+removed and it exits with status 130 (SIGINT) or 143 (SIGTERM).`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		// TODO: Handle errors with more grace.
 
 		var (
-			d       *datapackage.DataPackage
 			arg     string
 			decrypt = false
 			err     error
@@ -31,20 +81,23 @@ use its contents as the keyring passcode.`,
 
 		// Enforce single data package argument.
 		if len(args) != 1 {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryUsage, log.Fields{
 				"args": args,
-			}).Fatal("expand requires 1 argument")
+			}, "expand requires 1 argument")
 		}
 
 		arg = args[0]
 
 		// Enforce required output path.
 		if viper.GetString("output") == "" {
-			log.Fatal("expand requires an output path")
+			fatal(dataset.CategoryUsage, nil, "expand requires an output path")
 		}
 
+		keys := viperKeySource("", "keypath", "keypasspath")
+		keys.AgeIdentities = viper.GetStringSlice("ageidentity")
+
 		// Determine if decryption will happen for logging.
-		if viper.GetString("keypath") != "" {
+		if !keys.Empty() {
 			decrypt = true
 		}
 
@@ -60,24 +113,151 @@ use its contents as the keyring passcode.`,
 			"PackagePath": arg,
 			"KeyPath":     viper.GetString("keypath"),
 			"KeyPassPath": viper.GetString("keypasspath"),
+			"KeyID":       keys.KeyID,
 		}).Debug("creating new DataPackage object")
 
-		// Create DataPackage object using all information given. It will
-		// handle all the decryption mechanics if those values are given.
-		d = &datapackage.DataPackage{
-			PackagePath: arg,
-			KeyPath:     viper.GetString("keypath"),
-			KeyPassPath: viper.GetString("keypasspath"),
+		ctx := signalContext()
+
+		// The manifest of a package split into volumes stands in for it.
+		signedPath := arg
+		formatPath := arg
+
+		volumes := isVolumePath(arg)
+		if volumes {
+			signedPath = volumeManifestPath(arg)
+
+			manifest, err := readVolumeManifest(signedPath)
+			if err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"package": arg,
+					"error":   err,
+				}, "error reading volume manifest")
+			}
+
+			formatPath = manifest.Package
+
+			log.WithFields(log.Fields{
+				"manifest": signedPath,
+				"volumes":  len(manifest.Volumes),
+				"size":     manifest.Size,
+			}).Info("reassembling package from volumes")
 		}
 
-		// Fatal and exit if expansion fails.
-		if err = d.Unpack(viper.GetString("output")); err != nil {
+		// Check the package signature before touching its contents.
+		if viper.GetString("verifykey") != "" {
+			if arg == "-" {
+				fatal(dataset.CategoryUsage, nil, "signatures cannot be verified for packages read from stdin")
+			}
+
+			signer, err := verifyFile(signedPath, viper.GetString("verifykey"))
+			if err != nil {
+				fatal(dataset.CategoryOf(err), log.Fields{
+					"package": signedPath,
+					"error":   err,
+				}, "error verifying package signature")
+			}
+
 			log.WithFields(log.Fields{
+				"package": signedPath,
+				"signer":  dataset.EntityName(signer),
+			}).Info("verified package signature")
+		}
+
+		format, err := packageFormat(viper.GetString("format"), formatPath)
+		if err != nil {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"error": err,
+			}, "error determining package format")
+		}
+
+		// Only tar packages are encrypted with age. Stdin is always read as
+		// a tar package.
+		if format == formatDataPackage && arg != "-" && len(keys.AgeIdentities) > 0 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"format": format,
+			}, "age encryption requires a tar format")
+		}
+
+		if volumes && format != formatDataPackage {
+
+			var vr io.ReadCloser
+
+			// The volumes are verified as they are read, so the package
+			// is extracted into a staging directory until they all are.
+			if _, vr, err = openVolumes(arg); err == nil {
+				err = unpackStaged(viper.GetString("output"), func(dir string) error {
+					err := unpackTar(ctx, vr, format, dir, keys)
+
+					if cerr := vr.Close(); err == nil {
+						err = cerr
+					}
+
+					return err
+				})
+			}
+
+		} else if volumes {
+
+			// The datapackage format is read from a file, so the volumes
+			// are joined into a temporary one first.
+			var joined string
+
+			if joined, err = joinVolumes(arg); err == nil {
+				err = unpackDataPackage(ctx, joined, viper.GetString("output"), keys)
+				os.Remove(joined)
+			}
+
+			if err == nil {
+				err = placeMetadataSignature(strings.TrimSuffix(signedPath, manifestExt), viper.GetString("output"))
+			}
+
+		} else if arg == "-" {
+
+			// Only tar packages can be streamed. Detect the compression
+			// unless a format was given.
+			if format == formatDataPackage {
+				if viper.GetString("format") != "" {
+					fatal(dataset.CategoryUsage, nil, "the datapackage format cannot be read from stdin")
+				}
+
+				format = ""
+			}
+
+			err = unpackTar(ctx, os.Stdin, format, viper.GetString("output"), keys)
+
+		} else if format != formatDataPackage {
+
+			var f *os.File
+
+			if f, err = os.Open(arg); err == nil {
+				err = unpackTar(ctx, f, format, viper.GetString("output"), keys)
+				f.Close()
+			}
+
+		} else {
+
+			err = unpackDataPackage(ctx, arg, viper.GetString("output"), keys)
+
+			if err == nil {
+				err = placeMetadataSignature(arg, viper.GetString("output"))
+			}
+
+		}
+
+		// Fatal and exit if expansion fails.
+		if err != nil {
+			exitIfInterrupted(ctx, log.Fields{
+				"package":   arg,
+				"directory": viper.GetString("output"),
+			})
+
+			fatal(dataset.CategoryOf(err), log.Fields{
 				"package":   arg,
+				"format":    format,
 				"decrypt":   decrypt,
 				"directory": viper.GetString("output"),
 				"error":     err,
-			}).Fatal("error expanding package")
+			}, "error expanding package")
 		}
 
 		// Notify that expansion succeeded.
@@ -87,6 +267,10 @@ use its contents as the keyring passcode.`,
 			"decrypt":   decrypt,
 		}).Info("finished package expansion")
 
+		if viper.GetBool("verify") || viper.GetBool("validate") {
+			checkExpanded(ctx, viper.GetString("output"), viper.GetBool("validate"))
+		}
+
 	},
 }
 
@@ -99,9 +283,209 @@ func init() {
 	expandCmd.Flags().String("keypath", "", "Path to a keyring file for decryption.")
 	expandCmd.Flags().String("keypasspath", "", "Path to a key password file for decryption.")
 	expandCmd.Flags().StringP("output", "o", "", "Directory for output. Required.")
+	expandCmd.Flags().Bool("verify", false, "Verify the checksums of the expanded dataset.")
+	expandCmd.Flags().Bool("validate", false, "Verify the checksums and validate the format of the expanded dataset.")
+	addKeySourceFlags(expandCmd.Flags(), "")
+	expandCmd.Flags().StringSlice("age-identity", nil, "Path to an age identity or SSH private key file for decryption. May be repeated.")
+
+	// Add the shared flags expand uses.
+	addSharedFlags(expandCmd, "service", "jobs", "format", "verify-key")
+	addSharedFlags(expandCmd, metricsFlags...)
+}
+
+// unpackTar extracts the tar package read from r into dir, decrypting it with
+// the age identities or private key from the key source if one is selected. An
+// empty format is detected from the data. Reading stops once the context is
+// cancelled.
+func unpackTar(ctx context.Context, r io.Reader, format string, dir string, keys *keySource) error {
+	if !keys.Empty() {
+		var (
+			recipients []string
+			err        error
+		)
+
+		if r, recipients, err = decryptPackage(bufio.NewReader(r), keys); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"recipients": recipients,
+		}).Info("package encrypted for recipients")
+	}
+
+	return readTar(dataset.ContextReader(ctx, r), dir, format)
+}
+
+// unpackStaged runs unpack to extract a package into a staging directory in
+// dir and moves what it extracted into dir once it succeeds, so that nothing
+// from a package that fails a check made as it is read, such as that of a
+// later volume, is left in dir. The staging directory is removed either way.
+func unpackStaged(dir string, unpack func(string) error) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(dir, ".expand-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err = unpack(staging); err != nil {
+		return err
+	}
+
+	return moveInto(staging, dir)
+}
+
+// moveInto moves the files and directories in src into dst, merging
+// directories that exist in both.
+func moveInto(src string, dst string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		from := filepath.Join(src, info.Name())
+		to := filepath.Join(dst, info.Name())
+
+		if info.IsDir() {
+			if existing, err := os.Stat(to); err == nil && existing.IsDir() {
+				if err = moveInto(from, to); err != nil {
+					return err
+				}
+
+				continue
+			}
+		}
+
+		if err = os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpackDataPackage expands the datapackage format package at packagePath into
+// dir. The library decrypts packages itself given key and passphrase files;
+// keys from other sources are used to decrypt the package into a temporary
+// file first, until the context is cancelled. The library reads the package
+// from a file, so the decrypted one is kept private to the user in dir rather
+// than next to the package, and removed however the command ends. Age
+// identities cannot decrypt the format.
+func unpackDataPackage(ctx context.Context, packagePath string, dir string, keys *keySource) error {
+	if len(keys.AgeIdentities) > 0 {
+		return errors.New("age encryption requires a tar format")
+	}
+
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return err
+	}
+
+	// Log who the package is encrypted for, if it is.
+	if ids, _ := messageRecipients(f); len(ids) > 0 {
+		log.WithFields(log.Fields{
+			"recipients": keyIDStrings(ids),
+		}).Info("package encrypted for recipients")
+	}
+
+	f.Close()
+
+	if keys.FilesOnly() {
+
+		// Create DataPackage object using all information given. It
+		// will handle all the decryption mechanics if those values are
+		// given.
+		d := &datapackage.DataPackage{
+			PackagePath: packagePath,
+			KeyPath:     keys.KeyPath,
+			KeyPassPath: keys.PassPath,
+		}
+
+		return d.Unpack(dir)
+	}
+
+	keyring, err := keys.Keyring()
+	if err != nil {
+		return err
+	}
+
+	if f, err = os.Open(packagePath); err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, _, err := decryptReader(f, keyring)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Temporary files are created with mode 0600.
+	tmp, err := ioutil.TempFile(dir, ".package-")
+	if err != nil {
+		return err
+	}
+	defer removeOnExit(tmp.Name())()
+
+	if _, err = io.Copy(tmp, dataset.ContextReader(ctx, r)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	d := &datapackage.DataPackage{
+		PackagePath: tmp.Name(),
+	}
+
+	return d.Unpack(dir)
+}
+
+// checkExpanded verifies the metadata file and checksums of the dataset
+// expanded into dir and, if validate is set, the format of its files, exiting
+// non-zero on any problem.
+func checkExpanded(ctx context.Context, dir string, validate bool) {
+	report, err := dataset.Validate(ctx, dir, dataset.ValidateOptions{
+		Service:    viper.GetString("service"),
+		Jobs:       viper.GetInt("jobs"),
+		SkipFormat: !validate,
+		OnFile:     reportFile,
+	})
+	if err != nil {
+		exitIfInterrupted(ctx, log.Fields{
+			"directory": dir,
+		})
+
+		fatal(dataset.CategoryOf(err), log.Fields{
+			"directory": dir,
+			"error":     err,
+		}, "error validating expanded dataset")
+	}
+
+	log.WithFields(log.Fields{
+		"directory": dir,
+	}).Info("verified checksums of expanded dataset")
+
+	if !validate {
+		return
+	}
+
+	if !report.Valid() {
+		fatal(dataset.CategoryFormat, log.Fields{
+			"directory": dir,
+		}, "format validation of expanded dataset found issues")
+	}
 
-	// Bind viper keys to the flag values.
-	viper.BindPFlag("keypath", expandCmd.Flags().Lookup("keypath"))
-	viper.BindPFlag("keypasspath", expandCmd.Flags().Lookup("keypasspath"))
-	viper.BindPFlag("output", expandCmd.Flags().Lookup("output"))
+	log.WithFields(log.Fields{
+		"directory": dir,
+	}).Info("validated format of expanded dataset")
 }
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [flags] DATADIR",
+	Short: "export a data model instance from a database",
+	Long: `Export the data model instance in the dburi specified database to DATADIR
+
+Export the tables of the data model instance located in the database specified
+by the dburi switch and the first schema of the searchPath switch to CSV files
+in DATADIR, one per table named after it, and write a metadata file describing
+them, as annotate does. The model and model version are looked up in the
+database in the version_history table, unless given with the model and modelv
+switches. The result is a dataset that can be validated, packaged with
+compress or loaded elsewhere.
+
+Every table of the model found in the schema is exported, unless the tables
+flag names the ones to export. Each file has a header of the table's fields,
+its values as PostgreSQL renders them as text and empty fields for NULLs.
+
+The site, datav and etl flags are recorded in the metadata file, along with the
+checksum of each file, calculated with the algorithm given by the checksum flag,
+and its statistics.
+
+If export is interrupted by SIGINT or SIGTERM, the file being written is
+removed and no metadata file is written. It then exits with status 130 (SIGINT)
+or 143 (SIGTERM).`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Enforce single data directory argument.
+		if len(args) != 1 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"args": args,
+			}, "export requires 1 argument")
+		}
+
+		arg := args[0]
+
+		// Enforce required dburi.
+		if viper.GetString("dburi") == "" {
+			fatal(dataset.CategoryUsage, nil, "export requires a dburi")
+		}
+
+		// Enforce required search path.
+		if viper.GetString("searchPath") == "" {
+			fatal(dataset.CategoryUsage, nil, "export requires a searchPath")
+		}
+
+		if err := dataset.CheckWriteChecksumAlgorithm(viper.GetString("checksum")); err != nil {
+			fatal(dataset.CategoryOf(err), log.Fields{
+				"checksum": viper.GetString("checksum"),
+				"error":    err,
+			}, "invalid checksum algorithm")
+		}
+
+		opts := dataset.ExportOptions{
+			DBURI:        viper.GetString("dburi"),
+			SearchPath:   viper.GetString("searchPath"),
+			Model:        viper.GetString("model"),
+			ModelVersion: viper.GetString("modelv"),
+			Service:      viper.GetString("service"),
+			Tables:       viper.GetStringSlice("tables"),
+		}
+
+		logFields := log.Fields{
+			"directory":  arg,
+			"DbUrl":      opts.DBURI,
+			"SearchPath": opts.SearchPath,
+		}
+
+		log.WithFields(logFields).Info("beginning dataset export")
+
+		ctx := signalContext()
+
+		result, err := dataset.Export(ctx, arg, opts)
+		if err != nil {
+			exitIfInterrupted(ctx, logFields)
+			logFields["err"] = err.Error()
+			fatal(dataset.CategoryOf(err), logFields, "Export failed")
+		}
+
+		recordStep("export", result.Duration)
+
+		logFields["DataModel"] = result.Model
+		logFields["ModelVersion"] = result.ModelVersion
+		logFields["tables"] = len(result.Files)
+		logFields["durationMinutes"] = result.Duration.Minutes()
+		log.WithFields(logFields).Info("tables exported")
+
+		// Describe the exported files in a metadata file.
+		d, err := datadirectory.New(&datadirectory.Config{
+			DataDirPath:  arg,
+			DataVersion:  viper.GetString("datav"),
+			Etl:          viper.GetString("etl"),
+			Model:        result.Model,
+			ModelVersion: result.ModelVersion,
+			Service:      opts.Service,
+			Site:         viper.GetString("site"),
+		})
+		if err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
+				"directory": arg,
+				"error":     err,
+			}, "error creating DataDirectory object")
+		}
+
+		d.RecordMaps = exportRecords(result, dataset.Attrs{
+			Site:         viper.GetString("site"),
+			Model:        result.Model,
+			ModelVersion: result.ModelVersion,
+			DataVersion:  viper.GetString("datav"),
+			Etl:          viper.GetString("etl"),
+		})
+
+		if err = dataset.ChecksumRecords(ctx, d, d.RecordMaps, viper.GetString("checksum"), viper.GetInt("jobs")); err != nil {
+			exitIfInterrupted(ctx, logFields)
+			fatal(dataset.CategoryOther, log.Fields{
+				"directory": arg,
+				"error":     err,
+			}, "error calculating checksums")
+		}
+
+		if err = writeMetadataFile(d); err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
+				"directory": arg,
+				"error":     err,
+			}, "error writing metadata to file")
+		}
+
+		log.WithFields(log.Fields{
+			"directory": arg,
+		}).Info("finished dataset export")
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(exportCmd)
+
+	// Set up the export-command-specific flags.
+	exportCmd.Flags().StringSlice("tables", nil, "Tables of the model to export (default all those in the schema).")
+	exportCmd.Flags().String("site", "", "Name of the organization or site to record in the metadata file.")
+	exportCmd.Flags().String("datav", "", "Dataset version number to record in the metadata file.")
+	exportCmd.Flags().String("etl", "", "URL of the ETL code to record in the metadata file.")
+	exportCmd.Flags().String("checksum", dataset.DefaultChecksumAlgorithm, "Checksum algorithm [sha256|sha512|blake3].")
+
+	// Add the shared flags export uses.
+	addSharedFlags(exportCmd, "dburi", "searchPath", "model", "modelv", "service", "jobs")
+	addSharedFlags(exportCmd, metricsFlags...)
+}
+
+// exportRecords returns the metadata records of the exported files, in table
+// order, with the non-empty dataset attributes.
+func exportRecords(result *dataset.ExportResult, attrs dataset.Attrs) []map[string]string {
+	var tables []string
+
+	for table := range result.Files {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	records := make([]map[string]string, len(tables))
+
+	for i, table := range tables {
+		record := map[string]string{
+			"filename": result.Files[table],
+			"table":    table,
+		}
+
+		for key, value := range attrs.Fields() {
+			if value != "" {
+				record[key] = value
+			}
+		}
+
+		records[i] = record
+	}
+
+	return records
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// sharedFlags register the flags that several commands accept, so that each is
+// defined once. Commands add the ones they use with addSharedFlags.
+var sharedFlags = map[string]func(*pflag.FlagSet){
+	"service": func(flags *pflag.FlagSet) {
+		flags.String("service", "", "Data models service URL.")
+	},
+	"dmsaservice": func(flags *pflag.FlagSet) {
+		flags.String("dmsaservice", "", "Data models SQLAlchemy service URL.")
+	},
+	"model": func(flags *pflag.FlagSet) {
+		flags.StringP("model", "m", "", "Data model of the dataset.")
+	},
+	"modelv": func(flags *pflag.FlagSet) {
+		flags.StringP("modelv", "v", "", "Data model version number.")
+	},
+	"dburi": func(flags *pflag.FlagSet) {
+		flags.StringP("dburi", "d", "", "Database URI of the dataset.")
+	},
+	"searchPath": func(flags *pflag.FlagSet) {
+		flags.StringP("searchPath", "s", "", "SearchPath of the dataset (secondary schemas may be needed for adding constraints).")
+	},
+	"undo": func(flags *pflag.FlagSet) {
+		flags.Bool("undo", false, "Undo the command: drop the tables, indexes or constraints it creates.")
+	},
+	"notValid": func(flags *pflag.FlagSet) {
+		flags.Bool("notValid", false, "Create foreign key constraints as NOT VALID, to be validated later with 'constrain --validate'.")
+	},
+	"jobs": func(flags *pflag.FlagSet) {
+		flags.IntP("jobs", "j", runtime.NumCPU(), "Number of files to checksum concurrently.")
+	},
+	"format": func(flags *pflag.FlagSet) {
+		flags.String("format", "", "Package format [datapackage|tar.gz|tar.zst], implied by the package extension if not given.")
+	},
+	"verify-key": func(flags *pflag.FlagSet) {
+		flags.String("verify-key", "", "Path to an ascii armored public key file to verify signatures with.")
+	},
+	"metrics-addr": func(flags *pflag.FlagSet) {
+		flags.String("metrics-addr", "", "Address to serve Prometheus metrics at /metrics on while running, e.g. ':9100'.")
+	},
+	"metrics-push": func(flags *pflag.FlagSet) {
+		flags.String("metrics-push", "", "URL of a Prometheus Pushgateway to push the metrics to when finished.")
+	},
+	"metrics-job": func(flags *pflag.FlagSet) {
+		flags.String("metrics-job", "infomodels", "Job name to push the metrics under.")
+	},
+}
+
+// addSharedFlags adds the named shared flags to the command.
+func addSharedFlags(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		sharedFlags[name](cmd.Flags())
+	}
+}
+
+// flagKey returns the viper key of a flag, which is its name without dashes.
+func flagKey(name string) string {
+	return strings.Replace(name, "-", "", -1)
+}
+
+// bindFlags binds viper keys to the flags of the command being run. Only that
+// command's flags are bound, so that commands can have flags of the same name
+// without one replacing the binding of another.
+func bindFlags(cmd *cobra.Command, args []string) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		viper.BindPFlag(flagKey(f.Name), f)
+	})
+}
+
+// commandAccepts reports whether the named command accepts the flag, as one
+// of its own flags or a global one.
+func commandAccepts(command string, flag string) bool {
+	if RootCmd.PersistentFlags().Lookup(flag) != nil {
+		return true
+	}
+
+	for _, c := range RootCmd.Commands() {
+		if c.Name() == command {
+			return c.Flags().Lookup(flag) != nil
+		}
+	}
+
+	return false
+}
+
+// acceptedOptions returns the options that the named command accepts as flags.
+func acceptedOptions(command string, options map[string]interface{}) map[string]interface{} {
+	accepted := make(map[string]interface{})
+
+	for name, v := range options {
+		if commandAccepts(command, name) {
+			accepted[name] = v
+		}
+	}
+
+	return accepted
+}
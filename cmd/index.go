@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/database"
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index [flags]",
+	Short: "add indexes to a data model instance",
+	Long: `Add indexes to a data model instance.
+
+Add the indexes defined by the model to the data model instance located in the
+database specified by the dburi switch and further specified by the searchPath
+switch. The model and model version are looked up in the database in the
+version_history table, unless given with the model and modelv switches.
+
+Load adds the indexes itself unless its skip-indexes flag is given; this
+command adds them separately, e.g. as a step of a pipeline. If the undo flag is
+given, the indexes are dropped instead.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var (
+			db           *database.Database
+			dburi        string
+			searchPath   string
+			dmsaservice  string
+			dataModel    string
+			modelVersion string
+			err          error
+		)
+
+		// Enforce required dburi.
+		dburi = viper.GetString("dburi")
+		if dburi == "" {
+			fatal(dataset.CategoryUsage, nil, "index requires a dburi")
+		}
+
+		// Enforce required searchPath.
+		searchPath = viper.GetString("searchPath")
+		if searchPath == "" {
+			fatal(dataset.CategoryUsage, nil, "index requires a searchPath")
+		}
+
+		dmsaservice = viper.GetString("dmsaservice")
+
+		dataModel, modelVersion, err = dataset.ModelAndVersion(dburi, searchPath)
+		if err != nil {
+			fatal(dataset.CategoryOf(err), log.Fields{"err": err.Error()}, "Failed to get model and version")
+		}
+
+		if viper.GetString("model") != "" {
+			dataModel = viper.GetString("model")
+		}
+
+		if viper.GetString("modelv") != "" {
+			modelVersion = viper.GetString("modelv")
+		}
+
+		logFields := log.Fields{
+			"dataModel":    dataModel,
+			"modelVersion": modelVersion,
+			"dburi":        dburi,
+			"searchPath":   searchPath,
+			"dmsaservice":  dmsaservice,
+		}
+
+		db, err = database.Open(dataModel, modelVersion, dburi, searchPath, dmsaservice, "", "")
+		if err != nil {
+			logFields["err"] = err.Error()
+			fatal(dataset.CategoryDatabase, logFields, "Database Open failed")
+		}
+
+		indexesStart := time.Now()
+
+		if !viper.GetBool("undo") {
+
+			log.WithFields(logFields).Info("adding indexes")
+
+			err = db.CreateIndexes("normal")
+			logFields["durationMinutes"] = time.Since(indexesStart).Minutes()
+			if err != nil {
+				logFields["err"] = err.Error()
+				fatal(dataset.CategoryDatabase, logFields, "error while adding indexes")
+			}
+
+			recordStep("indexes", time.Since(indexesStart))
+			log.WithFields(logFields).Info("indexes added")
+
+		} else {
+
+			log.WithFields(logFields).Info("dropping indexes")
+
+			err = db.DropIndexes("normal")
+			logFields["durationMinutes"] = time.Since(indexesStart).Minutes()
+			if err != nil {
+				logFields["err"] = err.Error()
+				fatal(dataset.CategoryDatabase, logFields, "error while dropping indexes")
+			}
+
+			log.WithFields(logFields).Info("indexes dropped")
+
+		}
+
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(indexCmd)
+
+	// Add the shared flags index uses.
+	addSharedFlags(indexCmd, "dburi", "searchPath", "undo", "model", "modelv", "dmsaservice")
+	addSharedFlags(indexCmd, metricsFlags...)
+}
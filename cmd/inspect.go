@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// maxMetadataSize limits how much of an embedded metadata file is printed.
+const maxMetadataSize = 1 << 20
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [flags] PACKAGE",
+	Short: "list the contents of a package",
+	Long: `List the contents of PACKAGE without expanding it
+
+Stream through the package and print the recipients it is encrypted for, the
+files it contains with their sizes and the contents of the embedded metadata
+file (and datapackage.json descriptor, if any). Nothing is written to disk.
+
+If the package is encrypted and keypath is given, the keyring file at keypath
+(decrypted with the contents of keypasspath, if needed) is used to decrypt it
+while it is read. The private key and its passphrase can also come from the
+other sources described for expand, and age encrypted packages are decrypted
+with the age-identity files. Without a key only the recipients of an
+encrypted package are printed. If PACKAGE is '-', the package is read from stdin.
+
+If PACKAGE is the manifest ('.manifest') or first volume ('.001') of a package
+split into volumes, the volumes are read in order and each is checked against
+the size and checksum in the manifest.
+
+The whole package is read, so that the checks at its end, such as the gzip or
+zstd checksum and the integrity check of an encrypted package, are made.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var (
+			arg string
+			r   io.Reader = os.Stdin
+			err error
+		)
+
+		// Enforce single package argument.
+		if len(args) != 1 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"args": args,
+			}, "inspect requires 1 argument")
+		}
+
+		arg = args[0]
+
+		formatPath := arg
+
+		var volumes io.ReadCloser
+
+		if isVolumePath(arg) {
+			var manifest *volumeManifest
+
+			if manifest, volumes, err = openVolumes(arg); err != nil {
+				fatal(dataset.CategoryOf(err), log.Fields{
+					"package": arg,
+					"error":   err,
+				}, "error opening package volumes")
+			}
+
+			formatPath = manifest.Package
+			r = volumes
+		}
+
+		format, err := packageFormat(viper.GetString("format"), formatPath)
+		if err != nil {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"error": err,
+			}, "error determining package format")
+		}
+
+		// Detect the compression of datapackage format packages.
+		if format == formatDataPackage {
+			format = ""
+		}
+
+		if arg != "-" && volumes == nil {
+			f, err := os.Open(arg)
+			if err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"package": arg,
+					"error":   err,
+				}, "error opening package")
+			}
+			defer f.Close()
+
+			r = f
+		}
+
+		keys := viperKeySource("", "keypath", "keypasspath")
+		keys.AgeIdentities = viper.GetStringSlice("ageidentity")
+
+		err = inspectPackage(os.Stdout, r, format, keys)
+
+		// Read whatever is left of the volumes, such as those of an
+		// encrypted package listed without a key, so that every volume is
+		// checked.
+		if volumes != nil {
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, volumes)
+			}
+
+			if cerr := volumes.Close(); err == nil {
+				err = cerr
+			}
+		}
+
+		if err != nil {
+			fatal(dataset.CategoryOf(err), log.Fields{
+				"package": arg,
+				"error":   err,
+			}, "error inspecting package")
+		}
+
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(inspectCmd)
+
+	// Set up the inspect-command-specific flags.
+	inspectCmd.Flags().String("keypath", "", "Path to a keyring file for decryption.")
+	inspectCmd.Flags().String("keypasspath", "", "Path to a key password file for decryption.")
+	addKeySourceFlags(inspectCmd.Flags(), "")
+	inspectCmd.Flags().StringSlice("age-identity", nil, "Path to an age identity or SSH private key file for decryption. May be repeated.")
+
+	// Add the shared flags inspect uses.
+	addSharedFlags(inspectCmd, "format")
+}
+
+// packageMember is a file in a package.
+type packageMember struct {
+	Name string
+	Size int64
+}
+
+// isMetadataMember reports whether a package member holds dataset metadata.
+func isMetadataMember(name string) bool {
+	base := path.Base(name)
+	return base == dataset.MetadataFile || base == dataset.DataPackageFile
+}
+
+// inspectPackage reads the package from r and prints its recipients, members
+// and metadata to w. Encrypted packages are decrypted with the private key from
+// the key source if one is selected.
+func inspectPackage(w io.Writer, r io.Reader, format string, keys *keySource) error {
+	br := bufio.NewReader(r)
+
+	// Anything that is not a compressed archive is taken to be an
+	// encrypted one.
+	if sniffFormat(br) == "" {
+		if keys.Empty() {
+			recipients, err := packageRecipients(br)
+			if err != nil {
+				return err
+			}
+
+			if len(recipients) == 0 {
+				return fmt.Errorf("package is not a compressed tar archive or an encrypted message")
+			}
+
+			fmt.Fprintf(w, "Recipients: %s\n", strings.Join(recipients, ", "))
+
+			log.Warn("package is encrypted, give a key to list its contents")
+
+			return nil
+		}
+
+		dr, recipients, err := decryptPackage(br, keys)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Recipients: %s\n", strings.Join(recipients, ", "))
+
+		br = bufio.NewReader(dr)
+	} else {
+		fmt.Fprintln(w, "Recipients: none, the package is not encrypted")
+	}
+
+	cr, err := decompressReader(br, format)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	var (
+		members  []*packageMember
+		metadata = make(map[string][]byte)
+		total    int64
+		tr       = tar.NewReader(cr)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		members = append(members, &packageMember{
+			Name: hdr.Name,
+			Size: hdr.Size,
+		})
+
+		total += hdr.Size
+
+		if isMetadataMember(hdr.Name) {
+			if metadata[hdr.Name], err = ioutil.ReadAll(io.LimitReader(tr, maxMetadataSize)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The archive ends before the stream does. Read the rest so that the
+	// checks made at its end are not skipped, as readTar does.
+	if _, err = io.Copy(ioutil.Discard, cr); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+
+	tw := tablewriter.NewWriter(w)
+
+	tw.SetHeader([]string{
+		"file",
+		"size",
+	})
+
+	tw.SetFooter([]string{
+		fmt.Sprintf("%d files", len(members)),
+		strconv.FormatInt(total, 10),
+	})
+
+	for _, m := range members {
+		tw.Append([]string{
+			m.Name,
+			strconv.FormatInt(m.Size, 10),
+		})
+	}
+
+	tw.Render()
+
+	for _, m := range members {
+		b, ok := metadata[m.Name]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n==> %s <==\n%s", m.Name, b)
+
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			fmt.Fprintln(w)
+		}
+
+		if m.Size > maxMetadataSize {
+			fmt.Fprintf(w, "... (%d more bytes)\n", m.Size-maxMetadataSize)
+		}
+	}
+
+	return nil
+}
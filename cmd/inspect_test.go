@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writePrivateKey writes the ascii armored private key of the entity to a file
+// in dir, returning its path.
+func writePrivateKey(t *testing.T, dir string, e *openpgp.Entity) string {
+	keyPath := filepath.Join(dir, "secring.asc")
+
+	f, err := os.Create(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPath
+}
+
+func TestInspectPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, testDataset)
+
+	var pkg bytes.Buffer
+
+	if err = writeTar(&pkg, src, formatTarGz, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	if err = inspectPackage(&out, bytes.NewReader(pkg.Bytes()), formatTarGz, &keySource{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"not encrypted", "person.csv", "extra/visit.csv", "4 FILES", "==> " + dataset.MetadataFile + " <==", testDataset[dataset.MetadataFile]} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output does not contain %q:\n%s", s, out.String())
+		}
+	}
+
+	// The gzip checksum at the end of the stream is checked.
+	b := append([]byte(nil), pkg.Bytes()...)
+	b[len(b)-8] ^= 0xff
+
+	if err = inspectPackage(ioutil.Discard, bytes.NewReader(b), formatTarGz, &keySource{}); err != gzip.ErrChecksum {
+		t.Errorf("error %v inspecting a package with a bad checksum, expected %v", err, gzip.ErrChecksum)
+	}
+}
+
+func TestInspectEncryptedPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		recipient = testEntity(t, "recipient")
+		src       = writeTestDir(t, dir, testDataset)
+		pkg       bytes.Buffer
+	)
+
+	w, err := encryptWriter(&pkg, openpgp.EntityList{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writeTar(w, src, formatTarZst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients := strings.Join(keyIDStrings(encryptionKeyIDs(recipient)), ", ")
+
+	// Without a key only the recipients are listed.
+	var out bytes.Buffer
+
+	if err = inspectPackage(&out, bytes.NewReader(pkg.Bytes()), "", &keySource{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "Recipients: "+recipients+"\n" {
+		t.Errorf("output without a key is %q", out.String())
+	}
+
+	out.Reset()
+
+	keys := &keySource{KeyPath: writePrivateKey(t, dir, recipient)}
+
+	if err = inspectPackage(&out, bytes.NewReader(pkg.Bytes()), "", keys); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"Recipients: " + recipients, "person.csv", testDataset[dataset.MetadataFile]} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output does not contain %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestInspectVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, testDataset)
+
+	var pkg bytes.Buffer
+
+	if err = writeTar(&pkg, src, formatTarGz, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	packagePath, _ := writeVolumes(t, dir, pkg.Bytes(), 100)
+
+	_, r, err := openVolumes(manifestPath(packagePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	if err = inspectPackage(&out, r, formatTarGz, &keySource{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Errorf("unexpected error closing the volumes: %s", err)
+	}
+
+	if !strings.Contains(out.String(), "extra/visit.csv") {
+		t.Errorf("output does not list the files:\n%s", out.String())
+	}
+}
@@ -0,0 +1,433 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/elgamal"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// keySource locates a private key and the passphrase that unlocks it. The key
+// is read from the ascii armored keyring at KeyPath or, if that is empty,
+// loaded by KeyID from the GnuPG home directory. The passphrase is taken from
+// the first of the passphrase sources that is set. AgeIdentities are files of
+// age identities, used instead for age encrypted packages; the passphrase of
+// an encrypted SSH key among them comes from the same sources.
+type keySource struct {
+	KeyPath   string
+	KeyID     string
+	GnupgHome string
+
+	AgeIdentities []string
+
+	PassPath    string
+	PassEnv     string
+	PassCommand string
+	PassAgent   bool
+	PassPrompt  bool
+}
+
+// addKeySourceFlags registers the flags selecting a private key and the source
+// of its passphrase, named with the prefix, and the shared gnupg-home flag.
+func addKeySourceFlags(flags *pflag.FlagSet, prefix string) {
+	flags.String(prefix+"key-id", "", "ID of a private key to load from the GnuPG home directory.")
+	flags.String(prefix+"keypass-env", "", "Name of an environment variable holding the key passphrase.")
+	flags.String(prefix+"keypass-command", "", "Command that prints the key passphrase.")
+	flags.Bool(prefix+"keypass-agent", false, "Ask a running gpg-agent for the key passphrase.")
+	flags.Bool(prefix+"keypass-prompt", false, "Prompt for the key passphrase on the terminal.")
+	flags.String("gnupg-home", "", "GnuPG home directory to load key-id from (default $GNUPGHOME or ~/.gnupg).")
+}
+
+// viperKeySource returns the keySource set by the flags registered with the
+// prefix and the viper keys of the key and passphrase paths.
+func viperKeySource(prefix string, keyPathKey string, passPathKey string) *keySource {
+	key := func(name string) string {
+		return flagKey(prefix + name)
+	}
+
+	return &keySource{
+		KeyPath:     viper.GetString(keyPathKey),
+		KeyID:       viper.GetString(key("key-id")),
+		GnupgHome:   viper.GetString("gnupghome"),
+		PassPath:    viper.GetString(passPathKey),
+		PassEnv:     viper.GetString(key("keypass-env")),
+		PassCommand: viper.GetString(key("keypass-command")),
+		PassAgent:   viper.GetBool(key("keypass-agent")),
+		PassPrompt:  viper.GetBool(key("keypass-prompt")),
+	}
+}
+
+// Empty reports whether no key is selected.
+func (s *keySource) Empty() bool {
+	return s.KeyPath == "" && s.KeyID == "" && len(s.AgeIdentities) == 0
+}
+
+// FilesOnly reports whether the key and any passphrase are read from files.
+func (s *keySource) FilesOnly() bool {
+	return s.KeyID == "" && s.PassEnv == "" && s.PassCommand == "" && !s.PassAgent && !s.PassPrompt
+}
+
+// String describes where the key comes from.
+func (s *keySource) String() string {
+	if s.KeyPath != "" {
+		return s.KeyPath
+	}
+
+	return fmt.Sprintf("%s in %s", s.KeyID, s.gnupgHome())
+}
+
+// Keyring reads the keyring and decrypts its encrypted private keys with the
+// passphrase, which is asked for at most once. Keys are left encrypted if no
+// passphrase source is set.
+func (s *keySource) Keyring() (openpgp.EntityList, error) {
+	var (
+		keyring openpgp.EntityList
+		err     error
+	)
+
+	if s.KeyPath != "" {
+		keyring, err = readKeyring(s.KeyPath)
+	} else {
+		keyring, err = readGnupgKey(s.gnupgHome(), s.KeyID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pass []byte
+
+	for _, e := range keyring {
+		keys := []*packet.PrivateKey{e.PrivateKey}
+
+		for _, sub := range e.Subkeys {
+			keys = append(keys, sub.PrivateKey)
+		}
+
+		for _, k := range keys {
+			if k == nil || !k.Encrypted {
+				continue
+			}
+
+			if pass == nil {
+				if pass, err = s.passphrase(keyIDString(e.PrimaryKey.KeyId), k.PublicKey.PublicKey); err != nil {
+					return nil, err
+				}
+
+				if pass == nil {
+					return keyring, nil
+				}
+			}
+
+			if err = k.Decrypt(pass); err != nil {
+				return nil, fmt.Errorf("cannot decrypt private key %s: %s", keyIDString(k.KeyId), err)
+			}
+		}
+	}
+
+	return keyring, nil
+}
+
+// passphrase returns the passphrase from the first source that is set, or nil
+// if none is. The key ID names the key to the user; gpg-agent caches the
+// passphrase of the encrypted key by the keygrip of its public key.
+func (s *keySource) passphrase(keyID string, key crypto.PublicKey) ([]byte, error) {
+	switch {
+	case s.PassPath != "":
+		return readPassphrase(s.PassPath)
+
+	case s.PassEnv != "":
+		pass, ok := os.LookupEnv(s.PassEnv)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", s.PassEnv)
+		}
+
+		return []byte(pass), nil
+
+	case s.PassCommand != "":
+		return commandPassphrase(s.PassCommand)
+
+	case s.PassAgent:
+		return agentPassphrase(s.gnupgHome(), keyID, key)
+
+	case s.PassPrompt:
+		return promptPassphrase(keyID)
+	}
+
+	return nil, nil
+}
+
+// gnupgHome returns the GnuPG home directory.
+func (s *keySource) gnupgHome() string {
+	if s.GnupgHome != "" {
+		return s.GnupgHome
+	}
+
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return home
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".gnupg")
+}
+
+// matchesKeyID reports whether the entity's primary key or a subkey has the
+// key ID, given as a short or long key ID or a fingerprint.
+func matchesKeyID(e *openpgp.Entity, keyID string) bool {
+	keyID = strings.ToUpper(strings.TrimPrefix(strings.Replace(keyID, " ", "", -1), "0x"))
+
+	keys := []*packet.PublicKey{e.PrimaryKey}
+
+	for _, sub := range e.Subkeys {
+		keys = append(keys, sub.PublicKey)
+	}
+
+	for _, k := range keys {
+		if strings.HasSuffix(fmt.Sprintf("%X", k.Fingerprint), keyID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readGnupgKey loads the private key with the key ID from the GnuPG home
+// directory. The legacy secring.gpg keyring is read directly; otherwise the
+// key is exported with gpg, which may ask for its passphrase.
+func readGnupgKey(home string, keyID string) (openpgp.EntityList, error) {
+	if f, err := os.Open(filepath.Join(home, "secring.gpg")); err == nil {
+		keyring, err := openpgp.ReadKeyRing(f)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range keyring {
+			if e.PrivateKey != nil && matchesKeyID(e, keyID) {
+				return openpgp.EntityList{e}, nil
+			}
+		}
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("gpg", "--homedir", home, "--batch", "--armor", "--export-secret-keys", keyID)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exporting key %s from %s: %s: %s", keyID, home, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no private key %s found in %s", keyID, home)
+	}
+
+	return openpgp.ReadArmoredKeyRing(bytes.NewReader(out))
+}
+
+// commandPassphrase runs the command with the shell and returns its output,
+// dropping any trailing newline. The command's stdin is left empty, since it
+// may carry a package; a command that prompts must use the terminal.
+func commandPassphrase(command string) ([]byte, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("passphrase command failed: %s", err)
+	}
+
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// promptPassphrase asks for the passphrase on the terminal without echoing it.
+// The controlling terminal is used so that stdin can carry a package.
+func promptPassphrase(keyID string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot prompt for a passphrase without a terminal: %s", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Passphrase for key %s: ", keyID)
+
+	pass, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+
+	return pass, err
+}
+
+// agentSocket returns the path of the gpg-agent socket for the GnuPG home.
+func agentSocket(home string) string {
+	out, err := exec.Command("gpgconf", "--homedir", home, "--list-dirs", "agent-socket").Output()
+	if err == nil && len(bytes.TrimSpace(out)) > 0 {
+		return string(bytes.TrimSpace(out))
+	}
+
+	return filepath.Join(home, "S.gpg-agent")
+}
+
+// assuanEscape escapes a GET_PASSPHRASE argument.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "+", "%2B", " ", "+").Replace(s)
+}
+
+// assuanUnescape decodes the percent escapes of an Assuan data line.
+func assuanUnescape(s string) ([]byte, error) {
+	var b []byte
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("bad escape in gpg-agent response")
+		}
+
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad escape in gpg-agent response")
+		}
+
+		b = append(b, byte(c))
+		i += 2
+	}
+
+	return b, nil
+}
+
+// keygrip returns the keygrip of the public key, the SHA-1 hash of its
+// parameters as libgcrypt computes it, which gpg-agent names keys and caches
+// their passphrases by. Only RSA, DSA and ElGamal keys are supported.
+func keygrip(key crypto.PublicKey) ([]byte, error) {
+	h := sha1.New()
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		h.Write(gripMPI(k.N))
+
+	case *dsa.PublicKey:
+		writeGripParams(h, "p", k.P, "q", k.Q, "g", k.G, "y", k.Y)
+
+	case *elgamal.PublicKey:
+		writeGripParams(h, "p", k.P, "g", k.G, "y", k.Y)
+
+	default:
+		return nil, fmt.Errorf("cannot compute the keygrip of a %T key", key)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// gripMPI returns the big-endian bytes of n with a leading zero byte if its
+// top bit is set, as in libgcrypt's standard MPI format.
+func gripMPI(n *big.Int) []byte {
+	b := n.Bytes()
+
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+
+	return b
+}
+
+// writeGripParams writes the named parameters, given as pairs of a name and a
+// value, as the S-expressions libgcrypt hashes for DSA and ElGamal keygrips.
+func writeGripParams(w io.Writer, params ...interface{}) {
+	for i := 0; i < len(params); i += 2 {
+		name := params[i].(string)
+		value := gripMPI(params[i+1].(*big.Int))
+
+		fmt.Fprintf(w, "(%d:%s%d:", len(name), name, len(value))
+		w.Write(value)
+		fmt.Fprint(w, ")")
+	}
+}
+
+// agentPassphrase asks the gpg-agent of the GnuPG home for the passphrase of
+// the key, which it takes from its cache or asks the user for with pinentry.
+// The passphrase is cached by the key's keygrip, as gpg does, so one set with
+// gpg-preset-passphrase is found. An empty or cancelled reply is an error.
+func agentPassphrase(home string, keyID string, key crypto.PublicKey) ([]byte, error) {
+	grip, err := keygrip(key)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", agentSocket(home))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to gpg-agent: %s", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// The agent greets with an OK line.
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "OK") {
+		return nil, fmt.Errorf("unexpected gpg-agent greeting: %q %v", line, err)
+	}
+
+	fmt.Fprintf(conn, "GET_PASSPHRASE --data %X X %s %s\n",
+		grip,
+		assuanEscape("Passphrase:"),
+		assuanEscape(fmt.Sprintf("Enter the passphrase for key %s", keyID)))
+
+	var pass []byte
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading from gpg-agent: %s", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "D "):
+			data, err := assuanUnescape(line[2:])
+			if err != nil {
+				return nil, err
+			}
+
+			pass = append(pass, data...)
+
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			if len(pass) == 0 {
+				return nil, fmt.Errorf("gpg-agent returned an empty passphrase for key %s", keyID)
+			}
+
+			return pass, nil
+
+		case strings.HasPrefix(line, "ERR"):
+			if strings.Contains(strings.ToLower(line), "cancel") {
+				return nil, fmt.Errorf("passphrase entry for key %s was cancelled", keyID)
+			}
+
+			return nil, fmt.Errorf("gpg-agent: %s", line)
+
+		case strings.HasPrefix(line, "INQUIRE"):
+			fmt.Fprint(conn, "END\n")
+		}
+	}
+}
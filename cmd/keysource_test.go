@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// gripKey is an RSA key with an ElGamal subkey exported by gpg, whose
+// keygrips gpg --with-keygrip lists as gripKeygrips.
+const gripKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EatU3vAEEAMMZ9QutCBqgbQX72JIcVP/sq7D4A5lw2nyJQW3MuY5X8sZ+6wul
+mDefHBJuftbbX6A5YOOw3I71kvjeh5HjsCCNkYZvKgmlMhoUyMsEo69bcaZjDhpf
+dROI7mAUqhVoXD99MOEPFgr/TaZXfQlOmixIBdiPv0BKwwLqUkp9hp0bABEBAAG0
+F2dyaXAgPGdyaXBAZXhhbXBsZS5vcmc+iM4EEwEKADgWIQTnLSIk5ahHhCWWISMc
+jWuxgb85jwUCatU3vAIbAwULCQgHAgYVCgkICwIEFgIDAQIeAQIXgAAKCRAcjWux
+gb85jyMSBADCYpAz68LTiXkv8PwBn9NigMs6Z/U3bFRRpYVr636o0ncRfMql/Ht/
+yyM0QLnhf5tblcx1Y2NKpyQzxYNylU2UdVOG6T/ZY3nzcCKEYKiz4wbAQMLniRQ2
+Sq+dinJjbYiFsm58oipmrNaakkxPKejO8DmEQQ00Byj29UiOam3L9LkBDQRq1Te9
+EAQA1pfpc9MIgpE2+jiD7cLz/DZp1SByf2TuTGh0Wti+5ADC89uqWwgYM/A+JQTs
+Ircy8E8bOBMn1P98obnVj5YuzFELt5+BT7+DZtSpctdTxdbjRz4R1pOkNZiTas8Z
+m9KiRmIMESs8mOZODcOs1sBEcAUUTXeM6fFniEqMwKvTT8MAAwUEAIQ9xnFvkzrJ
+TnTzniTR8i23+TwrBoZUJGhxwkRSApIWViIvD4zSf3YTVBeUCv7TpXaCvGzfpP/b
+iZcvjk72mSPW2zSe9PyoO2OFeHw29WK1FdUh78dYNyrTnNCNzrRAvzY4FwV1uQwd
+Lim/crvACfApbyWkP1vkCrii+rzxkUSXiLYEGAEKACAWIQTnLSIk5ahHhCWWISMc
+jWuxgb85jwUCatU3vQIbDAAKCRAcjWuxgb85j33tBACnqNj8+tIo1nEiSgo7Tenf
+aHctcyhvVhHESwyxKfwTK7F3N0Y2yUURqg2tgRL9t61OaAZQzDddJvRgZoAsC94k
+X6PpKiTIsLynwLMRIzgA4PONZ0fn+xW/YEjzqEQC78zgz/rD4Y9cLvWtwm4mFZiV
+H2GTWK1yGPJRt1zVy/ULPw==
+=c8Su
+-----END PGP PUBLIC KEY BLOCK-----`
+
+var gripKeygrips = []string{
+	"84E62A6741E1EEDDD7A2C4CA3F90D41039893EB9",
+	"6EA25C302D5499E75E8DC05F28EC5CE4A270239D",
+}
+
+func TestKeygrip(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(gripKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := keyring[0]
+
+	for i, key := range []interface{}{e.PrimaryKey.PublicKey, e.Subkeys[0].PublicKey.PublicKey} {
+		grip, err := keygrip(key)
+		if err != nil {
+			t.Errorf("%T: unexpected error: %s", key, err)
+		} else if s := fmt.Sprintf("%X", grip); s != gripKeygrips[i] {
+			t.Errorf("%T: keygrip is %s, expected %s", key, s, gripKeygrips[i])
+		}
+	}
+
+	if _, err = keygrip("not a key"); err == nil {
+		t.Error("no error computing the keygrip of an unsupported key")
+	}
+}
+
+func TestAssuanEscape(t *testing.T) {
+	s := "Enter 100% of the a+b passphrase"
+
+	escaped := assuanEscape(s)
+	if escaped != "Enter+100%25+of+the+a%2Bb+passphrase" {
+		t.Errorf("assuanEscape(%q) = %q", s, escaped)
+	}
+
+	if b, err := assuanUnescape("pass%25word%0A%2B"); err != nil || string(b) != "pass%word\n+" {
+		t.Errorf("assuanUnescape = %q, %v", b, err)
+	}
+
+	for _, s := range []string{"pass%2", "pass%zz"} {
+		if _, err := assuanUnescape(s); err == nil {
+			t.Errorf("%q: no error for a bad escape", s)
+		}
+	}
+}
+
+// fakeAgent serves one gpg-agent connection on the agent socket of the GnuPG
+// home. After the greeting it reads the command, which it sends on the
+// returned channel, and writes the replies, reading a line from the client
+// between each.
+func fakeAgent(t *testing.T, home string, replies ...string) <-chan string {
+	socket := agentSocket(home)
+
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			close(commands)
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "OK Pleased to meet you\n")
+
+		line, _ := r.ReadString('\n')
+		commands <- line
+
+		for i, reply := range replies {
+			if i > 0 {
+				r.ReadString('\n')
+			}
+
+			fmt.Fprint(conn, reply)
+		}
+	}()
+
+	return commands
+}
+
+func TestAgentPassphrase(t *testing.T) {
+	home, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(gripKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := keyring[0].Subkeys[0].PublicKey.PublicKey
+
+	tests := []struct {
+		replies []string
+		pass    string
+		err     string
+	}{
+		{[]string{"D secret%25pass\nOK\n"}, "secret%pass", ""},
+		{[]string{"INQUIRE PINENTRY_LAUNCHED 1234\n", "D secret\nOK\n"}, "secret", ""},
+		{[]string{"OK\n"}, "", "empty passphrase"},
+		{[]string{"ERR 83886179 Operation cancelled <Pinentry>\n"}, "", "cancelled"},
+		{[]string{"ERR 67108881 No pinentry <GPG Agent>\n"}, "", "No pinentry"},
+	}
+
+	for _, test := range tests {
+		commands := fakeAgent(t, home, test.replies...)
+
+		pass, err := agentPassphrase(home, "1C8D6BB181BF398F", key)
+
+		// The passphrase is cached by the keygrip of the key.
+		if command := <-commands; !strings.HasPrefix(command, "GET_PASSPHRASE --data "+gripKeygrips[1]+" ") {
+			t.Errorf("command is %q", command)
+		}
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: error is %v, expected one containing %q", test.replies, err, test.err)
+			}
+		} else if err != nil || !bytes.Equal(pass, []byte(test.pass)) {
+			t.Errorf("%q: passphrase is %q, %v, expected %q", test.replies, pass, err, test.pass)
+		}
+
+		os.Remove(agentSocket(home))
+	}
+}
+
+func TestPassphraseSources(t *testing.T) {
+	f, err := ioutil.TempFile("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("from file\n")
+	f.Close()
+
+	os.Setenv("INFOMODELS_TEST_PASS", "from env")
+	defer os.Unsetenv("INFOMODELS_TEST_PASS")
+
+	tests := []struct {
+		source *keySource
+		pass   string
+	}{
+		{&keySource{}, ""},
+		{&keySource{PassPath: f.Name(), PassEnv: "INFOMODELS_TEST_PASS"}, "from file"},
+		{&keySource{PassEnv: "INFOMODELS_TEST_PASS", PassCommand: "echo from command"}, "from env"},
+		{&keySource{PassCommand: "echo from command"}, "from command"},
+	}
+
+	for _, test := range tests {
+		pass, err := test.source.passphrase("0000000000ABCDEF", nil)
+		if err != nil || string(pass) != test.pass {
+			t.Errorf("%+v: passphrase is %q, %v, expected %q", test.source, pass, err, test.pass)
+		}
+	}
+
+	if _, err = (&keySource{PassEnv: "INFOMODELS_TEST_UNSET"}).passphrase("0000000000ABCDEF", nil); err == nil {
+		t.Error("no error for an unset passphrase environment variable")
+	}
+}
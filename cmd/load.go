@@ -1,13 +1,10 @@
 package cmd
 
 import (
-	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/infomodels/database"
-	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"time"
 )
 
 var loadCmd = &cobra.Command{
@@ -17,179 +14,140 @@ var loadCmd = &cobra.Command{
 
 Load the dataset in DATADIR by using the metadata to determine which
 file to load into which table. The model tables are created, data
-loaded, indexes created, and finally constraints added.
+loaded, indexes created, and finally constraints added. If the notValid flag
+is given, the foreign key constraints are created as NOT VALID and must be
+validated afterwards with 'constrain --validate'.
 
 The tables are automatically vacuum/analyzed after they are loaded.
 
+The skip-indexes and skip-constraints flags leave out adding the indexes or
+constraints, to add them later with the index and constrain commands.
+
+If the metadata file records the byte size and header columns of the data
+files, they are checked before loading, and the recorded row counts are used to
+report loading progress.
+
 The required searchPath switch is a PostgreSQL search_path value
 containing a comma-separated list of schema names. The first schema in
 the list is the primary schema into which the data will be
 loaded. Additional schemas may be required when applying constraints
 if the loaded tables have foreign keys into other schemas.
+
+Files are loaded one at a time. If load is interrupted by SIGINT or SIGTERM
+while they are, the file being loaded is rolled back, no other file is loaded,
+an 'aborted' entry is recorded in the version_history table and the tables that
+were not in the schema before the load are dropped, so that it can be run
+again. If it is interrupted while adding indexes or constraints, the 'aborted'
+entry is recorded but the loaded tables are kept, for the index and constrain
+commands to finish the job. It then exits with status 130 (SIGINT) or 143
+(SIGTERM). A second signal exits at once.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		var (
-			d   *datadirectory.DataDirectory
-			cfg *datadirectory.Config
-			db  *database.Database
-			arg string
-			err error
-		)
-
 		// Enforce single data directory argument.
 		if len(args) != 1 {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryUsage, log.Fields{
 				"args": args,
-			}).Fatal("load requires 1 argument")
+			}, "load requires 1 argument")
 		}
 
-		arg = args[0]
+		arg := args[0]
 
 		// Enforce required dburi.
 		if viper.GetString("dburi") == "" {
-			log.Fatal("load requires a dburi")
+			fatal(dataset.CategoryUsage, nil, "load requires a dburi")
 		}
 
 		// Enforce required search path.
 		if viper.GetString("searchPath") == "" {
-			log.Fatal("load requires a searchPath")
+			fatal(dataset.CategoryUsage, nil, "load requires a searchPath")
 		}
 
 		log.WithFields(log.Fields{
 			"directory": arg,
 		}).Info("beginning dataset loading")
 
-		// Make the DataDirectory object and load it from the metadata file,
-		// see cmd/validate.go for that process.
-		cfg = &datadirectory.Config{DataDirPath: arg}
-		d, err = datadirectory.New(cfg)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("Error reading data directory: %v", err))
-		}
-
-		err = d.ReadMetadataFromFile()
-		if err != nil {
-			log.Fatal(fmt.Sprintf("Error reading metadata file: %v", err))
-		}
-
 		// The data model in the data directory can be overridden by the
 		// --model command line switch. E.g. the non-vocbulary `pedsnet`
 		// data model is ordinarily overridden as `--model=pedsnet-core`,
 		// and the vocabulary is overridden as `--model=pedsnet-vocab`
-
-		dataModel := d.Model
-		if viper.GetString("model") != "" {
-			dataModel = viper.GetString("model")
-		}
-
-		modelVersion := d.ModelVersion
-		if viper.GetString("modelv") != "" {
-			modelVersion = viper.GetString("modelv")
+		opts := dataset.LoadOptions{
+			DBURI:           viper.GetString("dburi"),
+			SearchPath:      viper.GetString("searchPath"),
+			Model:           viper.GetString("model"),
+			ModelVersion:    viper.GetString("modelv"),
+			Service:         viper.GetString("service"),
+			DMSAService:     viper.GetString("dmsaservice"),
+			SkipIndexes:     viper.GetBool("skipindexes"),
+			SkipConstraints: viper.GetBool("skipconstraints"),
+			NotValid:        viper.GetBool("notValid"),
 		}
 
-		// Open the Database object using information from the DataDirectory
-		// object. Create tables and load data, then constraints and indexes.
+		// Count what is loaded as it is, so that a failed load reports the
+		// rows it did load.
+		var loadedRows int64
 
-		// TODO: should we enforce (in validate) that all models and model
-		// versions in the metadata file are the same, and in
-		// datadirectory, should ReadMetadataFromFile set the model and
-		// model version in the datadirectory object? Eh, probably not.
-		// We should loop over the metadata, opening the database for each
-		// table we load.
-
-		logFields := log.Fields{
-			"DataModel":    dataModel,
-			"ModelVersion": modelVersion,
-			"DbUrl":        viper.GetString("dburi"),
-			"SearchPath":   viper.GetString("searchPath"),
-			"Service":      viper.GetString("service"),
+		opts.OnFile = func(f *dataset.LoadedFile) {
+			loadedRows += f.Rows
+			recordLoadedFile(f)
 		}
 
-		db, err = database.Open(dataModel, modelVersion, viper.GetString("dburi"), viper.GetString("searchPath"), viper.GetString("dmsaservice"), "", "")
-		if err != nil {
-			logFields["err"] = err.Error()
-			log.WithFields(logFields).Fatal("Database Open failed")
+		logFields := log.Fields{
+			"DbUrl":      opts.DBURI,
+			"SearchPath": opts.SearchPath,
+			"Service":    opts.Service,
 		}
 
-		if !viper.GetBool("undo") {
-
-			err = db.CreateTables("strict")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("CreateTables() failed")
-			}
+		ctx := signalContext()
 
-			start := time.Now()
+		if viper.GetBool("undo") {
 
-			err = db.Load(d)
-			if err != nil {
+			// Drop constraints, indexes, and tables while ignoring 'does not exist' errors.
+			if err := dataset.Unload(ctx, arg, opts); err != nil {
+				exitIfInterrupted(ctx, logFields)
 				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Load() failed")
+				fatal(dataset.CategoryOf(err), logFields, "Unload failed")
 			}
 
-			// TODO: add a switch to prevent adding indexes or constraints
-			// TODO: add separate commands for adding indexes and constraints
-
-			elapsed := time.Since(start)
-			logFields["durationMinutes"] = elapsed.Minutes()
-			log.WithFields(logFields).Info("Loaded. Beginning to add indexes.")
-
-			indexesStart := time.Now()
-			err = db.CreateIndexes("strict")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Error while adding indexes")
-			}
+			log.WithFields(logFields).Info("Unload complete.")
+			return
+		}
 
-			elapsed = time.Since(indexesStart)
-			logFields["durationMinutes"] = elapsed.Minutes()
-			log.WithFields(logFields).Info("Indexes added. Beginning to add constraints.")
+		// A load interrupted before its files are loaded drops the tables it
+		// created, and exits with the status of the signal.
+		result, err := dataset.Load(ctx, arg, opts)
+		if err != nil {
+			logFields["rowsLoaded"] = loadedRows
+			exitIfInterrupted(ctx, logFields)
+			logFields["err"] = err.Error()
+			fatal(dataset.CategoryOf(err), logFields, "Load failed")
+		}
 
-			constraintsStart := time.Now()
-			err = db.CreateConstraints("strict")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Error while adding constraints")
-			}
+		recordLoad(result)
 
-			elapsed = time.Since(constraintsStart)
-			logFields["durationMinutes"] = elapsed.Minutes()
-			log.WithFields(logFields).Info("Constraints added.")
+		logFields["DataModel"] = result.Model
+		logFields["ModelVersion"] = result.ModelVersion
 
-			elapsed = time.Since(start)
-			logFields["durationMinutes"] = elapsed.Minutes()
-			log.WithFields(logFields).Info("Load complete.")
+		if opts.SkipIndexes {
+			log.WithFields(logFields).Info("Skipping indexes, add them with the index command.")
+		}
 
+		logFields["durationMinutes"] = result.ConstraintsDuration.Minutes()
+		if opts.SkipConstraints {
+			log.WithFields(logFields).Info("Skipping constraints, add them with the constrain command.")
+		} else if opts.NotValid {
+			log.WithFields(logFields).Info("NOT VALID constraints added. Run constrain with --validate to validate them.")
 		} else {
-
-			// Drop constraints, indexes, and tables while ignoring 'does not exist' errors.
-
-			err = db.DropConstraints("normal")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Unexpected error while dropping constraints")
-			}
-
-			err = db.DropIndexes("normal")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Unexpected error while dropping indexes")
-			}
-
-			err = db.DropTables("normal")
-			if err != nil {
-				logFields["err"] = err.Error()
-				log.WithFields(logFields).Fatal("Unexpected error while dropping tables")
-			}
-
+			log.WithFields(logFields).Info("Constraints added.")
 		}
 
+		logFields["durationMinutes"] = result.Duration.Minutes()
+		log.WithFields(logFields).Info("Load complete.")
+
 		// TODO: figure out password handling that does not involve entering
 		// it into a command line.
 		// TODO: make this command idempotent so that it can wipe any existing
 		// data and load the new stuff, to resume from a failure.
-
 	},
 }
 
@@ -198,16 +156,11 @@ func init() {
 	// Register this command under the top-level CLI command.
 	RootCmd.AddCommand(loadCmd)
 
-	// Made these into global flags because I couldn't figure out how to use them in another subcommand also.
-	// // Set up the load-command-specific flags.
-	// loadCmd.Flags().StringP("dburi", "d", "", "Database URI to load the dataset into. Required.")
-	// //	loadCmd.Flags().StringP("dbpass", "p", "", "Database password.")
-	// loadCmd.Flags().StringP("searchPath", "s", "", "SearchPath for the load (secondary schemas may be needed for adding constraints). Required.")
-	// loadCmd.Flags().Bool("undo", false, "Undo the load; delete all tables.")
-
-	// // Bind viper keys to the flag values.
-	// viper.BindPFlag("dburi", loadCmd.Flags().Lookup("dburi"))
-	// //	viper.BindPFlag("dbpass", loadCmd.Flags().Lookup("dbpass"))
-	// viper.BindPFlag("searchPath", loadCmd.Flags().Lookup("searchPath"))
-	// viper.BindPFlag("undo", loadCmd.Flags().Lookup("undo"))
+	// Set up the load-command-specific flags.
+	loadCmd.Flags().Bool("skip-indexes", false, "Do not add indexes after loading.")
+	loadCmd.Flags().Bool("skip-constraints", false, "Do not add constraints after loading.")
+
+	// Add the shared flags load uses.
+	addSharedFlags(loadCmd, "dburi", "searchPath", "undo", "notValid", "model", "modelv", "service", "dmsaservice")
+	addSharedFlags(loadCmd, metricsFlags...)
 }
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// tableRule maps data file names matching a glob or regular expression
+// pattern to a model table.
+type tableRule struct {
+	Pattern string
+	Table   string
+	re      *regexp.Regexp
+}
+
+// Match reports whether the file name matches the rule's pattern.
+func (r *tableRule) Match(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// tableMapping is an ordered list of file name rules. The first matching rule
+// wins.
+type tableMapping []*tableRule
+
+// Table returns the table of the first rule matching the file name.
+func (m tableMapping) Table(name string) (string, bool) {
+	for _, r := range m {
+		if r.Match(name) {
+			return r.Table, true
+		}
+	}
+
+	return "", false
+}
+
+// readTableMapping reads a mapping file. Each non-blank line that does not
+// start with '#' has the form `PATTERN -> TABLE`. Patterns are shell globs
+// matched against the file name, unless enclosed in slashes, in which case
+// they are regular expressions, e.g.
+//
+//	*_visits_*.csv -> visit_occurrence
+//	/^pers(on)?_\d+\.csv$/ -> person
+func readTableMapping(filePath string) (tableMapping, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		mapping tableMapping
+		scanner = bufio.NewScanner(f)
+		lineNum int
+	)
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, "->")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected 'PATTERN -> TABLE'", filePath, lineNum)
+		}
+
+		r := &tableRule{
+			Pattern: strings.TrimSpace(line[:i]),
+			Table:   strings.TrimSpace(line[i+2:]),
+		}
+
+		if r.Pattern == "" || r.Table == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'PATTERN -> TABLE'", filePath, lineNum)
+		}
+
+		if len(r.Pattern) > 1 && strings.HasPrefix(r.Pattern, "/") && strings.HasSuffix(r.Pattern, "/") {
+			if r.re, err = regexp.Compile(r.Pattern[1 : len(r.Pattern)-1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filePath, lineNum, err)
+			}
+		} else if _, err = path.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filePath, lineNum, err)
+		}
+
+		mapping = append(mapping, r)
+	}
+
+	return mapping, scanner.Err()
+}
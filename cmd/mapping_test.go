@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeTempFile writes the contents to a temporary file and returns its path.
+func writeTempFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestReadTableMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		ok      bool
+		rules   int
+		matches map[string]string
+	}{
+		{
+			name: "globs and regular expressions",
+			file: `# comment
+*_visits_*.csv -> visit_occurrence
+
+  /^pers(on)?_\d+\.csv$/   ->   person
+site-?.csv -> care_site
+`,
+			ok:    true,
+			rules: 3,
+			matches: map[string]string{
+				"seattle_visits_2016.csv": "visit_occurrence",
+				"person_1.csv":            "person",
+				"pers_22.csv":             "person",
+				"site-a.csv":              "care_site",
+				"personal_1.csv":          "",
+				"visits.csv":              "",
+			},
+		},
+		{
+			name: "first matching rule wins",
+			file: `*.csv -> observation
+person.csv -> person
+`,
+			ok:    true,
+			rules: 2,
+			matches: map[string]string{
+				"person.csv": "observation",
+			},
+		},
+		{
+			name:  "arrow in pattern",
+			file:  `/a->b/ -> measurement`,
+			ok:    true,
+			rules: 1,
+			matches: map[string]string{
+				"a->b.csv": "measurement",
+				"ab.csv":   "",
+			},
+		},
+		{
+			name:  "empty",
+			file:  "\n# nothing\n\n",
+			ok:    true,
+			rules: 0,
+			matches: map[string]string{
+				"person.csv": "",
+			},
+		},
+		{name: "missing arrow", file: "person.csv person\n"},
+		{name: "missing table", file: "person.csv ->\n"},
+		{name: "missing pattern", file: "-> person\n"},
+		{name: "bad regular expression", file: "/pers(on/ -> person\n"},
+		{name: "bad glob", file: "[person.csv -> person\n"},
+	}
+
+	for _, test := range tests {
+		p := writeTempFile(t, test.file)
+		defer os.Remove(p)
+
+		mapping, err := readTableMapping(p)
+
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if len(mapping) != test.rules {
+			t.Errorf("%s: read %d rules, expected %d", test.name, len(mapping), test.rules)
+		}
+
+		for name, table := range test.matches {
+			got, ok := mapping.Table(name)
+
+			if ok != (table != "") || got != table {
+				t.Errorf("%s: Table(%q) = %q, %t, expected %q", test.name, name, got, ok, table)
+			}
+		}
+	}
+}
+
+func TestReadTableMappingMissingFile(t *testing.T) {
+	if _, err := readTableMapping("/nonexistent/mapping.txt"); err == nil {
+		t.Error("expected an error reading a missing file")
+	}
+}
@@ -0,0 +1,496 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+// stdin is shared by all prompts so that buffered input is not lost between
+// them.
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt asks the user for a value on standard error and reads a line from
+// standard input.
+func prompt(label string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// metadataOptions controls how the metadata is populated from the data.
+type metadataOptions struct {
+	Attrs       dataset.Attrs
+	Service     string
+	Mapping     tableMapping
+	Interactive bool
+
+	// Algorithm is the checksum algorithm for new checksums and Jobs the
+	// number of files hashed concurrently.
+	Algorithm string
+	Jobs      int
+}
+
+// populateMetadata fills the records of the DataDirectory from the files in
+// its directory without relying on the library's prompts. Each file is matched
+// to a table using the mapping rules, its name or its header. Missing values and
+// unmatched files are prompted for in interactive mode and are errors
+// otherwise.
+func populateMetadata(d *datadirectory.DataDirectory, opts *metadataOptions) error {
+	attrs := opts.Attrs
+
+	required := []struct {
+		flag  string
+		label string
+		value *string
+	}{
+		{"site", "Site name", &attrs.Site},
+		{"model", "Data model", &attrs.Model},
+		{"modelv", "Data model version", &attrs.ModelVersion},
+		{"datav", "Dataset version", &attrs.DataVersion},
+		{"etl", "ETL code URL", &attrs.Etl},
+	}
+
+	for _, r := range required {
+		if *r.value != "" {
+			continue
+		}
+
+		if !opts.Interactive {
+			return &dataset.Error{
+				Category: dataset.CategoryUsage,
+				Err:      fmt.Errorf("missing required value, use --%s", r.flag),
+			}
+		}
+
+		v, err := prompt(r.label)
+		if err != nil {
+			return err
+		}
+
+		if v == "" {
+			return &dataset.Error{
+				Category: dataset.CategoryUsage,
+				Err:      fmt.Errorf("missing required value for %s", r.flag),
+			}
+		}
+
+		*r.value = v
+	}
+
+	m, err := dataset.FetchModel(attrs.Model, attrs.ModelVersion, opts.Service)
+	if err != nil {
+		return err
+	}
+
+	// Record the resolved version in case the latest one was used.
+	attrs.ModelVersion = m.Version
+
+	files, err := dataFiles(d)
+	if err != nil {
+		return err
+	}
+
+	var records []map[string]string
+
+	// Assign all the tables first, since that may prompt the user, and
+	// then calculate the checksums concurrently.
+	for _, name := range files {
+		table, err := assignTable(d, name, m, opts)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, newRecord(name, table, attrs))
+	}
+
+	if len(records) == 0 {
+		return fmt.Errorf("no data files found in %s", d.DirPath)
+	}
+
+	if err = dataset.ChecksumRecords(context.Background(), d, records, opts.Algorithm, opts.Jobs); err != nil {
+		return err
+	}
+
+	d.Model = attrs.Model
+	d.ModelVersion = attrs.ModelVersion
+	d.RecordMaps = records
+
+	return nil
+}
+
+// dataFiles returns the sorted names of the regular, non-hidden files in the
+// data directory other than the metadata file, datapackage.json and detached
+// signatures.
+func dataFiles(d *datadirectory.DataDirectory) ([]string, error) {
+	infos, err := ioutil.ReadDir(d.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, info := range infos {
+		name := info.Name()
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || name == filepath.Base(d.FilePath) || name == dataset.DataPackageFile || strings.HasSuffix(name, dataset.SignatureExt) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// assignTable determines the model table for a data file, first using the
+// mapping rules, then the file name up to its first dot, then the best match
+// of the file's header against the tables' fields, and finally asking the user
+// if allowed.
+func assignTable(d *datadirectory.DataDirectory, name string, m *dms.Model, opts *metadataOptions) (string, error) {
+	if table, ok := opts.Mapping.Table(name); ok {
+		if m.Tables.Get(table) == nil {
+			return "", &dataset.Error{
+				Category: dataset.CategoryConfiguration,
+				Err:      fmt.Errorf("mapping assigns '%s' to unknown table '%s'", name, table),
+			}
+		}
+
+		return table, nil
+	}
+
+	if table := strings.SplitN(name, ".", 2)[0]; m.Tables.Get(table) != nil {
+		return table, nil
+	}
+
+	// A file whose header cannot be read, such as an empty or binary one,
+	// has no candidates.
+	table, candidates, err := detectTable(filepath.Join(d.DirPath, name), m)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  name,
+			"error": err,
+		}).Warn("cannot detect table from header")
+
+		table, candidates = "", nil
+	}
+
+	if table != "" {
+		log.WithFields(log.Fields{
+			"file":  name,
+			"table": table,
+		}).Info("detected table from header")
+
+		return table, nil
+	}
+
+	var choices []string
+	for _, c := range candidates {
+		choices = append(choices, c.String())
+	}
+
+	if !opts.Interactive {
+		err = fmt.Errorf("cannot determine table for file '%s'", name)
+
+		if len(choices) > 0 {
+			err = fmt.Errorf("cannot determine table for file '%s', best matches: %s", name, strings.Join(choices, ", "))
+		}
+
+		return "", &dataset.Error{Category: dataset.CategoryFormat, Err: err}
+	}
+
+	if len(choices) > 0 {
+		fmt.Fprintf(os.Stderr, "Best matches for '%s': %s\n", name, strings.Join(choices, ", "))
+	}
+
+	for {
+		table, err := prompt(fmt.Sprintf("Table for file '%s'", name))
+		if err != nil {
+			return "", err
+		}
+
+		if m.Tables.Get(table) != nil {
+			return table, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Unknown table '%s'. Choices are: %s\n", table, strings.Join(m.Tables.Names(), ", "))
+	}
+}
+
+// metadataChanges summarizes the differences found when updating an existing
+// metadata file.
+type metadataChanges struct {
+	Added     []string
+	Removed   []string
+	Changed   []string
+	Unchanged []string
+}
+
+// updateMetadata brings the records read from an existing metadata file up to
+// date with the files in the directory. Existing values are kept unless
+// overridden by non-empty attributes in the options. Checksums and statistics
+// are only recomputed for files whose size or modification time differs from
+// the recorded one, records are added for new files and removed for deleted
+// ones.
+func updateMetadata(d *datadirectory.DataDirectory, opts *metadataOptions) (*metadataChanges, error) {
+	// The records come from the datapackage.json descriptor if there is no
+	// metadata file.
+	metaInfo, err := os.Stat(dataset.MetadataPath(d))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := dataFiles(d)
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]bool, len(files))
+	for _, name := range files {
+		present[name] = true
+	}
+
+	var (
+		changes = &metadataChanges{}
+		records []map[string]string
+		stale   []map[string]string
+		known   = make(map[string]bool)
+	)
+
+	for _, record := range d.RecordMaps {
+		name := record["filename"]
+
+		if !present[name] {
+			changes.Removed = append(changes.Removed, name)
+			continue
+		}
+
+		known[name] = true
+		applyAttrs(record, opts.Attrs)
+
+		info, err := os.Stat(filepath.Join(d.DirPath, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if fileUnchanged(record, info, metaInfo.ModTime()) {
+			if record["modified"] == "" {
+				record["modified"] = dataset.FormatModTime(info.ModTime())
+			}
+
+			changes.Unchanged = append(changes.Unchanged, name)
+			records = append(records, record)
+			continue
+		}
+
+		changes.Changed = append(changes.Changed, name)
+		records = append(records, record)
+		stale = append(stale, record)
+	}
+
+	for _, name := range files {
+		if !known[name] {
+			changes.Added = append(changes.Added, name)
+		}
+	}
+
+	if len(changes.Added) > 0 {
+
+		// New files take their dataset values from the existing records,
+		// unless given in the options.
+		attrs := opts.Attrs
+		if len(d.RecordMaps) > 0 {
+			first := d.RecordMaps[0]
+			defaultString(&attrs.Site, first["organization"])
+			defaultString(&attrs.Model, first["cdm"])
+			defaultString(&attrs.ModelVersion, first["cdm-version"])
+			defaultString(&attrs.DataVersion, first["data-version"])
+			defaultString(&attrs.Etl, first["etl"])
+		}
+
+		m, err := dataset.FetchModel(attrs.Model, attrs.ModelVersion, opts.Service)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range changes.Added {
+			table, err := assignTable(d, name, m, opts)
+			if err != nil {
+				return nil, err
+			}
+
+			record := newRecord(name, table, attrs)
+			records = append(records, record)
+			stale = append(stale, record)
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no data files found in %s", d.DirPath)
+	}
+
+	if err = dataset.ChecksumRecords(context.Background(), d, stale, opts.Algorithm, opts.Jobs); err != nil {
+		return nil, err
+	}
+
+	d.RecordMaps = records
+
+	return changes, nil
+}
+
+// fileUnchanged reports whether a data file matches its record: its size and
+// modification time are the recorded ones or, for records written before
+// modification times were recorded, it is no newer than the metadata file.
+func fileUnchanged(record map[string]string, info os.FileInfo, metaModTime time.Time) bool {
+	if record["bytes"] != "" && record["bytes"] != strconv.FormatInt(info.Size(), 10) {
+		return false
+	}
+
+	if record["modified"] != "" {
+		return record["modified"] == dataset.FormatModTime(info.ModTime())
+	}
+
+	return !info.ModTime().After(metaModTime)
+}
+
+// newRecord returns a metadata record for a data file, without its checksum.
+func newRecord(name string, table string, attrs dataset.Attrs) map[string]string {
+	return map[string]string{
+		"organization": attrs.Site,
+		"filename":     name,
+		"cdm":          attrs.Model,
+		"cdm-version":  attrs.ModelVersion,
+		"table":        table,
+		"data-version": attrs.DataVersion,
+		"etl":          attrs.Etl,
+	}
+}
+
+// applyAttrs overrides the dataset values of a record with the non-empty
+// attributes.
+func applyAttrs(record map[string]string, attrs dataset.Attrs) {
+	for key, value := range attrs.Fields() {
+		if value != "" {
+			record[key] = value
+		}
+	}
+}
+
+// defaultString sets the string to the default value if it is empty.
+func defaultString(s *string, def string) {
+	if *s == "" {
+		*s = def
+	}
+}
+
+// metadataColumns is the order of the standard metadata file columns. Any
+// other columns follow them in alphabetical order.
+var metadataColumns = []string{
+	"organization",
+	"filename",
+	"checksum",
+	"checksum-algorithm",
+	"cdm",
+	"cdm-version",
+	"table",
+	"data-version",
+	"etl",
+	"rows",
+	"bytes",
+	"columns",
+	"encoding",
+	"modified",
+}
+
+// writeMetadataFile writes the records of the DataDirectory to its metadata
+// file, overwriting any existing file. Unlike WriteMetadataToFile, every key
+// present in the records is written.
+func writeMetadataFile(d *datadirectory.DataDirectory) error {
+	var (
+		header   []string
+		standard = make(map[string]bool)
+		extra    = make(map[string]bool)
+	)
+
+	for _, col := range metadataColumns {
+		standard[col] = true
+	}
+
+	for _, record := range d.RecordMaps {
+		for key := range record {
+			if !standard[key] {
+				extra[key] = true
+			}
+		}
+	}
+
+	for _, col := range metadataColumns {
+		for _, record := range d.RecordMaps {
+			if _, ok := record[col]; ok {
+				header = append(header, col)
+				break
+			}
+		}
+	}
+
+	var extraCols []string
+	for col := range extra {
+		extraCols = append(extraCols, col)
+	}
+
+	sort.Strings(extraCols)
+	header = append(header, extraCols...)
+
+	f, err := os.Create(d.FilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+
+	if err = w.Write(header); err != nil {
+		return err
+	}
+
+	for _, record := range d.RecordMaps {
+		row := make([]string, len(header))
+
+		for i, col := range header {
+			row[i] = record[col]
+		}
+
+		if err = w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	if err = w.Error(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
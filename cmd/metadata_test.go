@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+// fakeFileInfo is an os.FileInfo with a given size and modification time.
+type fakeFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+
+func TestFileUnchanged(t *testing.T) {
+	var (
+		metaTime = time.Date(2016, 7, 18, 12, 0, 0, 0, time.UTC)
+		before   = metaTime.Add(-time.Hour)
+		after    = metaTime.Add(time.Hour)
+	)
+
+	tests := []struct {
+		name      string
+		record    map[string]string
+		info      fakeFileInfo
+		unchanged bool
+	}{
+		{
+			name:      "same size and time",
+			record:    map[string]string{"bytes": "10", "modified": dataset.FormatModTime(after)},
+			info:      fakeFileInfo{size: 10, modTime: after},
+			unchanged: true,
+		},
+		{
+			name:   "different size",
+			record: map[string]string{"bytes": "10", "modified": dataset.FormatModTime(after)},
+			info:   fakeFileInfo{size: 11, modTime: after},
+		},
+		{
+			name:   "different time",
+			record: map[string]string{"bytes": "10", "modified": dataset.FormatModTime(before)},
+			info:   fakeFileInfo{size: 10, modTime: after},
+		},
+		{
+			name:      "no recorded time, older than the metadata",
+			record:    map[string]string{"bytes": "10"},
+			info:      fakeFileInfo{size: 10, modTime: before},
+			unchanged: true,
+		},
+		{
+			name:   "no recorded time, newer than the metadata",
+			record: map[string]string{"bytes": "10"},
+			info:   fakeFileInfo{size: 10, modTime: after},
+		},
+		{
+			name:      "no statistics, older than the metadata",
+			record:    map[string]string{},
+			info:      fakeFileInfo{size: 10, modTime: before},
+			unchanged: true,
+		},
+	}
+
+	for _, test := range tests {
+		if unchanged := fileUnchanged(test.record, test.info, metaTime); unchanged != test.unchanged {
+			t.Errorf("%s: fileUnchanged = %t, expected %t", test.name, unchanged, test.unchanged)
+		}
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("person.csv", "person_id\n1\n2\n")
+	write("visit.csv", "visit_id\n10\n")
+	write("gone.csv", "gone_id\n")
+
+	d := &datadirectory.DataDirectory{
+		DirPath:  dir,
+		FilePath: filepath.Join(dir, "metadata.csv"),
+	}
+
+	for _, name := range []string{"person.csv", "visit.csv", "gone.csv"} {
+		d.RecordMaps = append(d.RecordMaps, newRecord(name, name[:len(name)-4], dataset.Attrs{Site: "seattle", Etl: "https://example.org/etl"}))
+	}
+
+	if err = dataset.ChecksumRecords(context.Background(), d, d.RecordMaps, "", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writeMetadataFile(d); err != nil {
+		t.Fatal(err)
+	}
+
+	personChecksum := d.RecordMaps[0]["checksum"]
+
+	// Change the visit file with a different size and remove the other.
+	write("visit.csv", "visit_id\n10\n11\n")
+
+	if err = os.Remove(filepath.Join(dir, "gone.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := updateMetadata(d, &metadataOptions{
+		Attrs: dataset.Attrs{DataVersion: "2.0.0"},
+		Jobs:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &metadataChanges{
+		Removed:   []string{"gone.csv"},
+		Changed:   []string{"visit.csv"},
+		Unchanged: []string{"person.csv"},
+	}
+
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes are %+v, expected %+v", changes, expected)
+	}
+
+	if len(d.RecordMaps) != 2 {
+		t.Fatalf("%d records after the update, expected 2", len(d.RecordMaps))
+	}
+
+	person, visit := d.RecordMaps[0], d.RecordMaps[1]
+
+	if person["checksum"] != personChecksum {
+		t.Errorf("checksum of the unchanged file changed from %s to %s", personChecksum, person["checksum"])
+	}
+
+	if visit["rows"] != "2" {
+		t.Errorf("rows of the changed file are %s, expected 2", visit["rows"])
+	}
+
+	for _, record := range d.RecordMaps {
+		if record["data-version"] != "2.0.0" || record["organization"] != "seattle" {
+			t.Errorf("%s: dataset values are not updated: %v", record["filename"], record)
+		}
+	}
+}
+
+func TestPopulateMetadataMissing(t *testing.T) {
+	d := &datadirectory.DataDirectory{DirPath: "/data/seattle"}
+
+	opts := &metadataOptions{
+		Attrs: dataset.Attrs{Site: "seattle", Model: "pedsnet"},
+	}
+
+	err := populateMetadata(d, opts)
+
+	if dataset.CategoryOf(err) != dataset.CategoryUsage || err.Error() != "missing required value, use --modelv" {
+		t.Errorf("populateMetadata() error %v of category %s, expected a %s error", err, dataset.CategoryOf(err), dataset.CategoryUsage)
+	}
+}
+
+func TestAssignTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, map[string]string{
+		"person.csv":  "person_id,site\n",
+		"export1.csv": "person_id,gender_concept_id,year_of_birth,birth_datetime,site\n",
+		"export2.csv": "person_id,site\n",
+		"export3.csv": "x,y\n",
+		"visits.csv":  "visit_occurrence_id\n",
+	})
+
+	d := &datadirectory.DataDirectory{DirPath: src}
+	m := testModel(t, detectModelTables)
+
+	opts := &metadataOptions{
+		Mapping: tableMapping{{Pattern: "visits.csv", Table: "visit"}},
+	}
+
+	tests := []struct {
+		file     string
+		table    string
+		category dataset.Category
+	}{
+		{file: "person.csv", table: "person"},
+		{file: "export1.csv", table: "person"},
+		{file: "export2.csv", category: dataset.CategoryFormat},
+		{file: "export3.csv", category: dataset.CategoryFormat},
+		{file: "visits.csv", category: dataset.CategoryConfiguration},
+	}
+
+	for _, test := range tests {
+		table, err := assignTable(d, test.file, m, opts)
+
+		if test.category != "" {
+			if err == nil || dataset.CategoryOf(err) != test.category {
+				t.Errorf("%s: error %v, expected a %s error", test.file, err, test.category)
+			}
+
+			continue
+		}
+
+		if err != nil || table != test.table {
+			t.Errorf("%s: assignTable() = %q, %v, expected %q", test.file, table, err, test.table)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The Prometheus metrics of the running command. They are served at the
+// metrics-addr flag while it runs and pushed to the metrics-push flag when it
+// finishes, for the commands that accept those flags (see metricsFlags).
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	rowsValidated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "infomodels",
+		Name:      "rows_validated_total",
+		Help:      "Data rows validated against the format of their table.",
+	}, []string{"table"})
+
+	rowsLoaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "infomodels",
+		Name:      "rows_loaded_total",
+		Help:      "Data rows copied into each table, counted as each file is loaded.",
+	}, []string{"table"})
+
+	validationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "infomodels",
+		Name:      "validation_errors_total",
+		Help:      "Format issues found by validation, by validator error code.",
+	}, []string{"code"})
+
+	failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "infomodels",
+		Name:      "failures_total",
+		Help:      "Failed commands, by category of the failure.",
+	}, []string{"category"})
+
+	stepDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "infomodels",
+		Name:      "step_duration_seconds",
+		Help:      "Duration of the steps of the command: load, indexes, constraints, validate and export.",
+	}, []string{"step"})
+
+	bytesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "infomodels",
+		Name:      "bytes_processed_total",
+		Help:      "Bytes of data files validated or loaded, by step.",
+	}, []string{"step"})
+)
+
+// metricsFlags are the shared flags of the commands that record metrics.
+var metricsFlags = []string{"metrics-addr", "metrics-push", "metrics-job"}
+
+// metricsCommand is the name of the command whose metrics are recorded, set
+// by startMetrics.
+var metricsCommand string
+
+func init() {
+	metricsRegistry.MustRegister(
+		rowsValidated,
+		rowsLoaded,
+		validationErrors,
+		failures,
+		stepDuration,
+		bytesProcessed,
+	)
+}
+
+// startMetrics serves the metrics at the metrics-addr flag, if given, while
+// the command runs, if it is one that records metrics.
+func startMetrics(cmd *cobra.Command) {
+	if cmd.Flags().Lookup("metrics-addr") == nil {
+		return
+	}
+
+	metricsCommand = cmd.Name()
+
+	addr := viper.GetString("metricsaddr")
+	if addr == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal(dataset.CategoryConfiguration, log.Fields{
+			"addr":  addr,
+			"error": err,
+		}, "error listening for metrics requests")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.WithFields(log.Fields{
+				"addr":  addr,
+				"error": err,
+			}).Warn("error serving metrics")
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"addr": ln.Addr().String(),
+	}).Info("serving metrics at /metrics")
+}
+
+// pushMetrics pushes the metrics to the Pushgateway at the metrics-push flag,
+// if given, under the job named by the metrics-job flag and grouped by
+// command. A push that fails is logged but does not fail the command.
+func pushMetrics() {
+	url := viper.GetString("metricspush")
+	if metricsCommand == "" || url == "" {
+		return
+	}
+
+	err := push.New(url, viper.GetString("metricsjob")).
+		Gatherer(metricsRegistry).
+		Grouping("command", metricsCommand).
+		Push()
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   url,
+			"error": err,
+		}).Warn("error pushing metrics")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"url": url,
+	}).Debug("pushed metrics")
+}
+
+// recordFileReport adds the rows and bytes validated in a file and the format
+// issues found in it to the metrics.
+func recordFileReport(f *dataset.FileReport) {
+	rowsValidated.WithLabelValues(f.Table).Add(float64(f.Rows))
+	bytesProcessed.WithLabelValues("validate").Add(float64(f.Bytes))
+
+	if f.Result == nil {
+		return
+	}
+
+	for err, verrs := range f.Result.LineErrors() {
+		validationErrors.WithLabelValues(fmt.Sprint(err.Code)).Add(float64(len(verrs)))
+	}
+
+	for _, field := range f.Header {
+		for err, verrs := range f.Result.FieldErrors(field) {
+			validationErrors.WithLabelValues(fmt.Sprint(err.Code)).Add(float64(len(verrs)))
+		}
+	}
+}
+
+// recordLoadedFile adds the rows and bytes of a loaded file to the metrics.
+func recordLoadedFile(f *dataset.LoadedFile) {
+	rowsLoaded.WithLabelValues(f.Table).Add(float64(f.Rows))
+	bytesProcessed.WithLabelValues("load").Add(float64(f.Bytes))
+}
+
+// recordLoad adds the durations of the steps of the load to the metrics. The
+// rows and bytes loaded are added as each file is, by recordLoadedFile.
+func recordLoad(result *dataset.LoadResult) {
+	recordStep("load", result.LoadDuration)
+
+	if result.IndexesDuration > 0 {
+		recordStep("indexes", result.IndexesDuration)
+	}
+
+	if result.ConstraintsDuration > 0 {
+		recordStep("constraints", result.ConstraintsDuration)
+	}
+}
+
+// recordStep sets the duration of a step in the metrics.
+func recordStep(step string, d time.Duration) {
+	stepDuration.WithLabelValues(step).Set(d.Seconds())
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+func TestRecordLoadedFile(t *testing.T) {
+	rowsLoaded.Reset()
+	defer rowsLoaded.Reset()
+
+	counted := func() float64 {
+		var m dto.Metric
+
+		if err := rowsLoaded.WithLabelValues("visit_occurrence").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		return m.GetCounter().GetValue()
+	}
+
+	recordLoadedFile(&dataset.LoadedFile{Filename: "visit_1.csv", Table: "visit_occurrence", Rows: 3, Bytes: 60})
+
+	if n := counted(); n != 3 {
+		t.Errorf("rows loaded after the first file are %v, expected 3", n)
+	}
+
+	recordLoadedFile(&dataset.LoadedFile{Filename: "visit_2.csv", Table: "visit_occurrence", Rows: 4, Bytes: 80})
+
+	if n := counted(); n != 7 {
+		t.Errorf("rows loaded after the second file are %v, expected 7", n)
+	}
+
+	// The rows are only counted as files are loaded.
+	recordLoad(&dataset.LoadResult{
+		LoadDuration: time.Minute,
+		Rows:         map[string]int64{"visit_occurrence": 7},
+	})
+
+	if n := counted(); n != 7 {
+		t.Errorf("rows loaded after the load are %v, expected 7", n)
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var (
+		method string
+		path   string
+		body   string
+	)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+
+		method, path, body = r.Method, r.URL.Path, string(data)
+	}))
+	defer gateway.Close()
+
+	defer func(command string) {
+		metricsCommand = command
+	}(metricsCommand)
+
+	viper.Set("metricspush", gateway.URL)
+	viper.Set("metricsjob", "nightly")
+	defer viper.Set("metricspush", "")
+
+	metricsCommand = "load"
+
+	recordFileReport(&dataset.FileReport{Filename: "person.csv", Table: "person", Rows: 2, Bytes: 40})
+	recordLoadedFile(&dataset.LoadedFile{Filename: "person.csv", Table: "person", Rows: 2, Bytes: 40})
+	recordLoad(&dataset.LoadResult{
+		LoadDuration: 90 * time.Second,
+		Rows:         map[string]int64{"person": 2},
+		Bytes:        map[string]int64{"person": 40},
+	})
+
+	pushMetrics()
+
+	if method != http.MethodPut || path != "/metrics/job/nightly/command/load" {
+		t.Errorf("pushed with %s %s, expected PUT /metrics/job/nightly/command/load", method, path)
+	}
+
+	// The protobuf format of the push holds the names and labels as plain
+	// strings.
+	for _, s := range []string{
+		"infomodels_rows_validated_total",
+		"infomodels_rows_loaded_total",
+		"infomodels_bytes_processed_total",
+		"infomodels_step_duration_seconds",
+		"person",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("pushed metrics do not contain %q", s)
+		}
+	}
+}
+
+func TestPushMetricsUnset(t *testing.T) {
+	var pushed bool
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed = true
+	}))
+	defer gateway.Close()
+
+	defer func(command string) {
+		metricsCommand = command
+	}(metricsCommand)
+
+	// Commands that do not record metrics push nothing.
+	metricsCommand = ""
+	viper.Set("metricspush", gateway.URL)
+	defer viper.Set("metricspush", "")
+
+	pushMetrics()
+
+	if pushed {
+		t.Error("metrics pushed for a command that does not record them")
+	}
+}
@@ -0,0 +1,394 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Failure policies of pipeline steps. A failed step is retried as many times
+// as its retries setting allows before its policy applies.
+const (
+	failAbort    = "abort"
+	failContinue = "continue"
+)
+
+// Statuses of pipeline steps.
+const (
+	stepSucceeded = "succeeded"
+	stepFailed    = "failed"
+	stepSkipped   = "skipped"
+	stepNotRun    = "not run"
+)
+
+// pipelineExcluded are the commands that cannot be run as pipeline steps.
+var pipelineExcluded = map[string]bool{
+	"help":  true,
+	"run":   true,
+	"serve": true,
+	"watch": true,
+}
+
+// pipeline is a sequence of infomodels commands declared in a YAML file. The
+// options are passed as flags to the steps whose commands accept them, such as
+// dburi and searchPath to load, index and constrain.
+type pipeline struct {
+	Name    string                 `yaml:"name"`
+	Log     string                 `yaml:"log"`
+	State   string                 `yaml:"state"`
+	Options map[string]interface{} `yaml:"options"`
+	Steps   []*pipelineStep        `yaml:"steps"`
+
+	// checksum identifies the contents of the pipeline file.
+	checksum string
+}
+
+// pipelineStep runs one infomodels command with the options as flags followed
+// by the arguments.
+type pipelineStep struct {
+	Name       string                 `yaml:"name"`
+	Command    string                 `yaml:"command"`
+	Args       []string               `yaml:"args"`
+	Options    map[string]interface{} `yaml:"options"`
+	OnFailure  string                 `yaml:"on-failure"`
+	Retries    int                    `yaml:"retries"`
+	RetryDelay string                 `yaml:"retry-delay"`
+
+	retryDelay time.Duration
+}
+
+// readPipeline reads and checks the pipeline file, filling in defaults: the
+// log and state files are named after the pipeline file, a step's command
+// defaults to its name and vice versa, and steps abort the pipeline on failure.
+func readPipeline(path string) (*pipeline, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pipeline{}
+
+	if err = yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	sum := sha256.Sum256(b)
+	p.checksum = hex.EncodeToString(sum[:])
+
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	if p.Log == "" {
+		p.Log = path + ".log"
+	}
+
+	if p.State == "" {
+		p.State = path + ".state"
+	}
+
+	if len(p.Steps) == 0 {
+		return nil, fmt.Errorf("%s declares no steps", path)
+	}
+
+	commands := make(map[string]bool)
+
+	for _, c := range RootCmd.Commands() {
+		if !pipelineExcluded[c.Name()] {
+			commands[c.Name()] = true
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i, s := range p.Steps {
+		if s.Command == "" {
+			s.Command = s.Name
+		}
+
+		if s.Name == "" {
+			s.Name = s.Command
+		}
+
+		if !commands[s.Command] {
+			return nil, fmt.Errorf("step %d: unknown command '%s'", i+1, s.Command)
+		}
+
+		if names[s.Name] {
+			return nil, fmt.Errorf("step %d: duplicate step name '%s', name the steps", i+1, s.Name)
+		}
+
+		names[s.Name] = true
+
+		switch s.OnFailure {
+		case "":
+			s.OnFailure = failAbort
+		case failAbort, failContinue:
+		default:
+			return nil, fmt.Errorf("step '%s': unknown failure policy '%s', choose from: %s, %s", s.Name, s.OnFailure, failAbort, failContinue)
+		}
+
+		if s.Retries < 0 {
+			return nil, fmt.Errorf("step '%s': retries cannot be negative", s.Name)
+		}
+
+		if s.RetryDelay != "" {
+			if s.retryDelay, err = time.ParseDuration(s.RetryDelay); err != nil {
+				return nil, fmt.Errorf("step '%s': invalid retry-delay: %s", s.Name, err)
+			}
+		}
+	}
+
+	// An option no step accepts is most likely misspelled.
+	for name := range p.Options {
+		accepted := false
+
+		for _, s := range p.Steps {
+			if commandAccepts(s.Command, name) {
+				accepted = true
+				break
+			}
+		}
+
+		if !accepted {
+			return nil, fmt.Errorf("option '%s' is not a flag of any step", name)
+		}
+	}
+
+	return p, nil
+}
+
+// flagArgs turns options into command line flags, in name order. Lists give a
+// flag per item and empty values a flag without a value.
+func flagArgs(options map[string]interface{}) []string {
+	var names []string
+
+	for name := range options {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var args []string
+
+	for _, name := range names {
+		switch v := options[name].(type) {
+		case nil:
+			args = append(args, "--"+name)
+		case []interface{}:
+			for _, item := range v {
+				args = append(args, fmt.Sprintf("--%s=%v", name, item))
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", name, v))
+		}
+	}
+
+	return args
+}
+
+// commandLine returns the infomodels arguments that run the step, with the
+// step's options overriding the pipeline's, which override the defaults. Only
+// the pipeline options and defaults that the step's command accepts are given.
+func (s *pipelineStep) commandLine(p *pipeline, defaults map[string]interface{}) []string {
+	options := make(map[string]interface{})
+
+	for name, v := range acceptedOptions(s.Command, defaults) {
+		options[name] = v
+	}
+
+	for name, v := range acceptedOptions(s.Command, p.Options) {
+		options[name] = v
+	}
+
+	for name, v := range s.Options {
+		options[name] = v
+	}
+
+	args := append([]string{s.Command}, flagArgs(options)...)
+
+	return append(args, s.Args...)
+}
+
+// pipelineState records the steps of a pipeline that have succeeded, so that
+// a failed run can be resumed from the failed step.
+type pipelineState struct {
+	Pipeline  string    `json:"pipeline"`
+	Checksum  string    `json:"checksum"`
+	Completed []string  `json:"completed"`
+	Failed    string    `json:"failed,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// readPipelineState reads the state file, returning an empty state if there
+// is none.
+func readPipelineState(path string) (*pipelineState, error) {
+	state := &pipelineState{}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	return state, nil
+}
+
+// write saves the state file.
+func (s *pipelineState) write(path string) error {
+	s.Updated = time.Now()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// completed reports whether the named step has succeeded.
+func (s *pipelineState) completed(name string) bool {
+	for _, c := range s.Completed {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allCompleted reports whether every step of the pipeline has succeeded.
+func (s *pipelineState) allCompleted(p *pipeline) bool {
+	for _, step := range p.Steps {
+		if !s.completed(step.Name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prefixWriter writes each line written to it to w with a prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+
+	mu   sync.Mutex
+	line []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	pw.line = append(pw.line, p...)
+
+	for {
+		i := bytes.IndexByte(pw.line, '\n')
+		if i < 0 {
+			break
+		}
+
+		if _, err := fmt.Fprintf(pw.w, "%s%s", pw.prefix, pw.line[:i+1]); err != nil {
+			return 0, err
+		}
+
+		pw.line = pw.line[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any unterminated last line.
+func (pw *prefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if len(pw.line) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(pw.w, "%s%s\n", pw.prefix, pw.line)
+	pw.line = nil
+
+	return err
+}
+
+// infomodelsCommand returns a command that runs this infomodels executable
+// with the arguments.
+func infomodelsCommand(args []string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.Command(exe, args...), nil
+}
+
+// runInfomodels runs this infomodels executable with the arguments, writing
+// its output and logs to out.
+func runInfomodels(args []string, out io.Writer) error {
+	cmd, err := infomodelsCommand(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	return cmd.Run()
+}
+
+// stepDefaults returns the options every step is run with unless the
+// pipeline sets them: the log level and format of the run command, with text
+// logs if the format is not set, since the steps' output is not a terminal,
+// and its configuration file and profile, if given.
+func stepDefaults() map[string]interface{} {
+	logfmt := viper.GetString("logfmt")
+	if logfmt == "" {
+		logfmt = "text"
+	}
+
+	defaults := map[string]interface{}{
+		"loglvl": viper.GetString("loglvl"),
+		"logfmt": logfmt,
+	}
+
+	for _, name := range []string{"config", "profile"} {
+		if v := viper.GetString(name); v != "" {
+			defaults[name] = v
+		}
+	}
+
+	return defaults
+}
+
+// stepResult is the outcome of a pipeline step.
+type stepResult struct {
+	Step     *pipelineStep
+	Status   string
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
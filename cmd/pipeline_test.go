@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagArgs(t *testing.T) {
+	tests := []struct {
+		options map[string]interface{}
+		args    []string
+	}{
+		{nil, nil},
+		{
+			map[string]interface{}{"searchPath": "site_seattle", "dburi": "postgres://db/pedsnet"},
+			[]string{"--dburi=postgres://db/pedsnet", "--searchPath=site_seattle"},
+		},
+		{
+			map[string]interface{}{"jobs": 4, "skip-indexes": true, "samples": 2.5},
+			[]string{"--jobs=4", "--samples=2.5", "--skip-indexes=true"},
+		},
+		{
+			map[string]interface{}{"undo": nil},
+			[]string{"--undo"},
+		},
+		{
+			map[string]interface{}{"keypath": []interface{}{"a.asc", "b.asc"}, "format": "tar.gz"},
+			[]string{"--format=tar.gz", "--keypath=a.asc", "--keypath=b.asc"},
+		},
+		{
+			map[string]interface{}{"keypath": []interface{}{}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		if args := flagArgs(test.options); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("flagArgs(%v) = %q, expected %q", test.options, args, test.args)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	p := &pipeline{
+		Options: map[string]interface{}{
+			"dburi":  "postgres://db/pedsnet",
+			"loglvl": "Warn",
+			"site":   "seattle",
+		},
+	}
+
+	s := &pipelineStep{
+		Command: "load",
+		Args:    []string{"/data/seattle"},
+		Options: map[string]interface{}{
+			"dburi":        "postgres://db/other",
+			"skip-indexes": true,
+		},
+	}
+
+	defaults := map[string]interface{}{
+		"loglvl": "Info",
+		"logfmt": "text",
+		"jobs":   4,
+	}
+
+	expected := []string{
+		"load",
+		"--dburi=postgres://db/other",
+		"--logfmt=text",
+		"--loglvl=Warn",
+		"--skip-indexes=true",
+		"/data/seattle",
+	}
+
+	if args := s.commandLine(p, defaults); !reflect.DeepEqual(args, expected) {
+		t.Errorf("commandLine() = %q, expected %q", args, expected)
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		err   string
+		check func(t *testing.T, path string, p *pipeline)
+	}{
+		{
+			name: "defaults",
+			file: `steps:
+  - name: validate
+    args: [/data/seattle]
+  - command: load
+    args: [/data/seattle]
+    on-failure: continue
+    retries: 2
+    retry-delay: 30s
+`,
+			check: func(t *testing.T, path string, p *pipeline) {
+				if !strings.HasPrefix(p.Name, "infomodels-test-") {
+					t.Errorf("name %q is not named after the file", p.Name)
+				}
+
+				if p.Log != path+".log" || p.State != path+".state" {
+					t.Errorf("log %q and state %q are not named after the file", p.Log, p.State)
+				}
+
+				if len(p.checksum) != 64 {
+					t.Errorf("checksum %q is not a SHA-256 checksum", p.checksum)
+				}
+
+				v, l := p.Steps[0], p.Steps[1]
+
+				if v.Command != "validate" || v.OnFailure != failAbort || v.Retries != 0 {
+					t.Errorf("first step is %+v", v)
+				}
+
+				if l.Name != "load" || l.OnFailure != failContinue || l.Retries != 2 || l.retryDelay != 30*time.Second {
+					t.Errorf("second step is %+v", l)
+				}
+			},
+		},
+		{
+			name: "named options",
+			file: `name: nightly
+log: /var/log/nightly.log
+state: /var/lib/nightly.state
+options:
+  dburi: postgres://db/pedsnet
+steps:
+  - name: validate seattle
+    command: validate
+    options: {site: seattle}
+  - command: load
+`,
+			check: func(t *testing.T, path string, p *pipeline) {
+				if p.Name != "nightly" || p.Log != "/var/log/nightly.log" || p.State != "/var/lib/nightly.state" {
+					t.Errorf("pipeline is %+v", p)
+				}
+
+				if p.Options["dburi"] != "postgres://db/pedsnet" || p.Steps[0].Options["site"] != "seattle" {
+					t.Errorf("options are %v and %v", p.Options, p.Steps[0].Options)
+				}
+			},
+		},
+		{name: "no steps", file: "name: empty\n", err: "declares no steps"},
+		{name: "option of no step", file: "options: {dburi: postgres://db/pedsnet}\nsteps: [{name: validate}]\n", err: "not a flag of any step"},
+		{name: "unknown field", file: "steps: [{name: validate, retry: 1}]\n", err: "parsing"},
+		{name: "unknown command", file: "steps: [{name: frobnicate}]\n", err: "unknown command"},
+		{name: "excluded command", file: "steps: [{name: serve}]\n", err: "unknown command"},
+		{name: "duplicate name", file: "steps: [{name: validate}, {command: validate}]\n", err: "duplicate step name"},
+		{name: "bad failure policy", file: "steps: [{name: validate, on-failure: retry}]\n", err: "unknown failure policy"},
+		{name: "negative retries", file: "steps: [{name: validate, retries: -1}]\n", err: "cannot be negative"},
+		{name: "bad retry delay", file: "steps: [{name: validate, retry-delay: soon}]\n", err: "invalid retry-delay"},
+	}
+
+	for _, test := range tests {
+		path := writeTempFile(t, test.file)
+		defer os.Remove(path)
+
+		p, err := readPipeline(path)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, expected one containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		test.check(t, path, p)
+	}
+}
+
+func TestCommandAccepts(t *testing.T) {
+	tests := []struct {
+		command string
+		flag    string
+		ok      bool
+	}{
+		{"load", "dburi", true},
+		{"load", "skip-indexes", true},
+		{"load", "loglvl", true},
+		{"load", "profile", true},
+		{"load", "jobs", false},
+		{"validate", "dburi", false},
+		{"validate", "jobs", true},
+		{"compress", "undo", false},
+		{"compress", "keypath", true},
+		{"compress", "sign-key-id", true},
+		{"expand", "keyemail", false},
+		{"serve", "dburi", true},
+		{"serve", "undo", false},
+		{"export", "tables", true},
+		{"export", "undo", false},
+		{"frobnicate", "dburi", false},
+	}
+
+	for _, test := range tests {
+		if ok := commandAccepts(test.command, test.flag); ok != test.ok {
+			t.Errorf("commandAccepts(%q, %q) = %t, expected %t", test.command, test.flag, ok, test.ok)
+		}
+	}
+}
+
+func TestPipelineStateAllCompleted(t *testing.T) {
+	p := &pipeline{Steps: []*pipelineStep{{Name: "expand"}, {Name: "load"}}}
+
+	tests := []struct {
+		completed []string
+		all       bool
+	}{
+		{nil, false},
+		{[]string{"expand"}, false},
+		{[]string{"expand", "validate"}, false},
+		{[]string{"load", "expand"}, true},
+	}
+
+	for _, test := range tests {
+		state := &pipelineState{Completed: test.completed}
+
+		if all := state.allCompleted(p); all != test.all {
+			t.Errorf("allCompleted with %q completed = %t, expected %t", test.completed, all, test.all)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"runtime"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -21,7 +23,56 @@ var RootCmd = &cobra.Command{
 
 For datasets that conform to a model defined in the chop-dbhi/data-models
 repository, this CLI exposes an easy-to-use interface for accomplishing
-various ETL-type tasks common to many informatics workflows.`,
+various ETL-type tasks common to many informatics workflows.
+
+Settings can be kept in a YAML configuration file, ~/.infomodels.yaml or the
+file given by config, named after the flags they set. Settings at the top of
+the file apply to every command. Named profiles bundle the settings of a site
+or environment, such as its database, schema, model, service URLs, key paths
+and log settings, and are selected with the profile flag or by the profile
+setting of the file:
+
+  loglvl: warn
+  profiles:
+    nemours-prod:
+      dburi: postgres://etl@db.nemours.org/pedsnet
+      searchPath: nemours_pedsnet
+      model: pedsnet-core
+      modelv: 2.3.0
+      keypath: /keys/nemours.asc
+
+A profile's settings override those at the top of the file. Flags override
+environment variables (INFOMODELS_ followed by the upper-cased setting name,
+such as INFOMODELS_DBURI), which override the configuration file, which
+overrides the defaults.
+
+Commands that fail exit with a status for the category of the failure, which
+is also logged in the category field of the log entry:
+
+  1  other errors, such as files that cannot be read or written
+  2  usage: a missing or invalid argument or flag
+  3  configuration: an unreadable settings, key or mapping file, or a model or
+     version unknown to the data models service
+  4  service: the data models service cannot be reached
+  5  checksum: files do not match the checksums, sizes, statistics or
+     signatures recorded for them
+  6  format: data or metadata files do not match their format, or orphaned
+     rows were found
+  7  database: the database cannot be reached or a statement fails in it
+
+Commands interrupted by SIGINT or SIGTERM exit with status 130 or 143.`,
+
+	// The flags of each command, including those shared by several commands
+	// (see sharedFlags), are bound to viper keys when it is run, and the
+	// metrics of the commands that record them are served while it runs and
+	// pushed once it succeeds. Failed commands push them in fatal.
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, args)
+		startMetrics(cmd)
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		pushMetrics()
+	},
 }
 
 // Execute initializes, sets up, and runs the CLI. It will run the callbacks
@@ -32,10 +83,10 @@ various ETL-type tasks common to many informatics workflows.`,
 // is called by main.main() in the parent package.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		// The log.Fatal automatically calls os.Exit(1) after logging.
-		log.WithFields(log.Fields{
+		// Cobra returns the errors of unknown commands and flags.
+		fatal(dataset.CategoryUsage, log.Fields{
 			"err": err,
-		}).Fatal("error initializing infomodels cli")
+		}, "error initializing infomodels cli")
 	}
 }
 
@@ -50,31 +101,18 @@ func init() {
 
 	// Set up global flags that can be specified at any point on the command
 	// line. The values and defaults will be managed by viper.
-	RootCmd.PersistentFlags().String("service", "", "Data models service URL.")
-	RootCmd.PersistentFlags().String("dmsaservice", "", "Data models SQLAlchemy service URL.")
-	RootCmd.PersistentFlags().StringP("model", "m", "", "Data model of the dataset.")
-	RootCmd.PersistentFlags().StringP("modelv", "v", "", "Data model version number.")
+	RootCmd.PersistentFlags().String("config", "", "Path to the configuration file (default ~/.infomodels.yaml).")
+	RootCmd.PersistentFlags().String("profile", "", "Name of the configuration file profile to use.")
 	RootCmd.PersistentFlags().String("loglvl", "", "Logging output level  [DEBUG|INFO|WARN|ERROR|FATAL].")
 	RootCmd.PersistentFlags().String("logfmt", "", "Logging output format [tty|text|json].")
 
-	// Flags for constrain and load -- seemingly subcommands can't share flags with out the flags being global.  See https://github.com/spf13/cobra/issues/277.
-	RootCmd.PersistentFlags().StringP("dburi", "d", "", "Database URI to load the dataset into. Required by load, constrain.")
-	RootCmd.PersistentFlags().StringP("searchPath", "s", "", "SearchPath for the load (secondary schemas may be needed for adding constraints). Required by load, constrain.")
-	RootCmd.PersistentFlags().Bool("undo", false, "Undo the load; delete all tables.")
-
-	// Bind viper key names to the global flags.
-	viper.BindPFlag("service", RootCmd.PersistentFlags().Lookup("service"))
-	viper.BindPFlag("dmsaservice", RootCmd.PersistentFlags().Lookup("dmsaservice"))
-	viper.BindPFlag("model", RootCmd.PersistentFlags().Lookup("model"))
-	viper.BindPFlag("modelv", RootCmd.PersistentFlags().Lookup("modelv"))
+	// Bind viper key names to the global flags, which are needed to read the
+	// configuration and set up the log before the command is run.
+	viper.BindPFlag("config", RootCmd.PersistentFlags().Lookup("config"))
+	viper.BindPFlag("profile", RootCmd.PersistentFlags().Lookup("profile"))
 	viper.BindPFlag("loglvl", RootCmd.PersistentFlags().Lookup("loglvl"))
 	viper.BindPFlag("logfmt", RootCmd.PersistentFlags().Lookup("logfmt"))
 
-	// Viper flag bindings for constrain and load.
-	viper.BindPFlag("dburi", RootCmd.PersistentFlags().Lookup("dburi"))
-	viper.BindPFlag("searchPath", RootCmd.PersistentFlags().Lookup("searchPath"))
-	viper.BindPFlag("undo", RootCmd.PersistentFlags().Lookup("undo"))
-
 	// Set defaults in viper.
 	viper.SetDefault("service", "https://data-models-service.research.chop.edu/")
 	viper.SetDefault("dmsaservice", "https://data-models-sqlalchemy.research.chop.edu/")
@@ -87,6 +125,8 @@ func init() {
 	viper.SetDefault("dburi", "")
 	viper.SetDefault("searchPath", "")
 	viper.SetDefault("undo", false)
+	viper.SetDefault("notValid", false)
+	viper.SetDefault("jobs", runtime.NumCPU())
 
 	// Set up the dummy version flag. It will actually be handled in the
 	// main.main function, but we want it to show up in the help.
@@ -94,7 +134,8 @@ func init() {
 
 }
 
-// initConfig reads in environment variables if set.
+// initConfig reads in environment variables if set and the configuration
+// file, if there is one.
 func initConfig() {
 
 	// Set up the environment variable configuration. Any environment variable
@@ -104,6 +145,15 @@ func initConfig() {
 	viper.SetEnvPrefix("infomodels")
 	viper.AutomaticEnv()
 
+	// Read the settings of the configuration file and profile, which are
+	// overridden by both of the above.
+	if err := readConfigFile(); err != nil {
+		fatal(dataset.CategoryConfiguration, log.Fields{
+			"profile": viper.GetString("profile"),
+			"error":   err,
+		}, "error reading configuration file")
+	}
+
 }
 
 // initLog sets up the logging configuration.
@@ -133,9 +183,9 @@ func initLog() {
 		fmt.Printf("Error: invalid logging level \"%s\"",
 			viper.GetString("loglvl"))
 		fmt.Println("Run 'infomodels --help' for usage.")
-		log.WithFields(log.Fields{
+		fatal(dataset.CategoryConfiguration, log.Fields{
 			"loglvl": viper.GetString("loglvl"),
-		}).Fatal("invalid logging level")
+		}, "invalid logging level")
 	}
 
 	log.SetLevel(lvl)
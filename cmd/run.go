@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] PIPELINE",
+	Short: "run a pipeline of commands",
+	Long: `Run the steps declared in the PIPELINE YAML file in order
+
+Each step runs an infomodels command, such as expand, validate, load, index,
+constrain or export, with its options given as flags and its args as arguments:
+
+  name: nightly
+  options:                      # flags given to the steps that accept them
+    dburi: postgres://etl@db/pedsnet
+    searchPath: site_pedsnet
+  steps:
+    - command: expand
+      args: [/incoming/site.tar.gz]
+      options: {keypath: /keys/etl.asc, output: /data/site, verify: true}
+    - command: validate
+      args: [/data/site]
+      on-failure: continue      # or abort, the default
+    - command: load
+      args: [/data/site]
+      options: {skip-indexes: true, skip-constraints: true}
+    - command: index
+    - command: constrain
+      retries: 2                # retried before the failure policy applies
+      retry-delay: 5m
+    - command: export
+      args: [/export/site]
+      options: {site: site}
+
+Steps are named after their command unless given a name, which must then be
+unique. Option values that are lists give the flag once per item. The options
+of the pipeline are only given to the steps whose commands accept them, and
+each must be accepted by at least one.
+
+Steps are run with the loglvl and logfmt of the run command (text logs if no
+format is given) unless the pipeline options set them. The output of all steps
+is written, prefixed with the step name, to the terminal and to a consolidated
+log file (log, by default PIPELINE.log), which ends with a summary of each
+step's status, attempts and duration. The steps that succeeded are recorded in
+a state file (state, by default PIPELINE.state) so that, with the resume flag,
+a failed run is resumed from the failed step. If every step completed in the
+last run, there is nothing to resume, so a warning is logged and all the steps
+are run again. The command exits non-zero if any step failed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Enforce single pipeline argument.
+		if len(args) != 1 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"args": args,
+			}, "run requires 1 argument")
+		}
+
+		p, err := readPipeline(args[0])
+		if err != nil {
+			fatal(dataset.CategoryConfiguration, log.Fields{
+				"pipeline": args[0],
+				"error":    err,
+			}, "error reading pipeline")
+		}
+
+		if viper.GetBool("dryrun") {
+			for _, s := range p.Steps {
+				fmt.Printf("%s: infomodels %s\n", s.Name, strings.Join(s.commandLine(p, stepDefaults()), " "))
+			}
+
+			return
+		}
+
+		state := &pipelineState{}
+
+		if viper.GetBool("resume") {
+			if state, err = readPipelineState(p.State); err != nil {
+				fatal(dataset.CategoryOther, log.Fields{
+					"state": p.State,
+					"error": err,
+				}, "error reading pipeline state")
+			}
+
+			if state.Checksum != "" && state.Checksum != p.checksum {
+				log.WithFields(log.Fields{
+					"pipeline": args[0],
+				}).Warn("pipeline changed since the last run, resuming by step name")
+			}
+
+			// Resuming a run that succeeded would skip every step.
+			if state.allCompleted(p) {
+				log.WithFields(log.Fields{
+					"pipeline": args[0],
+					"state":    p.State,
+					"updated":  state.Updated,
+				}).Warn("every step completed in the last run, running them all again")
+
+				state = &pipelineState{}
+			}
+		}
+
+		state.Pipeline = p.Name
+		state.Checksum = p.checksum
+
+		logFile, err := os.OpenFile(p.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
+				"log":   p.Log,
+				"error": err,
+			}, "error opening pipeline log")
+		}
+		defer logFile.Close()
+
+		out := io.MultiWriter(os.Stderr, logFile)
+		log.SetOutput(out)
+
+		results := runPipeline(p, state, out)
+
+		tw := tablewriter.NewWriter(io.MultiWriter(os.Stdout, logFile))
+
+		tw.SetHeader([]string{
+			"step",
+			"command",
+			"status",
+			"attempts",
+			"duration",
+		})
+
+		var (
+			total  time.Duration
+			failed *stepResult
+		)
+
+		for _, r := range results {
+			total += r.Duration
+
+			if r.Status == stepFailed && failed == nil {
+				failed = r
+			}
+
+			tw.Append([]string{
+				r.Step.Name,
+				r.Step.Command,
+				r.Status,
+				fmt.Sprint(r.Attempts),
+				r.Duration.Round(time.Second).String(),
+			})
+		}
+
+		tw.SetFooter([]string{"", "", "", "total", total.Round(time.Second).String()})
+		tw.Render()
+
+		// Exit with the category of the first step that failed, so that the
+		// cause of the failure is not lost.
+		if failed != nil {
+			fatal(stepCategory(failed.Err), log.Fields{
+				"pipeline": p.Name,
+				"state":    p.State,
+				"step":     failed.Step.Name,
+			}, "pipeline failed, fix the problem and run again with --resume")
+		}
+
+		log.WithFields(log.Fields{
+			"pipeline":        p.Name,
+			"durationMinutes": total.Minutes(),
+		}).Info("pipeline finished")
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(runCmd)
+
+	// Set up the run-command-specific flags.
+	runCmd.Flags().Bool("resume", false, "Skip the steps that succeeded in the last run.")
+	runCmd.Flags().Bool("dry-run", false, "Print the command line of each step without running it.")
+}
+
+// runPipeline runs the steps of the pipeline that are not completed in the
+// state, writing their output to out and saving the state after each step.
+// Steps after one that fails with the abort policy are not run.
+func runPipeline(p *pipeline, state *pipelineState, out io.Writer) []*stepResult {
+	var (
+		results []*stepResult
+		aborted bool
+	)
+
+	for _, s := range p.Steps {
+		r := &stepResult{Step: s}
+		results = append(results, r)
+
+		if aborted {
+			r.Status = stepNotRun
+			continue
+		}
+
+		if state.completed(s.Name) {
+			log.WithFields(log.Fields{
+				"step": s.Name,
+			}).Info("skipping step completed in an earlier run")
+
+			r.Status = stepSkipped
+			continue
+		}
+
+		args := s.commandLine(p, stepDefaults())
+		start := time.Now()
+
+		for r.Attempts <= s.Retries {
+			if r.Attempts > 0 {
+				log.WithFields(log.Fields{
+					"step":    s.Name,
+					"attempt": r.Attempts + 1,
+					"delay":   s.retryDelay.String(),
+				}).Warn("retrying step")
+
+				time.Sleep(s.retryDelay)
+			}
+
+			r.Attempts++
+
+			log.WithFields(log.Fields{
+				"step":    s.Name,
+				"command": "infomodels " + strings.Join(args, " "),
+			}).Info("beginning step")
+
+			pw := &prefixWriter{prefix: fmt.Sprintf("[%s] ", s.Name), w: out}
+			r.Err = runInfomodels(args, pw)
+			pw.Flush()
+
+			if r.Err == nil {
+				break
+			}
+		}
+
+		r.Duration = time.Since(start)
+
+		fields := log.Fields{
+			"step":            s.Name,
+			"attempts":        r.Attempts,
+			"durationMinutes": r.Duration.Minutes(),
+		}
+
+		if r.Err == nil {
+			r.Status = stepSucceeded
+			state.Completed = append(state.Completed, s.Name)
+			state.Failed = ""
+
+			log.WithFields(fields).Info("step succeeded")
+		} else {
+			r.Status = stepFailed
+			state.Failed = s.Name
+
+			fields["error"] = r.Err
+			fields["category"] = stepCategory(r.Err)
+			fields["onFailure"] = s.OnFailure
+			log.WithFields(fields).Error("step failed")
+
+			aborted = s.OnFailure == failAbort
+		}
+
+		if err := state.write(p.State); err != nil {
+			log.WithFields(log.Fields{
+				"state": p.State,
+				"error": err,
+			}).Error("error saving pipeline state")
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [flags]",
+	Short: "serve an HTTP API for running commands",
+	Long: `Serve an HTTP API for validating, loading and constraining datasets
+
+The API listens on the address given by the addr flag. POST /validate, /load
+and /constrain start a job running the command in the background, as the run
+command runs its steps, with the flags and arguments in the JSON body:
+
+  {"args": ["/data/site"], "options": {"searchPath": "site_seattle"}}
+
+and respond with the job, whose id is used by the other endpoints:
+
+  GET /jobs                     list the jobs
+  GET /jobs/ID                  get the status of a job and, once it has
+                                finished, its result: its exit code, its
+                                output and its JSON log entries
+  GET /jobs/ID/log              stream the output of a job until it finishes
+  GET /history                  list the version_history table of the
+                                server's database in the schema given by
+                                the searchPath query parameter
+  GET /models/NAME              list the versions of a model
+  GET /models/NAME/VERSION      list the tables of a version of a model
+
+Jobs are run against the database given to serve by dburi, with the service,
+dmsaservice, searchPath and loglvl given to serve unless their options set
+them, with the configuration file and profile of serve, and always with JSON
+logs. Options are limited to:
+
+  validate      datav, etl, site, jobs, loglvl
+  load          searchPath, model, modelv, skip-indexes, skip-constraints,
+                loglvl
+  constrain     searchPath, model, modelv, check, samples, validate,
+                workers, loglvl
+
+so that the database, the undo and notValid flags, the configuration and files
+on the server are only ever set by whoever runs the server.
+
+At most max-jobs jobs run at a time; the others wait their turn. Jobs and up to
+16MB of the output of each are kept in memory, the oldest finished jobs being
+dropped beyond keep-jobs, and all are lost when the server stops.
+
+The server listens on the loopback interface by default. If token is given (or
+INFOMODELS_TOKEN is set), requests must carry it as a bearer token in their
+Authorization header; serve refuses to listen on other interfaces without one.
+The server itself does not use TLS, so expose it through a TLS terminating
+proxy.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if viper.GetInt("maxjobs") < 1 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"max-jobs": viper.GetInt("maxjobs"),
+			}, "max-jobs must be at least 1")
+		}
+
+		if viper.GetInt("keepjobs") < 0 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"keep-jobs": viper.GetInt("keepjobs"),
+			}, "keep-jobs cannot be negative")
+		}
+
+		if viper.GetString("token") == "" && !loopbackAddr(viper.GetString("addr")) {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"addr": viper.GetString("addr"),
+			}, "serve requires a token to listen on interfaces other than loopback")
+		}
+
+		defaults := map[string]interface{}{
+			"loglvl": viper.GetString("loglvl"),
+		}
+
+		for _, name := range []string{"config", "profile", "service", "dmsaservice", "dburi", "searchPath"} {
+			if v := viper.GetString(name); v != "" {
+				defaults[name] = v
+			}
+		}
+
+		s := newJobServer(viper.GetInt("maxjobs"), viper.GetInt("keepjobs"), defaults, viper.GetString("token"))
+
+		log.WithFields(log.Fields{
+			"addr":    viper.GetString("addr"),
+			"maxJobs": viper.GetInt("maxjobs"),
+			"auth":    viper.GetString("token") != "",
+		}).Info("serving API")
+
+		if err := http.ListenAndServe(viper.GetString("addr"), s.Handler()); err != nil {
+			fatal(dataset.CategoryOther, log.Fields{
+				"addr":  viper.GetString("addr"),
+				"error": err,
+			}, "error serving API")
+		}
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(serveCmd)
+
+	// Set up the serve-command-specific flags.
+	serveCmd.Flags().String("addr", "127.0.0.1:8080", "Address to listen on.")
+	serveCmd.Flags().Int("max-jobs", 1, "Number of jobs to run at a time.")
+	serveCmd.Flags().Int("keep-jobs", 100, "Number of finished jobs to keep.")
+	serveCmd.Flags().String("token", "", "Bearer token required of requests.")
+
+	// Add the shared flags serve uses.
+	addSharedFlags(serveCmd, "dburi", "searchPath", "service", "dmsaservice")
+}
+
+// loopbackAddr reports whether the listen address is on a loopback interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
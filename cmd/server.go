@@ -0,0 +1,707 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/database"
+)
+
+// Statuses of server jobs.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobOptions are the commands the server runs as jobs and the flags a job
+// request can set for each. The database, the undo and notValid flags and
+// anything naming a file on the server are left to the server's own flags.
+var jobOptions = map[string]map[string]bool{
+	"validate": {
+		"datav":  true,
+		"etl":    true,
+		"site":   true,
+		"jobs":   true,
+		"loglvl": true,
+	},
+	"load": {
+		"searchPath":       true,
+		"model":            true,
+		"modelv":           true,
+		"skip-indexes":     true,
+		"skip-constraints": true,
+		"loglvl":           true,
+	},
+	"constrain": {
+		"searchPath": true,
+		"model":      true,
+		"modelv":     true,
+		"check":      true,
+		"samples":    true,
+		"validate":   true,
+		"workers":    true,
+		"loglvl":     true,
+	},
+}
+
+// maxJobLogSize is the most output kept for a job; beyond it the output is
+// dropped and the log marked as truncated.
+const maxJobLogSize = 16 << 20
+
+// jobRequest is the body of a request to run a command: its arguments and
+// its flags, as in a pipeline step.
+type jobRequest struct {
+	Args    []string               `json:"args"`
+	Options map[string]interface{} `json:"options"`
+}
+
+// job is a command run by the server in the background. Its output is kept in
+// its log, whose lines, JSON log entries for the most part, make up its
+// result once it finishes.
+type job struct {
+	ID       string                 `json:"id"`
+	Command  string                 `json:"command"`
+	Args     []string               `json:"args"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+	Status   string                 `json:"status"`
+	ExitCode *int                   `json:"exitCode,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Created  time.Time              `json:"created"`
+	Started  *time.Time             `json:"started,omitempty"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Result   *jobResult             `json:"result,omitempty"`
+
+	log *jobLog
+}
+
+// jobResult is what a finished job printed: its log entries, lines that are
+// not JSON, such as tables, being kept as the message of an entry.
+type jobResult struct {
+	Logs      []map[string]interface{} `json:"logs"`
+	Truncated bool                     `json:"truncated,omitempty"`
+}
+
+// jobLog holds the output of a job, up to maxJobLogSize, which readers follow
+// as it is written.
+type jobLog struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	closed    bool
+	truncated bool
+}
+
+func newJobLog() *jobLog {
+	l := &jobLog{}
+	l.cond = sync.NewCond(&l.mu)
+
+	return l
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n := maxJobLogSize - len(l.buf); n < len(p) {
+		l.buf = append(l.buf, p[:n]...)
+		l.truncated = true
+	} else {
+		l.buf = append(l.buf, p...)
+	}
+
+	l.cond.Broadcast()
+
+	return len(p), nil
+}
+
+// Close marks the end of the log.
+func (l *jobLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	l.cond.Broadcast()
+
+	return nil
+}
+
+// follow writes the log to w from the start, waiting for more until the log
+// is closed, and calls flush after each write.
+func (l *jobLog) follow(w io.Writer, flush func()) error {
+	var off int
+
+	for {
+		l.mu.Lock()
+
+		for off == len(l.buf) && !l.closed {
+			l.cond.Wait()
+		}
+
+		chunk := l.buf[off:]
+		done := l.closed && off+len(chunk) == len(l.buf)
+
+		l.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+
+			flush()
+			off += len(chunk)
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// result parses the log into a job result.
+func (l *jobLog) result() *jobResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return &jobResult{
+		Logs:      parseJSONLogs(bytes.NewReader(l.buf)),
+		Truncated: l.truncated,
+	}
+}
+
+// jobServer runs jobs, at most as many at a time as it has slots, and serves
+// the HTTP API. The defaults are the options every job is run with unless its
+// request sets them. Only the last keep finished jobs are kept.
+type jobServer struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []string
+
+	slots    chan struct{}
+	keep     int
+	defaults map[string]interface{}
+	token    string
+}
+
+func newJobServer(maxJobs int, keep int, defaults map[string]interface{}, token string) *jobServer {
+	return &jobServer{
+		jobs:     make(map[string]*job),
+		slots:    make(chan struct{}, maxJobs),
+		keep:     keep,
+		defaults: defaults,
+		token:    token,
+	}
+}
+
+// Handler returns the handler of the API's endpoints.
+func (s *jobServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	for command := range jobOptions {
+		mux.HandleFunc("/"+command, s.handleCommand(command))
+	}
+
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/history", s.handleHistory)
+	mux.HandleFunc("/models/", s.handleModels)
+
+	return s.authorize(mux)
+}
+
+// authorize requires the bearer token, if the server has one, on all requests.
+func (s *jobServer) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// handleCommand returns the handler that starts a job running the command.
+func (s *jobServer) handleCommand(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "use POST to run "+command)
+			return
+		}
+
+		req := &jobRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+			return
+		}
+
+		for name := range req.Options {
+			if !jobOptions[command][name] {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("option '%s' cannot be set for %s", name, command))
+				return
+			}
+		}
+
+		j, err := s.start(command, req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		writeJSON(w, http.StatusAccepted, s.snapshot(j))
+	}
+}
+
+// handleJobs lists the jobs in the order they were created.
+func (s *jobServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET to list jobs")
+		return
+	}
+
+	s.mu.Lock()
+
+	jobs := make([]job, 0, len(s.order))
+
+	for _, id := range s.order {
+		jobs = append(jobs, *s.jobs[id])
+	}
+
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleJob serves a job (/jobs/ID) or follows its log (/jobs/ID/log).
+func (s *jobServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET to get a job")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+
+	s.mu.Lock()
+	j := s.jobs[parts[0]]
+	s.mu.Unlock()
+
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no job '%s'", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		snapshot := s.snapshot(j)
+
+		if snapshot.Finished != nil {
+			snapshot.Result = j.log.result()
+		}
+
+		writeJSON(w, http.StatusOK, snapshot)
+
+	case len(parts) == 2 && parts[1] == "log":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		flush := func() {}
+		if f, ok := w.(http.Flusher); ok {
+			flush = f.Flush
+		}
+
+		j.log.follow(w, flush)
+
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+// handleHistory lists the version_history table of the server's database in
+// the schema given by the searchPath query parameter or the server's default.
+func (s *jobServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET to get the history")
+		return
+	}
+
+	dburi, _ := s.defaults["dburi"].(string)
+	searchPath, _ := s.defaults["searchPath"].(string)
+
+	if v := r.URL.Query().Get("searchPath"); v != "" {
+		searchPath = v
+	}
+
+	if dburi == "" || searchPath == "" {
+		writeError(w, http.StatusBadRequest, "history requires the server's dburi and a searchPath")
+		return
+	}
+
+	history, err := versionHistory(dburi, searchPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// handleModels lists the versions of a model (/models/NAME) or the tables of
+// a version of it (/models/NAME/VERSION) from the data models service.
+func (s *jobServer) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET to get models")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/models/"), "/"), "/")
+
+	if parts[0] == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "use /models/NAME or /models/NAME/VERSION")
+		return
+	}
+
+	service, _ := s.defaults["service"].(string)
+
+	c, err := dms.New(service)
+	if err == nil {
+		err = c.Ping()
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("data models service: %s", err))
+		return
+	}
+
+	revisions, err := c.ModelRevisions(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	type modelTable struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	type modelVersion struct {
+		Name    string        `json:"name"`
+		Version string        `json:"version"`
+		Tables  []*modelTable `json:"tables,omitempty"`
+	}
+
+	var versions []*modelVersion
+
+	for _, m := range revisions.List() {
+		if len(parts) == 1 {
+			versions = append(versions, &modelVersion{Name: m.Name, Version: m.Version})
+			continue
+		}
+
+		if m.Version != parts[1] {
+			continue
+		}
+
+		v := &modelVersion{Name: m.Name, Version: m.Version}
+
+		if m.Tables != nil {
+			for _, t := range m.Tables.List() {
+				v.Tables = append(v.Tables, &modelTable{Name: t.Name, Description: t.Description})
+			}
+		}
+
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+
+	if len(parts) == 2 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no version '%s' of model '%s'", parts[1], parts[0]))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// snapshot returns a copy of the job, safe to encode while it runs.
+func (s *jobServer) snapshot(j *job) job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *j
+}
+
+// newJobID returns a random job ID.
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// start queues a job running the command and runs it in the background once a
+// slot is free.
+func (s *jobServer) start(command string, req *jobRequest) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		ID:      id,
+		Command: command,
+		Args:    req.Args,
+		Options: req.Options,
+		Status:  jobQueued,
+		Created: time.Now(),
+		log:     newJobLog(),
+	}
+
+	if j.Args == nil {
+		j.Args = []string{}
+	}
+
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"job":     id,
+		"command": command,
+		"args":    j.Args,
+	}).Info("job queued")
+
+	go s.run(j)
+
+	return j, nil
+}
+
+// commandLine returns the infomodels arguments that run the job, with its
+// options overriding the server's defaults that its command accepts. Logs are
+// always JSON, so that they can be parsed into the result, and the arguments
+// follow a '--' so that they cannot be taken for flags.
+func (s *jobServer) commandLine(j *job) []string {
+	options := make(map[string]interface{})
+
+	for name, v := range acceptedOptions(j.Command, s.defaults) {
+		options[name] = v
+	}
+
+	for name, v := range j.Options {
+		options[name] = v
+	}
+
+	options["logfmt"] = "json"
+
+	args := append([]string{j.Command}, flagArgs(options)...)
+	args = append(args, "--")
+
+	return append(args, j.Args...)
+}
+
+// run waits for a slot and runs the job.
+func (s *jobServer) run(j *job) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	started := time.Now()
+
+	s.mu.Lock()
+	j.Status = jobRunning
+	j.Started = &started
+	s.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"job":     j.ID,
+		"command": j.Command,
+	}).Info("job started")
+
+	cmd, err := infomodelsCommand(s.commandLine(j))
+	if err == nil {
+		cmd.Stdout = j.log
+		cmd.Stderr = j.log
+
+		err = cmd.Run()
+	}
+
+	j.log.Close()
+
+	finished := time.Now()
+
+	s.mu.Lock()
+
+	j.Finished = &finished
+
+	if cmd != nil && cmd.ProcessState != nil {
+		code := cmd.ProcessState.ExitCode()
+		j.ExitCode = &code
+	}
+
+	if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+	} else {
+		j.Status = jobSucceeded
+	}
+
+	fields := log.Fields{
+		"job":             j.ID,
+		"command":         j.Command,
+		"status":          j.Status,
+		"durationMinutes": finished.Sub(started).Minutes(),
+	}
+
+	s.evict()
+	s.mu.Unlock()
+
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Error("job failed")
+	} else {
+		log.WithFields(fields).Info("job finished")
+	}
+}
+
+// evict drops the oldest finished jobs beyond the number kept. The server's
+// lock must be held.
+func (s *jobServer) evict() {
+	var finished int
+
+	for _, id := range s.order {
+		if s.jobs[id].Finished != nil {
+			finished++
+		}
+	}
+
+	order := s.order[:0]
+
+	for _, id := range s.order {
+		if finished > s.keep && s.jobs[id].Finished != nil {
+			delete(s.jobs, id)
+			finished--
+			continue
+		}
+
+		order = append(order, id)
+	}
+
+	s.order = order
+}
+
+// parseJSONLogs parses the lines of JSON logs, keeping other lines as the
+// message of an entry.
+func parseJSONLogs(r io.Reader) []map[string]interface{} {
+	logs := []map[string]interface{}{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := make(map[string]interface{})
+
+		if err := json.Unmarshal(line, &entry); err != nil {
+			entry = map[string]interface{}{"msg": string(line)}
+		}
+
+		logs = append(logs, entry)
+	}
+
+	return logs
+}
+
+// versionHistory returns the rows of the version_history table in the order
+// of their datetimes.
+func versionHistory(dburi string, searchPath string) ([]map[string]interface{}, error) {
+	db, err := database.OpenDatabase(dburi, searchPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("select * from version_history order by datetime")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRows(rows)
+}
+
+// scanRows returns the rows as maps of column names to values.
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{})
+
+		for i, c := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[c] = string(b)
+			} else {
+				row[c] = values[i]
+			}
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJobServer returns a server whose only slot is taken, so that the jobs it
+// starts stay queued instead of running this test binary.
+func testJobServer(keep int, token string) (*jobServer, *httptest.Server) {
+	s := newJobServer(1, keep, map[string]interface{}{
+		"dburi":  "postgres://db/pedsnet",
+		"loglvl": "Info",
+	}, token)
+
+	s.slots <- struct{}{}
+
+	return s, httptest.NewServer(s.Handler())
+}
+
+// finishedJob adds a finished job with the output to the server.
+func finishedJob(s *jobServer, id string, output string) *job {
+	now := time.Now()
+	code := 6
+
+	j := &job{
+		ID:       id,
+		Command:  "validate",
+		Args:     []string{"/data/seattle"},
+		Status:   jobFailed,
+		ExitCode: &code,
+		Created:  now,
+		Started:  &now,
+		Finished: &now,
+		log:      newJobLog(),
+	}
+
+	j.log.Write([]byte(output))
+	j.log.Close()
+
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	return j
+}
+
+func doRequest(t *testing.T, method string, url string, token string, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, b
+}
+
+func TestServerAuthorize(t *testing.T) {
+	_, ts := testJobServer(10, "secret")
+	defer ts.Close()
+
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/jobs", test.token, "")
+
+		if resp.StatusCode != test.code {
+			t.Errorf("token %q: status %d, expected %d: %s", test.token, resp.StatusCode, test.code, body)
+		}
+	}
+}
+
+func TestServerCommand(t *testing.T) {
+	s, ts := testJobServer(10, "")
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		err    string
+	}{
+		{http.MethodGet, "/validate", "", http.StatusMethodNotAllowed, "use POST"},
+		{http.MethodPost, "/validate", "{", http.StatusBadRequest, "invalid request body"},
+		{http.MethodPost, "/load", `{"options": {"dburi": "postgres://db/other"}}`, http.StatusBadRequest, "option 'dburi' cannot be set for load"},
+		{http.MethodPost, "/validate", `{"options": {"skip-indexes": true}}`, http.StatusBadRequest, "option 'skip-indexes' cannot be set for validate"},
+		{http.MethodPost, "/export", `{}`, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		resp, body := doRequest(t, test.method, ts.URL+test.path, "", test.body)
+
+		if resp.StatusCode != test.code || !strings.Contains(string(body), test.err) {
+			t.Errorf("%s %s %s: status %d, body %s, expected %d with %q", test.method, test.path, test.body, resp.StatusCode, body, test.code, test.err)
+		}
+	}
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/load", "", `{"args": ["/data/seattle"], "options": {"searchPath": "site_seattle"}}`)
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting load: status %d: %s", resp.StatusCode, body)
+	}
+
+	var j job
+
+	if err := json.Unmarshal(body, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Command != "load" || j.Status != jobQueued || !reflect.DeepEqual(j.Args, []string{"/data/seattle"}) {
+		t.Errorf("started job %+v", j)
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "/jobs/"+j.ID {
+		t.Errorf("location %q, expected /jobs/%s", loc, j.ID)
+	}
+
+	expected := []string{
+		"load",
+		"--dburi=postgres://db/pedsnet",
+		"--logfmt=json",
+		"--loglvl=Info",
+		"--searchPath=site_seattle",
+		"--",
+		"/data/seattle",
+	}
+
+	s.mu.Lock()
+	started := s.jobs[j.ID]
+	s.mu.Unlock()
+
+	if args := s.commandLine(started); !reflect.DeepEqual(args, expected) {
+		t.Errorf("commandLine() = %q, expected %q", args, expected)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/validate", "", "")
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting validate without a body: status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, ts.URL+"/jobs", "", "")
+
+	var jobs []job
+
+	if err := json.Unmarshal(body, &jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 2 || jobs[0].ID != j.ID || jobs[1].Command != "validate" {
+		t.Errorf("listed jobs %+v", jobs)
+	}
+}
+
+func TestServerJob(t *testing.T) {
+	s, ts := testJobServer(10, "")
+	defer ts.Close()
+
+	finishedJob(s, "abc", `{"level":"error","msg":"validation failed"}`+"\n+-------+\n")
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/jobs/abc", "", "")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("getting job: status %d: %s", resp.StatusCode, body)
+	}
+
+	var j job
+
+	if err := json.Unmarshal(body, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Status != jobFailed || j.ExitCode == nil || *j.ExitCode != 6 {
+		t.Errorf("job %+v", j)
+	}
+
+	expected := []map[string]interface{}{
+		{"level": "error", "msg": "validation failed"},
+		{"msg": "+-------+"},
+	}
+
+	if j.Result == nil || !reflect.DeepEqual(j.Result.Logs, expected) {
+		t.Errorf("result %+v, expected logs %v", j.Result, expected)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, ts.URL+"/jobs/abc/log", "", "")
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("log: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if string(body) != `{"level":"error","msg":"validation failed"}`+"\n+-------+\n" {
+		t.Errorf("log %q", body)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodDelete, "/jobs/abc", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/jobs/xyz", http.StatusNotFound},
+		{http.MethodGet, "/jobs/abc/result", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if resp, body := doRequest(t, test.method, ts.URL+test.path, "", ""); resp.StatusCode != test.code {
+			t.Errorf("%s %s: status %d, expected %d: %s", test.method, test.path, resp.StatusCode, test.code, body)
+		}
+	}
+}
+
+func TestServerJobQueued(t *testing.T) {
+	s, ts := testJobServer(10, "")
+	defer ts.Close()
+
+	j, err := s.start("validate", &jobRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, body := doRequest(t, http.MethodGet, ts.URL+"/jobs/"+j.ID, "", "")
+
+	var got job
+
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Status != jobQueued || got.Result != nil || got.Finished != nil {
+		t.Errorf("queued job %+v", got)
+	}
+}
+
+func TestServerHistory(t *testing.T) {
+	s := newJobServer(1, 10, map[string]interface{}{}, "")
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/history?searchPath=site_seattle", "", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("history without a dburi: status %d: %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/history", "", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST history: status %d", resp.StatusCode)
+	}
+}
+
+func TestServerModels(t *testing.T) {
+	s := newJobServer(1, 10, map[string]interface{}{}, "")
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/models/", http.StatusNotFound},
+		{"/models/pedsnet/2.3.0/person", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if resp, body := doRequest(t, http.MethodGet, ts.URL+test.path, "", ""); resp.StatusCode != test.code {
+			t.Errorf("%s: status %d, expected %d: %s", test.path, resp.StatusCode, test.code, body)
+		}
+	}
+}
+
+func TestJobLogFollow(t *testing.T) {
+	l := newJobLog()
+
+	var (
+		buf     bytes.Buffer
+		flushes int
+		done    = make(chan error)
+	)
+
+	go func() {
+		done <- l.follow(&buf, func() { flushes++ })
+	}()
+
+	l.Write([]byte("first\n"))
+	l.Write([]byte("second\n"))
+	l.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "first\nsecond\n" || flushes == 0 {
+		t.Errorf("followed %q with %d flushes", buf.String(), flushes)
+	}
+}
+
+func TestJobLogTruncated(t *testing.T) {
+	l := newJobLog()
+
+	l.Write(bytes.Repeat([]byte("x"), maxJobLogSize-2))
+
+	if n, err := l.Write([]byte("{}\n{}\n")); n != 6 || err != nil {
+		t.Errorf("Write() = %d, %v", n, err)
+	}
+
+	l.Close()
+
+	if len(l.buf) != maxJobLogSize {
+		t.Errorf("log of %d bytes, expected %d", len(l.buf), maxJobLogSize)
+	}
+
+	if r := l.result(); !r.Truncated {
+		t.Error("result of a full log is not truncated")
+	}
+}
+
+func TestParseJSONLogs(t *testing.T) {
+	logs := parseJSONLogs(strings.NewReader(`{"level":"info","rows":3}` + "\n\n  not json  \n[1]\n"))
+
+	expected := []map[string]interface{}{
+		{"level": "info", "rows": float64(3)},
+		{"msg": "not json"},
+		{"msg": "[1]"},
+	}
+
+	if !reflect.DeepEqual(logs, expected) {
+		t.Errorf("parseJSONLogs() = %v, expected %v", logs, expected)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	s := newJobServer(1, 2, nil, "")
+
+	for i := 0; i < 4; i++ {
+		finishedJob(s, fmt.Sprintf("done%d", i), "")
+	}
+
+	s.jobs["queued"] = &job{ID: "queued", log: newJobLog()}
+	s.order = append([]string{"queued"}, s.order...)
+
+	s.evict()
+
+	expected := []string{"queued", "done2", "done3"}
+
+	if !reflect.DeepEqual(s.order, expected) || len(s.jobs) != len(expected) {
+		t.Errorf("kept %q (%d jobs), expected %q", s.order, len(s.jobs), expected)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"localhost:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"10.0.0.5:8080", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if loopback := loopbackAddr(test.addr); loopback != test.loopback {
+			t.Errorf("loopbackAddr(%q) = %t, expected %t", test.addr, loopback, test.loopback)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// interrupted holds the signal that cancelled the context of the running
+// command, if any.
+var interrupted atomic.Value
+
+// exitFiles holds the paths of the files to remove when a second signal exits
+// without cleaning up.
+var exitFiles sync.Map
+
+// removeOnExit registers the file at path to be removed if a second signal
+// exits the process, returning a function that removes the file and
+// unregisters it, for the caller to defer.
+func removeOnExit(path string) func() {
+	exitFiles.Store(path, struct{}{})
+
+	return func() {
+		os.Remove(path)
+		exitFiles.Delete(path)
+	}
+}
+
+// signalContext returns a context that is cancelled when the process receives
+// SIGINT or SIGTERM, so that the running command can stop its work and clean
+// up. A second signal exits at once, without cleaning up.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		interrupted.Store(sig)
+
+		log.WithFields(log.Fields{
+			"signal": sig.String(),
+		}).Warn("interrupted, cleaning up (signal again to exit at once)")
+
+		cancel()
+
+		sig = <-signals
+
+		log.WithFields(log.Fields{
+			"signal": sig.String(),
+		}).Error("interrupted again, exiting without cleaning up")
+
+		// Files holding decrypted data are removed even so.
+		exitFiles.Range(func(path, _ interface{}) bool {
+			os.Remove(path.(string))
+			return true
+		})
+
+		os.Exit(signalStatus(sig))
+	}()
+
+	return ctx
+}
+
+// signalStatus is the exit status of a command interrupted by the signal,
+// which follows the shell convention of 128 plus the signal number: 130 for
+// SIGINT and 143 for SIGTERM.
+func signalStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+
+	return 1
+}
+
+// exitIfInterrupted exits with the status of the interrupting signal if the
+// context was cancelled by one, logging the fields. Commands call it before
+// treating an error as a failure, since the error of an interrupted command is
+// just the cancellation.
+func exitIfInterrupted(ctx context.Context, fields log.Fields) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	sig, _ := interrupted.Load().(os.Signal)
+
+	if sig != nil {
+		fields["signal"] = sig.String()
+	}
+
+	log.WithFields(fields).Error("interrupted")
+
+	failures.WithLabelValues("interrupted").Inc()
+	pushMetrics()
+
+	os.Exit(signalStatus(sig))
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"golang.org/x/crypto/openpgp"
+)
+
+// readSigningKey reads the first private key from the key source, decrypting
+// it with the source's passphrase if it is encrypted.
+func readSigningKey(keys *keySource) (*openpgp.Entity, error) {
+	entities, err := keys.Keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *openpgp.Entity
+
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			signer = e
+			break
+		}
+	}
+
+	if signer == nil {
+		return nil, fmt.Errorf("no private key found in %s", keys)
+	}
+
+	if signer.PrivateKey.Encrypted {
+		return nil, fmt.Errorf("private key in %s is encrypted and no passphrase was given", keys)
+	}
+
+	return signer, nil
+}
+
+// signFile writes an ascii armored detached signature of the file to the
+// file's path with the signature extension appended.
+func signFile(filePath string, signer *openpgp.Entity) error {
+	sig, err := detachSign(filePath, signer)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath+dataset.SignatureExt, sig, 0644)
+}
+
+// detachSign returns an ascii armored detached signature of the file.
+func detachSign(filePath string, signer *openpgp.Entity) ([]byte, error) {
+	in, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var sig bytes.Buffer
+
+	if err = openpgp.ArmoredDetachSign(&sig, signer, in, nil); err != nil {
+		return nil, err
+	}
+
+	return sig.Bytes(), nil
+}
+
+// metadataSignaturePath returns the path the detached signature of the
+// metadata file named name is written to next to a datapackage format
+// package, which cannot carry it.
+func metadataSignaturePath(packagePath string, name string) string {
+	return packagePath + "." + name + dataset.SignatureExt
+}
+
+// placeMetadataSignature copies the signature of the metadata file written
+// next to the datapackage format package at packagePath, if there is one,
+// next to the metadata file expanded into dir.
+func placeMetadataSignature(packagePath string, dir string) error {
+	for _, name := range []string{dataset.MetadataFile, dataset.DataPackageFile} {
+		sig, err := ioutil.ReadFile(metadataSignaturePath(packagePath, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(filepath.Join(dir, name+dataset.SignatureExt), sig, 0644)
+	}
+
+	return nil
+}
+
+// verifyFile checks the detached signature next to the file against the
+// public keys in the ascii armored keyring at keyPath, returning the signer.
+func verifyFile(filePath string, keyPath string) (*openpgp.Entity, error) {
+	keyring, err := readKeyring(keyPath)
+	if err != nil {
+		return nil, &dataset.Error{Category: dataset.CategoryConfiguration, Err: err}
+	}
+
+	return dataset.VerifySignature(filePath, keyring)
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testEntity returns a new unencrypted key pair. Its hash preference lets
+// messages be encrypted for it, and its short key keeps the tests quick.
+func testEntity(t *testing.T, name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.org", &packet.Config{DefaultHash: crypto.SHA256, RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestSignFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		signer = testEntity(t, "signer")
+		other  = testEntity(t, "other")
+		path   = filepath.Join(dir, "package.tar.gz")
+	)
+
+	if err = ioutil.WriteFile(path, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = signFile(path, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := dataset.VerifySignature(path, openpgp.EntityList{other, signer})
+	if err != nil {
+		t.Fatalf("unexpected error verifying the signature: %s", err)
+	}
+
+	if e.PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("signed by %s, expected %s", dataset.EntityName(e), dataset.EntityName(signer))
+	}
+
+	if _, err = dataset.VerifySignature(path, openpgp.EntityList{other}); dataset.CategoryOf(err) != dataset.CategoryChecksum {
+		t.Errorf("error %v verifying with another key, expected a %s error", err, dataset.CategoryChecksum)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("changed package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = dataset.VerifySignature(path, openpgp.EntityList{signer}); dataset.CategoryOf(err) != dataset.CategoryChecksum {
+		t.Errorf("error %v verifying a changed file, expected a %s error", err, dataset.CategoryChecksum)
+	}
+}
+
+func TestTarMetadataSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		signer = testEntity(t, "signer")
+		src    = filepath.Join(dir, "src")
+		dst    = filepath.Join(dir, "dst")
+	)
+
+	if err = os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := filepath.Join(src, dataset.MetadataFile)
+
+	if err = ioutil.WriteFile(metadata, []byte("organization,filename\nseattle,person.csv\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale signature in the data directory is replaced by the new one.
+	if err = ioutil.WriteFile(metadata+dataset.SignatureExt, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := detachSign(metadata, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err = writeTar(&buf, src, formatTarGz, map[string][]byte{dataset.MetadataFile + dataset.SignatureExt: sig}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(metadata + dataset.SignatureExt); string(b) != "stale" {
+		t.Error("the signature in the data directory was changed")
+	}
+
+	if err = readTar(&buf, dst, formatTarGz); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = dataset.VerifySignature(filepath.Join(dst, dataset.MetadataFile), openpgp.EntityList{signer}); err != nil {
+		t.Errorf("unexpected error verifying the expanded metadata file: %s", err)
+	}
+}
+
+func TestPlaceMetadataSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infomodels-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagePath := filepath.Join(dir, "package.zip")
+
+	// Packages without a metadata signature are left alone.
+	if err = placeMetadataSignature(packagePath, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(metadataSignaturePath(packagePath, dataset.DataPackageFile), []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = placeMetadataSignature(packagePath, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, dataset.DataPackageFile+dataset.SignatureExt)); err != nil || string(b) != "signature" {
+		t.Errorf("placed signature is %q, %v", b, err)
+	}
+}
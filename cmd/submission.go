@@ -0,0 +1,562 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"gopkg.in/yaml.v2"
+)
+
+// Statuses of watched submissions.
+const (
+	submissionProcessing = "processing"
+	submissionSucceeded  = "succeeded"
+	submissionFailed     = "failed"
+)
+
+// unmatchedSite names the folders of packages that match no site.
+const unmatchedSite = "unmatched"
+
+// partialExts mark files that are still being uploaded.
+var partialExts = []string{".part", ".filepart", ".partial", ".tmp", ".uploading"}
+
+// packageExts are the extensions of the packages taken from the watched
+// directory: those of the tar formats and of the zip files of the datapackage
+// format.
+var packageExts = []string{".tar.gz", ".tgz", ".tar.zst", ".tzst", ".zip"}
+
+// volumeRegexp matches the extension of a volume of a split package.
+var volumeRegexp = regexp.MustCompile(`\.\d{3}$`)
+
+// watchConfig holds the settings of the sites whose packages are watched for.
+// The options are passed as flags to every step of every site.
+type watchConfig struct {
+	Options map[string]interface{} `yaml:"options"`
+	Sites   map[string]*watchSite  `yaml:"sites"`
+}
+
+// watchSite holds the settings of a site. A site's packages are those in the
+// subdirectory of the watched directory named after it and those in the
+// watched directory itself whose names match the pattern. The options are
+// passed to every step, the step options only to that step. The expanded data
+// of a package that succeeds is removed unless KeepData is set.
+type watchSite struct {
+	Pattern         string                 `yaml:"pattern"`
+	Load            bool                   `yaml:"load"`
+	KeepData        bool                   `yaml:"keep-data"`
+	Options         map[string]interface{} `yaml:"options"`
+	ExpandOptions   map[string]interface{} `yaml:"expand-options"`
+	ValidateOptions map[string]interface{} `yaml:"validate-options"`
+	LoadOptions     map[string]interface{} `yaml:"load-options"`
+}
+
+// readWatchConfig reads and checks the site settings file.
+func readWatchConfig(path string) (*watchConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &watchConfig{}
+
+	if err = yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	if len(c.Sites) == 0 {
+		return nil, fmt.Errorf("%s declares no sites", path)
+	}
+
+	for name, site := range c.Sites {
+		if name == unmatchedSite || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid site name '%s'", name)
+		}
+
+		if site == nil {
+			c.Sites[name] = &watchSite{}
+			continue
+		}
+
+		if site.Pattern != "" {
+			if _, err = filepath.Match(site.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("site '%s': invalid pattern '%s': %s", name, site.Pattern, err)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// siteNames returns the names of the sites in order.
+func (c *watchConfig) siteNames() []string {
+	var names []string
+
+	for name := range c.Sites {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// matchSite returns the first site, in name order, whose pattern matches the
+// file name, or an empty string if none does.
+func (c *watchConfig) matchSite(name string) string {
+	for _, site := range c.siteNames() {
+		if p := c.Sites[site].Pattern; p != "" {
+			if ok, _ := filepath.Match(p, name); ok {
+				return site
+			}
+		}
+	}
+
+	return ""
+}
+
+// submission is a package dropped into the watched directory, with the files
+// that come with it: its detached signature and, for a package split into
+// volumes, the volumes listed in its manifest, which stands in for it.
+type submission struct {
+	Site    string
+	Name    string
+	Path    string
+	Files   []string
+	Missing []string
+}
+
+// siteDir returns the name of the folder the submission's files go in.
+func (s *submission) siteDir() string {
+	if s.Site == "" {
+		return unmatchedSite
+	}
+
+	return s.Site
+}
+
+// isPackageFile reports whether a file in the watched directory can be a
+// package or the manifest of one, rather than a partial upload, a signature, a
+// volume or any other file, such as the sites file.
+func isPackageFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, dataset.SignatureExt) || volumeRegexp.MatchString(name) {
+		return false
+	}
+
+	for _, ext := range partialExts {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+
+	return hasPackageExt(strings.TrimSuffix(name, manifestExt))
+}
+
+// hasPackageExt reports whether the name ends in one of the package
+// extensions, optionally followed by an encryption extension.
+func hasPackageExt(name string) bool {
+	name = strings.ToLower(name)
+
+	for _, ext := range encryptedExts {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	for _, ext := range packageExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findSubmissions lists the packages in the watched directory and in the
+// subdirectories named after the sites. A detached signature is required if
+// the site's expand step verifies signatures.
+func findSubmissions(dir string, c *watchConfig) ([]*submission, error) {
+	dirs := map[string]string{"": dir}
+
+	for _, site := range c.siteNames() {
+		dirs[site] = filepath.Join(dir, site)
+	}
+
+	var subs []*submission
+
+	for _, site := range append([]string{""}, c.siteNames()...) {
+		infos, err := ioutil.ReadDir(dirs[site])
+		if os.IsNotExist(err) && site != "" {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || !isPackageFile(info.Name()) {
+				continue
+			}
+
+			s := &submission{
+				Site: site,
+				Name: strings.TrimSuffix(info.Name(), manifestExt),
+				Path: filepath.Join(dirs[site], info.Name()),
+			}
+
+			if s.Site == "" {
+				s.Site = c.matchSite(info.Name())
+			}
+
+			s.Files = []string{s.Path}
+
+			if strings.HasSuffix(s.Path, manifestExt) {
+				manifest, err := readVolumeManifest(s.Path)
+				if err != nil {
+					s.Missing = append(s.Missing, s.Path)
+				} else {
+					for _, v := range manifest.Volumes {
+						s.Files = append(s.Files, filepath.Join(dirs[site], v.Name))
+					}
+				}
+			}
+
+			sig := s.Path + dataset.SignatureExt
+
+			if _, err := os.Stat(sig); err == nil {
+				s.Files = append(s.Files, sig)
+			} else if s.Site != "" && c.siteOptions(s.Site, "expand")["verify-key"] != nil {
+				s.Missing = append(s.Missing, sig)
+			}
+
+			for _, f := range s.Files[1:] {
+				if _, err := os.Stat(f); err != nil {
+					s.Missing = append(s.Missing, f)
+				}
+			}
+
+			subs = append(subs, s)
+		}
+	}
+
+	return subs, nil
+}
+
+// siteOptions returns the options of a step of the site, merged over the
+// options of the site and of all sites that the step's command accepts.
+func (c *watchConfig) siteOptions(site string, command string) map[string]interface{} {
+	options := make(map[string]interface{})
+
+	s := c.Sites[site]
+
+	for _, m := range []map[string]interface{}{acceptedOptions(command, c.Options), acceptedOptions(command, s.Options), s.stepOptions(command)} {
+		for name, v := range m {
+			options[name] = v
+		}
+	}
+
+	return options
+}
+
+// stepOptions returns the site's options for the command.
+func (s *watchSite) stepOptions(command string) map[string]interface{} {
+	switch command {
+	case "expand":
+		return s.ExpandOptions
+	case "validate":
+		return s.ValidateOptions
+	case "load":
+		return s.LoadOptions
+	}
+
+	return nil
+}
+
+// sitePipeline returns the pipeline that expands the submission into the data
+// directory, validates it and, if the site loads its packages, loads it.
+func (c *watchConfig) sitePipeline(s *submission, id string, work string) *pipeline {
+	data := filepath.Join(work, "data")
+
+	expand := &pipelineStep{
+		Name:      "expand",
+		Command:   "expand",
+		Args:      []string{s.Path},
+		Options:   c.siteOptions(s.Site, "expand"),
+		OnFailure: failAbort,
+	}
+
+	expand.Options["output"] = data
+
+	commands := []string{"validate"}
+
+	if c.Sites[s.Site].Load {
+		commands = append(commands, "load")
+	}
+
+	steps := []*pipelineStep{expand}
+
+	for _, command := range commands {
+		steps = append(steps, &pipelineStep{
+			Name:      command,
+			Command:   command,
+			Args:      []string{data},
+			Options:   c.siteOptions(s.Site, command),
+			OnFailure: failAbort,
+		})
+	}
+
+	return &pipeline{
+		Name:  s.Site + "/" + id,
+		Log:   filepath.Join(work, "pipeline.log"),
+		State: filepath.Join(work, "pipeline.state"),
+		Steps: steps,
+	}
+}
+
+// settleTracker follows the size and modification time of files across scans
+// of the watched directory, to tell when an upload has completed. Stuck are
+// packages that could not be moved after processing, which are not processed
+// again while they remain.
+type settleTracker struct {
+	settle time.Duration
+	seen   map[string]*fileObservation
+	stuck  map[string]bool
+}
+
+// fileObservation is the last seen size and modification time of a file and
+// when they were first seen.
+type fileObservation struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+func newSettleTracker(settle time.Duration) *settleTracker {
+	return &settleTracker{
+		settle: settle,
+		seen:   make(map[string]*fileObservation),
+		stuck:  make(map[string]bool),
+	}
+}
+
+// settled reports whether the files have not changed for the settle duration.
+func (t *settleTracker) settled(files []string, now time.Time) bool {
+	settled := true
+
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			delete(t.seen, f)
+			settled = false
+			continue
+		}
+
+		o := t.seen[f]
+
+		if o == nil || o.size != info.Size() || !o.modTime.Equal(info.ModTime()) {
+			o = &fileObservation{size: info.Size(), modTime: info.ModTime(), since: now}
+			t.seen[f] = o
+		}
+
+		if now.Sub(o.since) < t.settle {
+			settled = false
+		}
+	}
+
+	return settled
+}
+
+// forget drops the observations of files other than those given.
+func (t *settleTracker) forget(keep map[string]bool) {
+	for f := range t.seen {
+		if !keep[f] {
+			delete(t.seen, f)
+		}
+	}
+
+	for f := range t.stuck {
+		if !keep[f] {
+			delete(t.stuck, f)
+		}
+	}
+}
+
+// submissionStatus records the progress and outcome of a submission. It is
+// written to the status folder when processing starts and when it ends.
+type submissionStatus struct {
+	ID          string        `json:"id"`
+	Site        string        `json:"site"`
+	Package     string        `json:"package"`
+	Files       []string      `json:"files"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Data        string        `json:"data,omitempty"`
+	DataRemoved bool          `json:"dataRemoved,omitempty"`
+	Log         string        `json:"log,omitempty"`
+	Moved       string        `json:"moved,omitempty"`
+	Steps       []*stepStatus `json:"steps,omitempty"`
+	Started     time.Time     `json:"started"`
+	Finished    *time.Time    `json:"finished,omitempty"`
+}
+
+// stepStatus is the outcome of a step of a submission.
+type stepStatus struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	Attempts        int     `json:"attempts"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// write saves the status file.
+func (s *submissionStatus) write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// watchDirs are the folders the watch command moves and writes files to.
+type watchDirs struct {
+	Done   string
+	Failed string
+	Status string
+	Work   string
+}
+
+// processSubmission runs the site's pipeline on the submission, working in a
+// folder of its own, and moves its files to a folder of their own in the done
+// or failed folder, writing the status file as it goes. Step output is
+// written to the pipeline log and to out. The expanded data of a submission
+// that succeeds is removed unless its site keeps it; that of one that fails is
+// kept to look into.
+func processSubmission(s *submission, c *watchConfig, dirs *watchDirs, out io.Writer) *submissionStatus {
+	start := time.Now()
+	id := s.Name + "-" + start.Format("20060102T150405")
+	work := filepath.Join(dirs.Work, s.siteDir(), id)
+	statusPath := filepath.Join(dirs.Status, s.siteDir(), id+".json")
+
+	status := &submissionStatus{
+		ID:      id,
+		Site:    s.Site,
+		Package: s.Path,
+		Files:   s.Files,
+		Status:  submissionProcessing,
+		Started: start,
+	}
+
+	save := func() {
+		if err := status.write(statusPath); err != nil {
+			fmt.Fprintf(out, "error writing status file %s: %s\n", statusPath, err)
+		}
+	}
+
+	save()
+
+	err := runSubmission(s, c, id, work, status, out)
+
+	if err != nil {
+		status.Status = submissionFailed
+		status.Error = err.Error()
+	} else {
+		status.Status = submissionSucceeded
+
+		if !c.Sites[s.Site].KeepData {
+			if rerr := os.RemoveAll(status.Data); rerr != nil {
+				fmt.Fprintf(out, "error removing expanded data %s: %s\n", status.Data, rerr)
+			} else {
+				status.DataRemoved = true
+			}
+		}
+	}
+
+	dest := filepath.Join(dirs.Done, s.siteDir(), id)
+	if err != nil {
+		dest = filepath.Join(dirs.Failed, s.siteDir(), id)
+	}
+
+	if err = moveFiles(s.Files, dest); err != nil {
+		status.Status = submissionFailed
+		status.Error = fmt.Sprintf("moving the package to %s: %s", dest, err)
+	} else {
+		status.Moved = dest
+	}
+
+	finished := time.Now()
+	status.Finished = &finished
+
+	save()
+
+	return status
+}
+
+// runSubmission runs the site's pipeline on the submission, recording its
+// steps in the status.
+func runSubmission(s *submission, c *watchConfig, id string, work string, status *submissionStatus, out io.Writer) error {
+	if s.Site == "" {
+		return fmt.Errorf("the package matches no site")
+	}
+
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+
+	p := c.sitePipeline(s, id, work)
+
+	status.Data = p.Steps[0].Options["output"].(string)
+	status.Log = p.Log
+
+	logFile, err := os.OpenFile(p.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	results := runPipeline(p, &pipelineState{}, io.MultiWriter(out, logFile))
+
+	for _, r := range results {
+		step := &stepStatus{
+			Name:            r.Step.Name,
+			Status:          r.Status,
+			Attempts:        r.Attempts,
+			DurationSeconds: r.Duration.Seconds(),
+		}
+
+		if r.Err != nil {
+			step.Error = r.Err.Error()
+			err = fmt.Errorf("step %s failed: %s", r.Step.Name, r.Err)
+		}
+
+		status.Steps = append(status.Steps, step)
+	}
+
+	return err
+}
+
+// moveFiles moves the files into the directory, creating it.
+func moveFiles(files []string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(dir, filepath.Base(f))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
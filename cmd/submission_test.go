@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+func TestIsPackageFile(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"seattle.tar.gz", true},
+		{"seattle.tar.gz.gpg", true},
+		{"seattle.tar.zst.age", true},
+		{"seattle.zip", true},
+		{"seattle.zip.gpg", true},
+		{"SEATTLE.TGZ", true},
+		{"seattle.tzst.pgp", true},
+		{"seattle.tar.gz.manifest", true},
+		{"seattle_2016", false},
+		{"seattle.csv", false},
+		{"seattle.gpg", false},
+		{"seattle.manifest", false},
+		{"README", false},
+		{"sites.yaml", false},
+		{"seattle.tar.gz.sig", false},
+		{"seattle.tar.gz.001", false},
+		{"seattle.tar.gz.123", false},
+		{"seattle.tar.gz.1234", false},
+		{".seattle.tar.gz", false},
+		{".DS_Store", false},
+		{"seattle.tar.gz.part", false},
+		{"seattle.tar.gz.filepart", false},
+		{"seattle.tar.gz.partial", false},
+		{"seattle.tar.gz.tmp", false},
+		{"seattle.tar.gz.uploading", false},
+	}
+
+	for _, test := range tests {
+		if ok := isPackageFile(test.name); ok != test.ok {
+			t.Errorf("isPackageFile(%q) = %t, expected %t", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestSettleTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settle-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := filepath.Join(dir, "seattle.tar.gz")
+	sig := pkg + dataset.SignatureExt
+
+	for _, f := range []string{pkg, sig} {
+		if err = ioutil.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []string{pkg, sig}
+	start := time.Now()
+
+	tracker := newSettleTracker(time.Minute)
+
+	steps := []struct {
+		name    string
+		after   time.Duration
+		change  func() error
+		settled bool
+	}{
+		{name: "first seen", after: 0, settled: false},
+		{name: "within the settle time", after: 30 * time.Second, settled: false},
+		{name: "after the settle time", after: 61 * time.Second, settled: true},
+		{
+			name:  "grown",
+			after: 62 * time.Second,
+			change: func() error {
+				return ioutil.WriteFile(pkg, []byte("more data"), 0644)
+			},
+			settled: false,
+		},
+		{name: "within the settle time of growing", after: 2 * time.Minute, settled: false},
+		{name: "after the settle time of growing", after: 123 * time.Second, settled: true},
+		{
+			name:  "touched",
+			after: 124 * time.Second,
+			change: func() error {
+				return os.Chtimes(sig, start, start.Add(time.Hour))
+			},
+			settled: false,
+		},
+		{name: "after the settle time of touching", after: 185 * time.Second, settled: true},
+		{
+			name:  "removed",
+			after: 186 * time.Second,
+			change: func() error {
+				return os.Remove(sig)
+			},
+			settled: false,
+		},
+	}
+
+	for _, step := range steps {
+		if step.change != nil {
+			if err = step.change(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if settled := tracker.settled(files, start.Add(step.after)); settled != step.settled {
+			t.Errorf("%s: settled = %t, expected %t", step.name, settled, step.settled)
+		}
+	}
+
+	if _, ok := tracker.seen[sig]; ok {
+		t.Error("the removed file is still tracked")
+	}
+
+	// Forget everything but the package.
+	tracker.stuck[pkg] = true
+	tracker.stuck[sig] = true
+
+	tracker.forget(map[string]bool{pkg: true})
+
+	if _, ok := tracker.seen[pkg]; !ok || !tracker.stuck[pkg] {
+		t.Error("forget dropped the kept package")
+	}
+
+	if tracker.stuck[sig] {
+		t.Error("forget kept a stuck file that was not given")
+	}
+
+	tracker.forget(nil)
+
+	if len(tracker.seen) != 0 || len(tracker.stuck) != 0 {
+		t.Errorf("forget(nil) left %d observations and %d stuck files", len(tracker.seen), len(tracker.stuck))
+	}
+}
+
+func TestSettleTrackerNoSettle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settle-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := filepath.Join(dir, "seattle.tar.gz")
+
+	if err = ioutil.WriteFile(pkg, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !newSettleTracker(0).settled([]string{pkg}, time.Now()) {
+		t.Error("a file is not settled at once without a settle time")
+	}
+}
+
+func TestFindSubmissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &watchConfig{Sites: map[string]*watchSite{
+		"seattle": {Pattern: "seattle_*"},
+		"boston":  {},
+	}}
+
+	files := []string{
+		"seattle_2016.tar.gz",
+		"boston_2016.zip",
+		"README",
+		"sites.yaml",
+		"seattle_2016.csv",
+		filepath.Join("boston", "boston_2017.tar.zst.age"),
+		filepath.Join("boston", "notes.txt"),
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subs, err := findSubmissions(dir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]string)
+
+	for _, s := range subs {
+		rel, _ := filepath.Rel(dir, s.Path)
+		found[rel] = s.Site
+	}
+
+	expected := map[string]string{
+		"seattle_2016.tar.gz": "seattle",
+		"boston_2016.zip":     "",
+		filepath.Join("boston", "boston_2017.tar.zst.age"): "boston",
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("found submissions %v, expected %v", found, expected)
+	}
+}
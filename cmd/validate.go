@@ -4,13 +4,12 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
-	"path"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	dms "github.com/chop-dbhi/data-models-service/client"
 	validator "github.com/chop-dbhi/data-models-validator"
-	"github.com/infomodels/datadirectory"
+	"github.com/infomodels/infomodels/pkg/dataset"
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,344 +25,252 @@ var validateCmd = &cobra.Command{
 Validate the dataset in DATADIR by verifying any metadata passed on the command
 line against the metadata file, each checksum in the metadata file against the
 appropriate file, and each file against the format prescribed for its table in
-the model definition.`,
-	Run: func(cmd *cobra.Command, args []string) {
+the model definition.
 
-		var (
-			d   *datadirectory.DataDirectory
-			m   *dms.Model
-			arg string
-			err error
-		)
+Checksums are verified with the algorithm recorded for each file in the metadata
+file (sha256 if none is recorded), hashing as many files concurrently as given
+by the jobs flag. Any row counts, byte sizes, header columns and encodings in
+the metadata file are verified at the same time.
+
+If verify-key is given, the detached signature of the metadata file written by
+compress is checked against the ascii armored public key(s) at that path before
+the metadata file is read.`,
+	Run: func(cmd *cobra.Command, args []string) {
 
 		// Enforce single data directory argument.
 		if len(args) != 1 {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryUsage, log.Fields{
 				"args": args,
-			}).Fatal("validate requires 1 argument")
+			}, "validate requires 1 argument")
 		}
 
-		arg = args[0]
+		arg := args[0]
 
 		log.WithFields(log.Fields{
 			"directory": arg,
 		}).Info("beginning dataset validation")
 
-		// On debug, declare that DataDirectory object is being created
-		// and all the arguements being used.
-		log.WithFields(log.Fields{
-			"DataDirPath":  arg,
-			"DataVersion":  viper.GetString("datav"),
-			"Etl":          viper.GetString("etl"),
-			"Model":        viper.GetString("model"),
-			"ModelVersion": viper.GetString("modelv"),
-			"Service":      viper.GetString("service"),
-			"Site":         viper.GetString("site"),
-		}).Debug("creating new DataDirectory object")
-
-		// Create DataDirectory object, using all information given.
-		d, err = datadirectory.New(&datadirectory.Config{
-			DataDirPath:  arg,
-			DataVersion:  viper.GetString("datav"),
-			Etl:          viper.GetString("etl"),
-			Model:        viper.GetString("model"),
-			ModelVersion: viper.GetString("modelv"),
-			Service:      viper.GetString("service"),
-			Site:         viper.GetString("site"),
-		})
+		// Any metadata given on the command line is checked against the
+		// metadata file, and the model given overrides the one in it.
+		opts := dataset.ValidateOptions{
+			Attrs: dataset.Attrs{
+				Site:         viper.GetString("site"),
+				Model:        viper.GetString("model"),
+				ModelVersion: viper.GetString("modelv"),
+				DataVersion:  viper.GetString("datav"),
+				Etl:          viper.GetString("etl"),
+			},
+			Service: viper.GetString("service"),
+			Jobs:    viper.GetInt("jobs"),
+			OnFile:  reportFile,
+		}
+
+		if viper.GetString("verifykey") != "" {
+			keyring, err := readKeyring(viper.GetString("verifykey"))
+			if err != nil {
+				fatal(dataset.CategoryConfiguration, log.Fields{
+					"key":   viper.GetString("verifykey"),
+					"error": err,
+				}, "error reading verify key")
+			}
 
-		// Fatal and exit if the object creation fails.
+			opts.Keyring = keyring
+		}
+
+		ctx := signalContext()
+		start := time.Now()
+
+		report, err := dataset.Validate(ctx, arg, opts)
 		if err != nil {
-			log.WithFields(log.Fields{
+			exitIfInterrupted(ctx, log.Fields{
 				"directory": arg,
-				"error":     err,
-			}).Fatal("error creating DataDirectory object")
-		}
+			})
 
-		// Fill the DataDirectory object with records from the metadata file.
-		// Fatal and exit on error.
-		if err = d.ReadMetadataFromFile(); err != nil {
-			log.WithFields(log.Fields{
+			fatal(dataset.CategoryOf(err), log.Fields{
 				"directory": arg,
 				"error":     err,
-			}).Fatal("error reading metadata file")
+			}, "error validating dataset")
 		}
 
-		// Hack to get Model and ModelVersion actually on to the DataDirectory
-		// object, should be done by library.
-		// Kevin's hack: command-line args should override file-based configuration
-		if d.Model == "" {
-			d.Model = d.RecordMaps[0]["cdm"]
-		}
-		if d.ModelVersion == "" {
-			d.ModelVersion = d.RecordMaps[0]["cdm-version"]
-		}
+		recordStep("validate", time.Since(start))
 
-		// Validate metadata information and checksums, fatal and exit on err.
-		// This checks the attributes on the DataDirectory object (any command
-		// line arguments given) against the values in the metadata file and
-		// the checksums in the metadata file against the data files.
-		if err = d.Validate(); err != nil {
+		if report.Signer != nil {
 			log.WithFields(log.Fields{
 				"directory": arg,
-				"error":     err,
-			}).Fatal("error validating checksums and metadata file")
+				"signer":    dataset.EntityName(report.Signer),
+			}).Info("verified metadata file signature")
 		}
 
-		// Get the model definition for the data format validation.
-		if m, err = getModel(d.Model, d.ModelVersion, viper.GetString("service")); err != nil {
-			log.WithFields(log.Fields{
+		// Exit non-zero on any format issues.
+		if !report.Valid() {
+			fatal(dataset.CategoryFormat, log.Fields{
 				"directory": arg,
-				"error":     err,
-			}).Fatal("error retrieving data model definition for format validation")
+			}, "format validation found issues")
 		}
+	},
+}
 
-		var (
-			hasErrors bool
-			table     *dms.Table
-		)
-
-		// Iterate over metadata records, running the format validation on each
-		// file.
-		// TODO: Improve logging in below loop.
-		// TODO: Parallelize it!
-		// TODO: More comments!
-		for _, record := range d.RecordMaps {
-
-			if table = m.Tables.Get(record["table"]); table == nil {
-				log.Warnf("* Unknown table '%s'.\nChoices are: %s", record["table"], strings.Join(m.Tables.Names(), ", "))
-				continue
-			}
-
-			log.Infof("* Evaluating '%s' table in '%s'...", record["table"], record["filename"])
-
-			// Open the reader.
-			reader, err := validator.Open(path.Join(d.DirPath, record["filename"]), "")
-
-			if err != nil {
-				log.Warnf("* Could not open file: %s", err)
-				continue
-			}
-
-			v := validator.New(reader, table)
-
-			if err = v.Init(); err != nil {
-				log.Warnf("* Problem reading CSV header: %s", err)
-				reader.Close()
-				continue
-			}
-
-			if err = v.Run(); err != nil {
-				log.Warnf("* Problem reading CSV data: %s", err)
-			}
+func init() {
 
-			reader.Close()
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(validateCmd)
 
-			// Build the result.
-			result := v.Result()
+	// Set up the validate-command-specific flags.
+	validateCmd.Flags().String("datav", "", "Dataset version number.")
+	validateCmd.Flags().String("etl", "", "URL of the ETL code used to create the dataset.")
+	validateCmd.Flags().String("site", "", "Name of the organization or site that created the dataset.")
 
-			lerrs := result.LineErrors()
+	// Add the shared flags validate uses.
+	addSharedFlags(validateCmd, "model", "modelv", "service", "jobs", "verify-key")
+	addSharedFlags(validateCmd, metricsFlags...)
+}
 
-			if len(lerrs) > 0 {
-				hasErrors = true
+// reportFile adds the validation report of a file to the metrics and prints
+// it.
+func reportFile(f *dataset.FileReport) {
+	recordFileReport(f)
+	printFileReport(f)
+}
 
-				log.Warn("* Row-level issues were found.")
+// printFileReport prints the issues found in a file, if any, as tables of
+// row-level and field-level issues.
+func printFileReport(f *dataset.FileReport) {
+	if f.Err != nil {
+		log.Warnf("* Problem with '%s': %s", f.Filename, f.Err)
+	}
 
-				// Row level issues.
-				tw := tablewriter.NewWriter(os.Stdout)
+	if f.Result == nil {
+		return
+	}
 
-				tw.SetHeader([]string{
-					"code",
-					"error",
-					"occurrences",
-					"lines",
-					"example",
-				})
+	result := f.Result
 
-				var lines, example string
+	lerrs := result.LineErrors()
 
-				for err, verrs := range result.LineErrors() {
-					ve := verrs[0]
+	if len(lerrs) > 0 {
+		log.Warn("* Row-level issues were found.")
 
-					if ve.Context != nil {
-						example = fmt.Sprintf("line %d: `%v` %v", ve.Line, ve.Value, ve.Context)
-					} else {
-						example = fmt.Sprintf("line %d: `%v`", ve.Line, ve.Value)
-					}
+		// Row level issues.
+		tw := tablewriter.NewWriter(os.Stdout)
 
-					errsteps := errLineSteps(verrs)
+		tw.SetHeader([]string{
+			"code",
+			"error",
+			"occurrences",
+			"lines",
+			"example",
+		})
 
-					if len(errsteps) > 10 {
-						lines = fmt.Sprintf("%s ... (%d more)", strings.Join(errsteps[:10], ", "), len(errsteps[10:]))
-					} else {
-						lines = strings.Join(errsteps, ", ")
-					}
+		var lines, example string
 
-					tw.Append([]string{
-						fmt.Sprint(err.Code),
-						err.Description,
-						fmt.Sprint(len(verrs)),
-						lines,
-						example,
-					})
-				}
+		for err, verrs := range result.LineErrors() {
+			ve := verrs[0]
 
-				tw.Render()
+			if ve.Context != nil {
+				example = fmt.Sprintf("line %d: `%v` %v", ve.Line, ve.Value, ve.Context)
+			} else {
+				example = fmt.Sprintf("line %d: `%v`", ve.Line, ve.Value)
 			}
 
-			// Field level issues.
-			tw := tablewriter.NewWriter(os.Stdout)
-
-			tw.SetHeader([]string{
-				"field",
-				"code",
-				"error",
-				"occurrences",
-				"lines",
-				"samples",
-			})
-
-			var nerrs int
-
-			// Output the error occurrence per field.
-			for _, f := range v.Header {
-				errmap := result.FieldErrors(f)
-
-				if len(errmap) == 0 {
-					continue
-				}
-
-				nerrs += len(errmap)
-
-				var (
-					lines  string
-					sample []*validator.ValidationError
-				)
-
-				for err, verrs := range errmap {
-					num := len(verrs)
-
-					if num >= sampleSize {
-						sample = make([]*validator.ValidationError, sampleSize)
-
-						// Randomly sample.
-						for i := range sample {
-							j := rand.Intn(num)
-							sample[i] = verrs[j]
-						}
-					} else {
-						sample = verrs
-					}
-
-					sstrings := make([]string, len(sample))
-
-					for i, ve := range sample {
-						if ve.Context != nil {
-							sstrings[i] = fmt.Sprintf("line %d: `%s` %s", ve.Line, ve.Value, ve.Context)
-						} else {
-							sstrings[i] = fmt.Sprintf("line %d: `%s`", ve.Line, ve.Value)
-						}
-					}
-
-					errsteps := errLineSteps(verrs)
-
-					if len(errsteps) > 10 {
-						lines = fmt.Sprintf("%s ... (%d more)", strings.Join(errsteps[:10], ", "), len(errsteps[10:]))
-					} else {
-						lines = strings.Join(errsteps, ", ")
-					}
-
-					tw.Append([]string{
-						f,
-						fmt.Sprint(err.Code),
-						err.Description,
-						fmt.Sprint(num),
-						lines,
-						strings.Join(sstrings, "\n"),
-					})
-				}
-			}
+			errsteps := errLineSteps(verrs)
 
-			if nerrs > 0 {
-				hasErrors = true
-				log.Warn("* Field-level issues were found.")
-				tw.Render()
-			} else if len(lerrs) == 0 {
-				log.Info("* Everything looks good!")
+			if len(errsteps) > 10 {
+				lines = fmt.Sprintf("%s ... (%d more)", strings.Join(errsteps[:10], ", "), len(errsteps[10:]))
+			} else {
+				lines = strings.Join(errsteps, ", ")
 			}
 
+			tw.Append([]string{
+				fmt.Sprint(err.Code),
+				err.Description,
+				fmt.Sprint(len(verrs)),
+				lines,
+				example,
+			})
 		}
 
-		if hasErrors {
-			os.Exit(1)
-		}
-	},
-}
+		tw.Render()
+	}
 
-func init() {
+	// Field level issues.
+	tw := tablewriter.NewWriter(os.Stdout)
 
-	// Register this command under the top-level CLI command.
-	RootCmd.AddCommand(validateCmd)
+	tw.SetHeader([]string{
+		"field",
+		"code",
+		"error",
+		"occurrences",
+		"lines",
+		"samples",
+	})
 
-	// Set up the validate-command-specific flags.
-	validateCmd.Flags().String("datav", "", "Dataset version number.")
-	validateCmd.Flags().String("etl", "", "URL of the ETL code used to create the dataset.")
-	validateCmd.Flags().String("site", "", "Name of the organization or site that created the dataset.")
+	var nerrs int
 
-	// Bind viper keys to the flag values.
-	viper.BindPFlag("datav", validateCmd.Flags().Lookup("datav"))
-	viper.BindPFlag("etl", validateCmd.Flags().Lookup("etl"))
-	viper.BindPFlag("site", validateCmd.Flags().Lookup("site"))
+	// Output the error occurrence per field.
+	for _, field := range f.Header {
+		errmap := result.FieldErrors(field)
 
-}
+		if len(errmap) == 0 {
+			continue
+		}
 
-func getModel(modelName string, versionName string, service string) (*dms.Model, error) {
-	// Initialize data models client for service.
-	c, err := dms.New(service)
+		nerrs += len(errmap)
 
-	if err != nil {
-		return nil, err
-	}
+		var (
+			lines  string
+			sample []*validator.ValidationError
+		)
 
-	if err = c.Ping(); err != nil {
-		return nil, err
-	}
+		for err, verrs := range errmap {
+			num := len(verrs)
 
-	revisions, err := c.ModelRevisions(modelName)
+			if num >= sampleSize {
+				sample = make([]*validator.ValidationError, sampleSize)
 
-	if err != nil {
-		return nil, err
-	}
+				// Randomly sample.
+				for i := range sample {
+					j := rand.Intn(num)
+					sample[i] = verrs[j]
+				}
+			} else {
+				sample = verrs
+			}
 
-	var model *dms.Model
+			sstrings := make([]string, len(sample))
 
-	// Get the latest version.
-	if versionName == "" {
-		model = revisions.Latest()
-	} else {
+			for i, ve := range sample {
+				if ve.Context != nil {
+					sstrings[i] = fmt.Sprintf("line %d: `%s` %s", ve.Line, ve.Value, ve.Context)
+				} else {
+					sstrings[i] = fmt.Sprintf("line %d: `%s`", ve.Line, ve.Value)
+				}
+			}
 
-		var (
-			versions []string
-			_model   *dms.Model
-		)
+			errsteps := errLineSteps(verrs)
 
-		for _, _model = range revisions.List() {
-			if _model.Version == versionName {
-				model = _model
-				break
+			if len(errsteps) > 10 {
+				lines = fmt.Sprintf("%s ... (%d more)", strings.Join(errsteps[:10], ", "), len(errsteps[10:]))
+			} else {
+				lines = strings.Join(errsteps, ", ")
 			}
 
-			versions = append(versions, _model.Version)
-		}
-
-		if model == nil {
-			return nil, fmt.Errorf("Invalid version for '%s'. Choose from: %s\n", modelName, strings.Join(versions, ", "))
+			tw.Append([]string{
+				field,
+				fmt.Sprint(err.Code),
+				err.Description,
+				fmt.Sprint(num),
+				lines,
+				strings.Join(sstrings, "\n"),
+			})
 		}
 	}
 
-	log.Infof("Validating against model '%s/%s'", model.Name, model.Version)
-
-	return model, nil
+	if nerrs > 0 {
+		log.Warn("* Field-level issues were found.")
+		tw.Render()
+	} else if len(lerrs) == 0 && f.Err == nil {
+		log.Info("* Everything looks good!")
+	}
 }
 
 // Returns a slice of line ranges that errors have occurred on.
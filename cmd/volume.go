@@ -0,0 +1,422 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+// manifestExt is appended to the path of a package to name the manifest of
+// its volumes.
+const manifestExt = ".manifest"
+
+// firstVolumeExt is the extension of the first volume of a package.
+const firstVolumeExt = ".001"
+
+// volumeManifest describes a package split into volumes. Volume names are
+// relative to the directory of the manifest.
+type volumeManifest struct {
+	Package           string          `json:"package"`
+	Format            string          `json:"format"`
+	Size              int64           `json:"size"`
+	VolumeSize        int64           `json:"volume-size"`
+	ChecksumAlgorithm string          `json:"checksum-algorithm"`
+	Volumes           []*volumeRecord `json:"volumes"`
+}
+
+// volumeRecord describes a single volume of a package.
+type volumeRecord struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// volumePath returns the path of the nth volume, counting from 1, of a package.
+func volumePath(packagePath string, n int) string {
+	return fmt.Sprintf("%s.%03d", packagePath, n)
+}
+
+// manifestPath returns the path of the manifest of a package's volumes.
+func manifestPath(packagePath string) string {
+	return packagePath + manifestExt
+}
+
+var sizeRegexp = regexp.MustCompile(`^(\d+)\s*([kmgt]?)i?b?$`)
+
+// sizeShifts maps size suffixes to powers of 2.
+var sizeShifts = map[string]uint{
+	"":  0,
+	"k": 10,
+	"m": 20,
+	"g": 30,
+	"t": 40,
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, each
+// a multiple of 1024 of the previous one.
+func parseSize(s string) (int64, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	shift := sizeShifts[m[2]]
+
+	if n <= 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	return n << shift, nil
+}
+
+// isVolumePath reports whether a path names the manifest or first volume of a
+// package split into volumes.
+func isVolumePath(p string) bool {
+	return strings.HasSuffix(p, manifestExt) || strings.HasSuffix(p, firstVolumeExt)
+}
+
+// volumeManifestPath returns the manifest path for a path naming the manifest
+// or first volume of a package.
+func volumeManifestPath(p string) string {
+	if strings.HasSuffix(p, firstVolumeExt) {
+		return manifestPath(strings.TrimSuffix(p, firstVolumeExt))
+	}
+
+	return p
+}
+
+// volumeWriter splits everything written to it into checksummed volumes of a
+// package. Closing it writes the manifest.
+type volumeWriter struct {
+	packagePath string
+	manifest    *volumeManifest
+
+	f       *os.File
+	h       hash.Hash
+	written int64
+}
+
+// newVolumeWriter returns a volumeWriter for volumes of the given size of a
+// package in the given format.
+func newVolumeWriter(packagePath string, format string, size int64) *volumeWriter {
+	return &volumeWriter{
+		packagePath: packagePath,
+		manifest: &volumeManifest{
+			Package:           filepath.Base(packagePath),
+			Format:            format,
+			VolumeSize:        size,
+			ChecksumAlgorithm: dataset.DefaultChecksumAlgorithm,
+		},
+	}
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	var total int
+
+	for len(p) > 0 {
+		if w.f == nil {
+			if err := w.openVolume(); err != nil {
+				return total, err
+			}
+		}
+
+		chunk := p
+		if left := w.manifest.VolumeSize - w.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+
+		n, err := w.f.Write(chunk)
+		w.h.Write(chunk[:n])
+		w.written += int64(n)
+		total += n
+
+		if err != nil {
+			return total, err
+		}
+
+		if w.written == w.manifest.VolumeSize {
+			if err = w.closeVolume(); err != nil {
+				return total, err
+			}
+		}
+
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// openVolume creates the next volume.
+func (w *volumeWriter) openVolume() error {
+	f, err := os.Create(volumePath(w.packagePath, len(w.manifest.Volumes)+1))
+	if err != nil {
+		return err
+	}
+
+	if w.h, err = dataset.NewChecksumHash(w.manifest.ChecksumAlgorithm); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.written = 0
+
+	return nil
+}
+
+// closeVolume closes the current volume and records it in the manifest.
+func (w *volumeWriter) closeVolume() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	w.manifest.Volumes = append(w.manifest.Volumes, &volumeRecord{
+		Name:     filepath.Base(w.f.Name()),
+		Size:     w.written,
+		Checksum: hex.EncodeToString(w.h.Sum(nil)),
+	})
+
+	w.manifest.Size += w.written
+	w.f = nil
+
+	return nil
+}
+
+// Close closes the last volume and writes the manifest.
+func (w *volumeWriter) Close() error {
+	if w.f != nil {
+		if err := w.closeVolume(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(manifestPath(w.packagePath), append(b, '\n'), 0644)
+}
+
+// splitPackage splits the package file into volumes of the given size and
+// removes it.
+func splitPackage(packagePath string, format string, size int64) (*volumeManifest, error) {
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newVolumeWriter(packagePath, format, size)
+
+	_, err = io.Copy(w, f)
+	f.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return w.manifest, os.Remove(packagePath)
+}
+
+// isVolumeName reports whether a volume name from a manifest is a plain file
+// name, which cannot refer to a file outside of the manifest's directory.
+func isVolumeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && filepath.VolumeName(name) == "" && filepath.Base(name) == name
+}
+
+// readVolumeManifest reads the manifest of a package's volumes, which must name
+// its volumes by plain file names.
+func readVolumeManifest(p string) (*volumeManifest, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest volumeManifest
+
+	if err = json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", p, err)
+	}
+
+	if len(manifest.Volumes) == 0 {
+		return nil, fmt.Errorf("%s lists no volumes", p)
+	}
+
+	for _, v := range manifest.Volumes {
+		if !isVolumeName(v.Name) {
+			return nil, &dataset.Error{
+				Category: dataset.CategoryFormat,
+				Err:      fmt.Errorf("%s lists volume '%s', which is not a file name", p, v.Name),
+			}
+		}
+	}
+
+	return &manifest, nil
+}
+
+// volumeReader reads the volumes listed in a manifest in order, verifying the
+// size and checksum of each as its end is reached. Closing it fails unless
+// every volume has been read and verified.
+type volumeReader struct {
+	dir      string
+	manifest *volumeManifest
+
+	i    int
+	f    *os.File
+	h    hash.Hash
+	read int64
+}
+
+// openVolumes returns the manifest of the package named by the path of its
+// manifest or first volume and a reader of the reassembled package. Each
+// volume is verified as its end is read, so nothing read from the package can
+// be trusted until the reader has been read to its end and closed without an
+// error.
+func openVolumes(p string) (*volumeManifest, io.ReadCloser, error) {
+	mp := volumeManifestPath(p)
+
+	manifest, err := readVolumeManifest(mp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = dataset.NewChecksumHash(manifest.ChecksumAlgorithm); err != nil {
+		return nil, nil, err
+	}
+
+	return manifest, &volumeReader{
+		dir:      filepath.Dir(mp),
+		manifest: manifest,
+	}, nil
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if r.i == len(r.manifest.Volumes) {
+				return 0, io.EOF
+			}
+
+			f, err := os.Open(filepath.Join(r.dir, r.manifest.Volumes[r.i].Name))
+			if err != nil {
+				return 0, err
+			}
+
+			r.f = f
+			r.h, _ = dataset.NewChecksumHash(r.manifest.ChecksumAlgorithm)
+			r.read = 0
+		}
+
+		n, err := r.f.Read(p)
+		r.h.Write(p[:n])
+		r.read += int64(n)
+
+		if err == io.EOF {
+			if err = r.closeVolume(); err != nil {
+				return n, err
+			}
+
+			if n == 0 {
+				continue
+			}
+
+			return n, nil
+		}
+
+		return n, err
+	}
+}
+
+// closeVolume closes the current volume, checking it against its record.
+func (r *volumeReader) closeVolume() error {
+	v := r.manifest.Volumes[r.i]
+
+	r.f.Close()
+	r.f = nil
+	r.i++
+
+	if r.read != v.Size {
+		return &dataset.Error{
+			Category: dataset.CategoryChecksum,
+			Err:      fmt.Errorf("volume %s is %d bytes, expected %d", v.Name, r.read, v.Size),
+		}
+	}
+
+	if sum := hex.EncodeToString(r.h.Sum(nil)); sum != v.Checksum {
+		return &dataset.Error{
+			Category: dataset.CategoryChecksum,
+			Err:      fmt.Errorf("volume %s has checksum %s, expected %s", v.Name, sum, v.Checksum),
+		}
+	}
+
+	return nil
+}
+
+// Close closes the current volume, if any, and fails if a volume has not been
+// read to its end and verified.
+func (r *volumeReader) Close() error {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+
+	if r.i < len(r.manifest.Volumes) {
+		return fmt.Errorf("volume %s was not read to its end", r.manifest.Volumes[r.i].Name)
+	}
+
+	return nil
+}
+
+// joinVolumes reassembles a package from its volumes into a temporary file in
+// the directory of the manifest, verifying each volume, and returns the file's
+// path. The caller removes it.
+func joinVolumes(p string) (string, error) {
+	_, r, err := openVolumes(p)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), ".package-")
+	if err != nil {
+		r.Close()
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		size int64
+		ok   bool
+	}{
+		{"1", 1, true},
+		{"512", 512, true},
+		{"10K", 10 << 10, true},
+		{"10k", 10 << 10, true},
+		{"10KB", 10 << 10, true},
+		{"10KiB", 10 << 10, true},
+		{"50G", 50 << 30, true},
+		{" 3 m ", 3 << 20, true},
+		{"2T", 2 << 40, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"0", 0, false},
+		{"0G", 0, false},
+		{"", 0, false},
+		{"G", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"10P", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(test.in)
+
+		if test.ok && err != nil {
+			t.Errorf("parseSize(%q): unexpected error: %s", test.in, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("parseSize(%q): expected an error, got %d", test.in, size)
+		} else if size != test.size {
+			t.Errorf("parseSize(%q) = %d, expected %d", test.in, size, test.size)
+		}
+	}
+}
+
+// writeVolumes splits the data into volumes of the given size of a package in
+// dir, returning the package path and manifest.
+func writeVolumes(t *testing.T, dir string, data []byte, size int64) (string, *volumeManifest) {
+	packagePath := filepath.Join(dir, "package.tar.gz")
+
+	w := newVolumeWriter(packagePath, formatTarGz, size)
+
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return packagePath, w.manifest
+}
+
+func TestVolumeRoundTrip(t *testing.T) {
+	data := make([]byte, 10000)
+
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		size    int64
+		volumes int
+	}{
+		{100000, 1},
+		{10000, 1},
+		{4096, 3},
+		{1000, 10},
+		{999, 11},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "volume-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		packagePath, written := writeVolumes(t, dir, data, test.size)
+
+		if len(written.Volumes) != test.volumes {
+			t.Errorf("size %d: wrote %d volumes, expected %d", test.size, len(written.Volumes), test.volumes)
+		}
+
+		if written.Size != int64(len(data)) {
+			t.Errorf("size %d: manifest size %d, expected %d", test.size, written.Size, len(data))
+		}
+
+		// Read the package back from both its manifest and first volume.
+		for _, p := range []string{manifestPath(packagePath), volumePath(packagePath, 1)} {
+			manifest, r, err := openVolumes(p)
+			if err != nil {
+				t.Errorf("size %d: opening %s: %s", test.size, p, err)
+				continue
+			}
+
+			if manifest.Format != formatTarGz {
+				t.Errorf("size %d: manifest format %s, expected %s", test.size, manifest.Format, formatTarGz)
+			}
+
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("size %d: reading %s: %s", test.size, p, err)
+			}
+
+			if err = r.Close(); err != nil {
+				t.Errorf("size %d: closing %s: %s", test.size, p, err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Errorf("size %d: read %d bytes differing from the %d written", test.size, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestVolumeCorruption(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	tests := []struct {
+		name    string
+		corrupt func(packagePath string, m *volumeManifest) error
+	}{
+		{"flipped byte in first volume", func(p string, m *volumeManifest) error {
+			return flipByte(volumePath(p, 1), 10)
+		}},
+		{"flipped byte in last volume", func(p string, m *volumeManifest) error {
+			return flipByte(volumePath(p, len(m.Volumes)), 0)
+		}},
+		{"truncated last volume", func(p string, m *volumeManifest) error {
+			return os.Truncate(volumePath(p, len(m.Volumes)), m.Volumes[len(m.Volumes)-1].Size-1)
+		}},
+		{"extended last volume", func(p string, m *volumeManifest) error {
+			f, err := os.OpenFile(volumePath(p, len(m.Volumes)), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+
+			f.Write([]byte("x"))
+
+			return f.Close()
+		}},
+		{"missing last volume", func(p string, m *volumeManifest) error {
+			return os.Remove(volumePath(p, len(m.Volumes)))
+		}},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "volume-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		packagePath, manifest := writeVolumes(t, dir, data, 3000)
+
+		if err = test.corrupt(packagePath, manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		// The volumes are verified as they are read.
+		if _, r, err := openVolumes(manifestPath(packagePath)); err == nil {
+			_, err = io.Copy(ioutil.Discard, r)
+
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+
+			if err == nil {
+				t.Errorf("%s: reading the volumes succeeded", test.name)
+			}
+		}
+
+		if p, err := joinVolumes(manifestPath(packagePath)); err == nil {
+			t.Errorf("%s: joinVolumes succeeded", test.name)
+			os.Remove(p)
+		}
+	}
+}
+
+func TestVolumeReaderCloseUnread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagePath, _ := writeVolumes(t, dir, bytes.Repeat([]byte("x"), 5000), 2000)
+
+	_, r, err := openVolumes(manifestPath(packagePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop short of the last volume, as a tar reader stops at the end of
+	// the archive.
+	if _, err = io.CopyN(ioutil.Discard, r, 4500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Close(); err == nil {
+		t.Error("closing a partly read package succeeded")
+	}
+}
+
+func TestVolumeManifestNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagePath, manifest := writeVolumes(t, dir, bytes.Repeat([]byte("x"), 5000), 2000)
+
+	for _, name := range []string{"../package.tar.gz.001", "sub/package.tar.gz.001", `..\package.tar.gz.001`, "/etc/passwd", "..", ".", ""} {
+		manifest.Volumes[0].Name = name
+
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(manifestPath(packagePath), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = readVolumeManifest(manifestPath(packagePath)); dataset.CategoryOf(err) != dataset.CategoryFormat {
+			t.Errorf("%q: error %v reading the manifest, expected a %s error", name, err, dataset.CategoryFormat)
+		}
+	}
+}
+
+func TestUnpackStagedVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestDir(t, dir, testDataset)
+
+	var pkg bytes.Buffer
+
+	if err = writeTar(&pkg, src, formatTarGz, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	packagePath, manifest := writeVolumes(t, dir, pkg.Bytes(), 100)
+
+	unpack := func(output string) error {
+		_, r, err := openVolumes(manifestPath(packagePath))
+		if err != nil {
+			return err
+		}
+
+		return unpackStaged(output, func(staging string) error {
+			err := unpackTar(context.Background(), r, formatTarGz, staging, &keySource{})
+
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+
+			return err
+		})
+	}
+
+	// Existing files in the output directory are kept.
+	output := filepath.Join(dir, "output")
+
+	if err = os.MkdirAll(filepath.Join(output, "extra"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(output, "extra", "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = unpack(output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"extra/notes.txt": "notes"}
+	for name, data := range testDataset {
+		expected[name] = data
+	}
+
+	checkTestDir(t, output, expected)
+
+	// Nothing is extracted from a package whose last volume is corrupted,
+	// which is only found once the archive has been read.
+	if err = flipByte(volumePath(packagePath, len(manifest.Volumes)), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := filepath.Join(dir, "corrupted")
+
+	if err = unpack(corrupted); err == nil {
+		t.Error("no error extracting a corrupted package")
+	}
+
+	checkTestDir(t, corrupted, nil)
+}
+
+// flipByte inverts the bits of the byte at the offset in the file.
+func flipByte(path string, offset int64) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	b[offset] ^= 0xff
+
+	return ioutil.WriteFile(path, b, 0644)
+}
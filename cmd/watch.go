@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/infomodels/infomodels/pkg/dataset"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [flags] DIR",
+	Short: "process packages dropped into a directory",
+	Long: `Watch DIR for site packages and expand, validate and load them
+
+DIR, such as an SFTP landing directory, is scanned every interval for packages.
+A package is processed once it and the files that come with it (its detached
+signature DATAPACKAGE.sig and, for a package split into volumes, its volumes)
+have not changed for the settle duration, so that uploads in progress are left
+alone. Only files with a package extension (.tar.gz, .tgz, .tar.zst, .tzst or
+.zip, optionally followed by .gpg, .pgp or .age) and the manifests of such
+packages are taken for packages; other files, such as the sites file or a
+README, are left alone. Hidden files and files ending in .part, .filepart,
+.partial, .tmp or .uploading are never taken for packages.
+
+The sites file (sites) holds the settings of each site:
+
+  options:                      # flags given to the steps of every site
+    dburi: postgres://etl@db/pedsnet
+  sites:
+    seattle:
+      pattern: "seattle_*"      # packages in DIR itself with matching names
+      load: true                # load after validating, off by default
+      keep-data: true           # keep the expanded data, off by default
+      options: {searchPath: site_seattle}
+      expand-options: {keypath: /keys/etl.asc, verify-key: /keys/seattle.asc}
+      validate-options: {site: seattle}
+      load-options: {skip-constraints: true}
+
+The options of all sites and of a site are only given to the steps whose
+commands accept them.
+
+The packages of a site are those in the subdirectory of DIR named after it and
+those in DIR whose names match its pattern. If a site's expand step verifies
+signatures, its packages wait for their signatures.
+
+Each package is expanded into a folder of its own in the work folder (work, by
+default DIR/work), then validated and, if the site loads its packages, loaded,
+running the steps as the run command does. Once a package succeeds, its
+expanded data is removed from the work folder, leaving the pipeline log, unless
+the site sets keep-data; that of a failed package is kept to look into. The package and its files are then
+moved to a folder of their own in the done folder (done, by default DIR/done)
+or, if a step failed or the package matches no site, in the failed folder
+(failed, by default DIR/failed). These folders must be on the same file system
+as DIR.
+
+A JSON status file per submission, recording its site, files, status, steps,
+log and where its files were moved, is written to the status folder (status,
+by default DIR/status) when processing starts and when it ends.
+
+With the once flag, the packages in DIR are processed, waiting for those still
+being uploaded, and the command exits instead of watching.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Enforce single directory argument.
+		if len(args) != 1 {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"args": args,
+			}, "watch requires 1 argument")
+		}
+
+		dir := args[0]
+
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			fatal(dataset.CategoryUsage, log.Fields{
+				"dir": dir,
+			}, "watch requires an existing directory")
+		}
+
+		// Enforce required sites file.
+		if viper.GetString("sites") == "" {
+			fatal(dataset.CategoryUsage, nil, "watch requires a sites file")
+		}
+
+		config, err := readWatchConfig(viper.GetString("sites"))
+		if err != nil {
+			fatal(dataset.CategoryConfiguration, log.Fields{
+				"sites": viper.GetString("sites"),
+				"error": err,
+			}, "error reading sites file")
+		}
+
+		dirs := &watchDirs{
+			Done:   viper.GetString("done"),
+			Failed: viper.GetString("failed"),
+			Status: viper.GetString("status"),
+			Work:   viper.GetString("work"),
+		}
+
+		for name, d := range map[string]*string{
+			"done":   &dirs.Done,
+			"failed": &dirs.Failed,
+			"status": &dirs.Status,
+			"work":   &dirs.Work,
+		} {
+			if *d == "" {
+				*d = filepath.Join(dir, name)
+			}
+		}
+
+		interval := viper.GetDuration("interval")
+		once := viper.GetBool("once")
+
+		tracker := newSettleTracker(viper.GetDuration("settle"))
+
+		log.WithFields(log.Fields{
+			"dir":      dir,
+			"sites":    config.siteNames(),
+			"interval": interval.String(),
+			"settle":   tracker.settle.String(),
+		}).Info("watching for packages")
+
+		for {
+			pending, err := watchScan(dir, config, dirs, tracker)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"dir":   dir,
+					"error": err,
+				}).Error("error scanning for packages")
+			}
+
+			if once && pending == 0 {
+				return
+			}
+
+			time.Sleep(interval)
+		}
+	},
+}
+
+func init() {
+
+	// Register this command under the top-level CLI command.
+	RootCmd.AddCommand(watchCmd)
+
+	// Set up the watch-command-specific flags.
+	watchCmd.Flags().String("sites", "", "Path to the YAML file of site settings. Required.")
+	watchCmd.Flags().String("done", "", "Folder to move processed packages to (default DIR/done).")
+	watchCmd.Flags().String("failed", "", "Folder to move failed packages to (default DIR/failed).")
+	watchCmd.Flags().String("status", "", "Folder to write submission status files to (default DIR/status).")
+	watchCmd.Flags().String("work", "", "Folder to expand packages in (default DIR/work).")
+	watchCmd.Flags().Duration("interval", 30*time.Second, "Time between scans of DIR.")
+	watchCmd.Flags().Duration("settle", time.Minute, "Time a package must be unchanged before it is processed.")
+	watchCmd.Flags().Bool("once", false, "Process the packages in DIR and exit.")
+}
+
+// watchScan processes the submissions in the directory whose files have
+// settled, returning the number of complete submissions still settling.
+// Submissions missing files are waited for without counting as pending.
+func watchScan(dir string, c *watchConfig, dirs *watchDirs, tracker *settleTracker) (int, error) {
+	subs, err := findSubmissions(dir, c)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		pending int
+		seen    = make(map[string]bool)
+		now     = time.Now()
+	)
+
+	for _, s := range subs {
+		for _, f := range s.Files {
+			seen[f] = true
+		}
+
+		if tracker.stuck[s.Path] {
+			continue
+		}
+
+		if len(s.Missing) > 0 {
+			log.WithFields(log.Fields{
+				"package": s.Path,
+				"missing": s.Missing,
+			}).Debug("waiting for package files")
+
+			continue
+		}
+
+		if !tracker.settled(s.Files, now) {
+			pending++
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"package": s.Path,
+			"site":    s.Site,
+		}).Info("processing package")
+
+		status := processSubmission(s, c, dirs, os.Stderr)
+
+		if status.Moved == "" {
+			tracker.stuck[s.Path] = true
+		}
+
+		fields := log.Fields{
+			"package": s.Path,
+			"site":    s.Site,
+			"status":  status.Status,
+			"moved":   status.Moved,
+		}
+
+		if status.Status == submissionFailed {
+			fields["error"] = status.Error
+			log.WithFields(fields).Error("package failed")
+		} else {
+			log.WithFields(fields).Info("package processed")
+		}
+	}
+
+	tracker.forget(seen)
+
+	return pending, nil
+}
@@ -0,0 +1,139 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/database"
+)
+
+// abortedOperation is the version_history operation recorded when a load or
+// the adding of constraints is interrupted.
+const abortedOperation = "aborted"
+
+// ContextReader returns a reader that fails with the context's error once the
+// context is done, so that long copies from r stop when they are cancelled.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// sessions numbers the database sessions tagged by taggedURI in this process.
+var sessions int64
+
+// taggedURI returns the database URI with a unique application_name, which
+// tags the connections made with it so that their queries can be cancelled by
+// cancelTagged. The database library gives no other way of cancelling them.
+func taggedURI(dburi string) (string, string) {
+	name := fmt.Sprintf("infomodels-%d-%d", os.Getpid(), atomic.AddInt64(&sessions, 1))
+
+	if u, err := url.Parse(dburi); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("application_name", name)
+		u.RawQuery = q.Encode()
+
+		return u.String(), name
+	}
+
+	// Otherwise it is a connection string of key=value settings.
+	return strings.TrimSpace(dburi) + " application_name=" + name, name
+}
+
+// cancelInterval is how often the queries of an interrupted session are
+// cancelled, in case one starts after the previous cancellation.
+const cancelInterval = time.Second
+
+// cancelTagged cancels the queries running on the connections tagged with the
+// application name once the context is done, until the returned function is
+// called. Cancelling a query rolls back its transaction, such as the COPY of
+// the table being loaded.
+func cancelTagged(ctx context.Context, dburi string, searchPath string, name string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+		}
+
+		db, err := database.OpenDatabase(dburi, searchPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Warn("cannot connect to cancel database queries")
+			return
+		}
+		defer db.Close()
+
+		ticker := time.NewTicker(cancelInterval)
+		defer ticker.Stop()
+
+		for {
+			var cancelled int
+
+			err = db.QueryRow(`select count(pg_cancel_backend(pid)) from pg_stat_activity
+where application_name = $1 and state = 'active' and pid <> pg_backend_pid()`, name).Scan(&cancelled)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err.Error(),
+				}).Warn("error cancelling database queries")
+				return
+			}
+
+			if cancelled > 0 {
+				log.WithFields(log.Fields{
+					"queries": cancelled,
+				}).Warn("cancelled database queries")
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// recordAborted adds an aborted entry for the model to the version_history
+// table, so that the interruption shows in the history of the schema.
+func recordAborted(dburi string, searchPath string, model string, modelVersion string) error {
+	db, err := database.OpenDatabase(dburi, searchPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`insert into version_history (operation, model, model_version, datetime) values ($1, $2, $3, now())`,
+		abortedOperation, model, modelVersion)
+
+	return err
+}
@@ -0,0 +1,51 @@
+package dataset
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTaggedURI(t *testing.T) {
+	uri, name := taggedURI("postgres://etl@localhost/pedsnet?sslmode=disable")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Query().Get("application_name"); got != name {
+		t.Errorf("application_name is %q, expected %q", got, name)
+	}
+
+	if got := u.Query().Get("sslmode"); got != "disable" {
+		t.Errorf("sslmode is %q, expected it to be kept", got)
+	}
+
+	uri, other := taggedURI("host=localhost dbname=pedsnet ")
+
+	if other == name {
+		t.Errorf("sessions share the application name %q", name)
+	}
+
+	if expected := "host=localhost dbname=pedsnet application_name=" + other; uri != expected {
+		t.Errorf("tagged URI is %q, expected %q", uri, expected)
+	}
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	data, err := ioutil.ReadAll(ContextReader(ctx, strings.NewReader("person_id\n1\n")))
+	if err != nil || string(data) != "person_id\n1\n" {
+		t.Errorf("read %q, %v before cancelling", data, err)
+	}
+
+	cancel()
+
+	if _, err = ioutil.ReadAll(ContextReader(ctx, strings.NewReader("person_id\n1\n"))); err != context.Canceled {
+		t.Errorf("error %v reading after cancelling, expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,203 @@
+package dataset
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"lukechampine.com/blake3"
+)
+
+// DefaultChecksumAlgorithm is used for new checksums and assumed for metadata
+// records that do not name their algorithm.
+const DefaultChecksumAlgorithm = "sha256"
+
+// checksumAlgorithms maps the algorithm names recorded in the metadata file's
+// checksum-algorithm column to hash constructors. MD5 is only supported for
+// verifying Frictionless Data Package hashes, where it is the default.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// writeChecksumAlgorithms are the algorithms annotate can write checksums
+// with. MD5 is left out as it is only read.
+var writeChecksumAlgorithms = []string{"sha256", "sha512", "blake3"}
+
+// CheckWriteChecksumAlgorithm returns an error unless annotate can write
+// checksums with the named algorithm.
+func CheckWriteChecksumAlgorithm(algorithm string) error {
+	for _, name := range writeChecksumAlgorithms {
+		if strings.ToLower(algorithm) == name {
+			return nil
+		}
+	}
+
+	return newError(CategoryUsage, "unsupported checksum algorithm '%s', choose from: %s", algorithm, strings.Join(writeChecksumAlgorithms, ", "))
+}
+
+// checksumAlgorithmNames returns the sorted names of the supported algorithms.
+func checksumAlgorithmNames() []string {
+	var names []string
+
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// recordChecksumAlgorithm returns the checksum algorithm of a metadata record.
+func recordChecksumAlgorithm(record map[string]string) string {
+	if alg := record["checksum-algorithm"]; alg != "" {
+		return alg
+	}
+
+	return DefaultChecksumAlgorithm
+}
+
+// NewChecksumHash returns a new hash for the named algorithm.
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	newHash, ok := checksumAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s', choose from: %s", algorithm, strings.Join(checksumAlgorithmNames(), ", "))
+	}
+
+	return newHash(), nil
+}
+
+// checksumJob is a single file to be hashed by checksumFiles.
+type checksumJob struct {
+	Path      string
+	Algorithm string
+
+	// CollectStats requests the row count, header and encoding of the file
+	// be collected while it is read.
+	CollectStats bool
+
+	Checksum string
+	Size     int64
+	Stats    *fileStats
+	Err      error
+}
+
+// run reads the job's file once, hashing it and collecting its statistics if
+// requested, until the context is cancelled. The statistics of gzip compressed
+// files are collected from the decompressed data.
+func (job *checksumJob) run(ctx context.Context) error {
+	h, err := NewChecksumHash(job.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(job.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	job.Size = info.Size()
+
+	f := ContextReader(ctx, file)
+
+	switch {
+	case !job.CollectStats:
+		_, err = io.Copy(h, f)
+
+	case strings.HasSuffix(job.Path, ".gz"):
+		var gz *gzip.Reader
+
+		job.Stats = newFileStats()
+
+		if gz, err = gzip.NewReader(io.TeeReader(f, h)); err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(job.Stats, gz); err != nil {
+			return err
+		}
+
+		// Hash anything following the compressed stream.
+		_, err = io.Copy(h, f)
+
+	default:
+		job.Stats = newFileStats()
+		_, err = io.Copy(io.MultiWriter(h, job.Stats), f)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	job.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	return nil
+}
+
+// checksumFiles hashes the files of the jobs using the given number of
+// concurrent workers, filling in each job's checksum or error. The first error
+// encountered, or the context's error if it is cancelled, is also returned.
+func checksumFiles(ctx context.Context, jobs []*checksumJob, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		queue = make(chan *checksumJob)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				job.Err = job.run(ctx)
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		queue <- job
+	}
+
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.Err != nil {
+			return job.Err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package dataset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewChecksumHash(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		sum       string
+	}{
+		{"md5", "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"SHA256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{"blake3", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+	}
+
+	for _, test := range tests {
+		h, err := NewChecksumHash(test.algorithm)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.algorithm, err)
+			continue
+		}
+
+		h.Write([]byte("abc"))
+
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != test.sum {
+			t.Errorf("%s of 'abc' is %s, expected %s", test.algorithm, sum, test.sum)
+		}
+	}
+
+	if _, err := NewChecksumHash("crc32"); err == nil {
+		t.Error("no error for an unsupported algorithm")
+	}
+}
+
+func TestCheckWriteChecksumAlgorithm(t *testing.T) {
+	for _, algorithm := range []string{"sha256", "SHA512", "blake3"} {
+		if err := CheckWriteChecksumAlgorithm(algorithm); err != nil {
+			t.Errorf("%s: unexpected error: %s", algorithm, err)
+		}
+	}
+
+	for _, algorithm := range []string{"md5", "crc32", ""} {
+		err := CheckWriteChecksumAlgorithm(algorithm)
+		if err == nil {
+			t.Errorf("%q: no error for an algorithm that cannot be written", algorithm)
+		} else if CategoryOf(err) != CategoryUsage {
+			t.Errorf("%q: error has category %s, expected %s", algorithm, CategoryOf(err), CategoryUsage)
+		}
+	}
+}
+
+func TestChecksumFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("person_id,year_of_birth\n1,2001\n2,2003\n")
+
+	var gz bytes.Buffer
+
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+
+	files := map[string][]byte{
+		"person.csv":    data,
+		"person.csv.gz": gz.Bytes(),
+	}
+
+	var jobs []*checksumJob
+
+	for name, b := range files {
+		path := filepath.Join(dir, name)
+
+		if err = ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, algorithm := range writeChecksumAlgorithms {
+			jobs = append(jobs, &checksumJob{Path: path, Algorithm: algorithm, CollectStats: true})
+		}
+	}
+
+	if err = checksumFiles(context.Background(), jobs, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		h, _ := NewChecksumHash(job.Algorithm)
+		h.Write(files[filepath.Base(job.Path)])
+
+		if sum := hex.EncodeToString(h.Sum(nil)); job.Checksum != sum {
+			t.Errorf("%s: %s checksum is %s, expected %s", job.Path, job.Algorithm, job.Checksum, sum)
+		}
+
+		if job.Size != int64(len(files[filepath.Base(job.Path)])) {
+			t.Errorf("%s: size is %d", job.Path, job.Size)
+		}
+
+		// The statistics of compressed files are those of the data.
+		if job.Stats == nil || job.Stats.Rows() != 2 {
+			t.Errorf("%s: statistics are %+v, expected 2 rows", job.Path, job.Stats)
+		}
+	}
+
+	missing := &checksumJob{Path: filepath.Join(dir, "missing.csv"), Algorithm: "sha256"}
+
+	if err = checksumFiles(context.Background(), []*checksumJob{jobs[0], missing}, 2); err == nil || missing.Err == nil {
+		t.Error("no error hashing a missing file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err = checksumFiles(ctx, jobs, 2); err != context.Canceled {
+		t.Errorf("error %v hashing with a cancelled context, expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,348 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/database"
+)
+
+// ConstrainOptions locates a loaded dataset whose foreign key constraints are
+// added, checked or dropped.
+type ConstrainOptions struct {
+	// DBURI is the database URI and SearchPath a PostgreSQL search_path
+	// value. The first schema of the search path is the one the constraints
+	// are added in; others may be needed if the tables have foreign keys into
+	// tables in other schemas.
+	DBURI      string
+	SearchPath string
+
+	// Model and ModelVersion, if given, override those recorded for the
+	// tables in the version_history table.
+	Model        string
+	ModelVersion string
+
+	// Service and DMSAService are the URLs of the data models service and
+	// its SQLAlchemy service.
+	Service     string
+	DMSAService string
+
+	// NotValid creates the constraints as NOT VALID, which only applies them
+	// to new rows, to be validated afterwards with ValidateConstraints.
+	NotValid bool
+
+	// Samples is the number of orphaned keys collected per foreign key by
+	// CheckOrphans and QuarantineOrphans.
+	Samples int
+}
+
+// ConstrainResult describes the constraints added by Constrain.
+type ConstrainResult struct {
+	Model        string
+	ModelVersion string
+
+	// Added is the number of NOT VALID constraints added, which does not
+	// count those that already existed.
+	Added int
+
+	Duration time.Duration
+}
+
+// resolveModel fills in the model and model version that are not given from
+// the version_history table.
+func (opts *ConstrainOptions) resolveModel() error {
+	if opts.DBURI == "" {
+		return newError(CategoryUsage, "a dburi is required")
+	}
+
+	if opts.SearchPath == "" {
+		return newError(CategoryUsage, "a searchPath is required")
+	}
+
+	if opts.Model != "" && opts.ModelVersion != "" {
+		return nil
+	}
+
+	model, modelVersion, err := ModelAndVersion(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return wrap(CategoryDatabase, err, "getting model and version")
+	}
+
+	if opts.Model == "" {
+		opts.Model = model
+	}
+
+	if opts.ModelVersion == "" {
+		opts.ModelVersion = modelVersion
+	}
+
+	return nil
+}
+
+// Constrain adds the model's foreign key constraints to the loaded tables, as
+// NOT VALID constraints if requested. If the context is cancelled, the
+// constraint being added is rolled back, an aborted entry is recorded in the
+// version_history table and the context's error is returned. The constraints
+// already added are kept; they can be dropped with DropConstraints.
+func Constrain(ctx context.Context, opts ConstrainOptions) (*ConstrainResult, error) {
+	if err := opts.resolveModel(); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &ConstrainResult{
+		Model:        opts.Model,
+		ModelVersion: opts.ModelVersion,
+	}
+
+	start := time.Now()
+
+	var err error
+
+	if opts.NotValid {
+		result.Added, err = addNotValidConstraints(ctx, opts.DBURI, opts.SearchPath, opts.Model, opts.ModelVersion, opts.Service)
+		if err != nil && ctx.Err() == nil {
+			return nil, wrap(CategoryDatabase, err, "adding NOT VALID constraints")
+		}
+	} else {
+		dburi, session := taggedURI(opts.DBURI)
+
+		db, err := database.Open(opts.Model, opts.ModelVersion, dburi, opts.SearchPath, opts.DMSAService, "", "")
+		if err != nil {
+			return nil, wrap(CategoryDatabase, err, "opening database")
+		}
+
+		stopCancel := cancelTagged(ctx, opts.DBURI, opts.SearchPath, session)
+
+		// TODO: add options for database error sensitivities (normal/strict/force)
+		err = db.CreateConstraints("normal")
+		stopCancel()
+
+		if err != nil && ctx.Err() == nil {
+			return nil, wrap(CategoryDatabase, err, "adding constraints")
+		}
+	}
+
+	if ctx.Err() != nil {
+		log.WithFields(log.Fields{
+			"dataModel":    opts.Model,
+			"modelVersion": opts.ModelVersion,
+			"searchPath":   opts.SearchPath,
+		}).Warn("adding constraints interrupted")
+
+		if err = recordAborted(opts.DBURI, opts.SearchPath, opts.Model, opts.ModelVersion); err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Warn("error recording aborted constraints in version_history")
+		}
+
+		return nil, ctx.Err()
+	}
+
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// DropConstraints drops the model's foreign key constraints from the loaded
+// tables.
+func DropConstraints(ctx context.Context, opts ConstrainOptions) error {
+	if err := opts.resolveModel(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db, err := database.Open(opts.Model, opts.ModelVersion, opts.DBURI, opts.SearchPath, opts.DMSAService, "", "")
+	if err != nil {
+		return wrap(CategoryDatabase, err, "opening database")
+	}
+
+	if err = db.DropConstraints("normal"); err != nil {
+		return wrap(CategoryDatabase, err, "dropping constraints")
+	}
+
+	return nil
+}
+
+// CheckOrphans reports, for each foreign key in the model that is not yet
+// enforced on the existing rows of the primary schema, because its constraint
+// does not exist or is NOT VALID, the rows that would violate it. Only the
+// foreign keys with orphaned rows are reported.
+func CheckOrphans(ctx context.Context, opts ConstrainOptions) ([]*OrphanReport, error) {
+	return orphans(ctx, opts, false)
+}
+
+// QuarantineOrphans reports the orphaned rows like CheckOrphans and then moves
+// them out of each table into a side table named <table>_orphans, repeating
+// until no orphans remain, since moving rows out of one table can orphan rows
+// in the tables that reference it.
+func QuarantineOrphans(ctx context.Context, opts ConstrainOptions) ([]*OrphanReport, error) {
+	return orphans(ctx, opts, true)
+}
+
+// orphans finds, and if quarantine is true moves, the orphaned rows of each
+// foreign key in the model.
+func orphans(ctx context.Context, opts ConstrainOptions, quarantine bool) ([]*OrphanReport, error) {
+	if err := opts.resolveModel(); err != nil {
+		return nil, err
+	}
+
+	// The foreign keys to check come from the model definition, since the
+	// constraints do not exist in the database yet.
+	m, err := FetchModel(opts.Model, opts.ModelVersion, opts.Service)
+	if err != nil {
+		return nil, wrap(CategoryService, err, "retrieving data model definition")
+	}
+
+	if len(foreignKeys(m)) == 0 {
+		log.WithFields(log.Fields{
+			"dataModel":    opts.Model,
+			"modelVersion": opts.ModelVersion,
+		}).Warn("model defines no foreign keys")
+		return nil, nil
+	}
+
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	// Validated constraints already guarantee there are no orphans.
+	var fks []*dms.ForeignKey
+
+	for _, fk := range foreignKeys(m) {
+		_, validated, err := constraintState(ctx, db, primarySchema(opts.SearchPath), fk.Name)
+		if err != nil {
+			return nil, wrap(CategoryDatabase, err, fmt.Sprintf("checking constraint %s", fk.Name))
+		}
+
+		if !validated {
+			fks = append(fks, fk)
+		}
+	}
+
+	var reports []*OrphanReport
+
+	for _, fk := range fks {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		report, err := findOrphans(ctx, db, fk, opts.Samples)
+		if err != nil {
+			return nil, wrap(CategoryDatabase, err, fmt.Sprintf("checking %s for orphaned rows", fk.Name))
+		}
+
+		if report.Count > 0 {
+			reports = append(reports, report)
+		}
+	}
+
+	if !quarantine || len(reports) == 0 {
+		return reports, nil
+	}
+
+	for pass := 1; ; pass++ {
+		var moved int64
+
+		for _, fk := range fks {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			n, err := quarantineOrphans(ctx, db, fk)
+			if err != nil {
+				return nil, wrap(CategoryDatabase, err, fmt.Sprintf("quarantining orphaned rows of %s", fk.Name))
+			}
+
+			if n > 0 {
+				log.WithFields(log.Fields{
+					"constraint": fk.Name,
+					"table":      fk.SourceTable,
+					"quarantine": quarantineTable(fk.SourceTable),
+					"rows":       n,
+					"pass":       pass,
+				}).Info("quarantined orphaned rows")
+			}
+
+			moved += n
+		}
+
+		if moved == 0 {
+			break
+		}
+	}
+
+	return reports, nil
+}
+
+// PendingConstraints lists the NOT VALID foreign key constraints in the
+// primary schema that are not validated yet.
+func PendingConstraints(ctx context.Context, opts ConstrainOptions) ([]PendingConstraint, error) {
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	pending, err := listPending(ctx, db, primarySchema(opts.SearchPath))
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "listing constraints to validate")
+	}
+
+	return pending, nil
+}
+
+// ValidateConstraints validates the pending constraints using the given
+// number of concurrent workers, while the tables remain queryable. The done
+// callback, if set, is called as each constraint finishes. Validation can be
+// interrupted by cancelling the context and repeated; validated constraints
+// are no longer pending.
+func ValidateConstraints(ctx context.Context, opts ConstrainOptions, pending []PendingConstraint, workers int, done func(p PendingConstraint, err error)) error {
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	// Allow a connection per worker plus one spare.
+	db.SetMaxOpenConns(workers + 1)
+
+	if done == nil {
+		done = func(PendingConstraint, error) {}
+	}
+
+	if err = validatePending(ctx, db, pending, workers, done); err != nil && ctx.Err() == nil {
+		return &Error{Category: CategoryDatabase, Err: err}
+	}
+
+	return err
+}
+
+// addNotValidConstraints creates the model's foreign keys as NOT VALID
+// constraints in the primary schema of the search path, returning the number
+// added.
+func addNotValidConstraints(ctx context.Context, dburi string, searchPath string, dataModel string, modelVersion string, service string) (int, error) {
+	m, err := FetchModel(dataModel, modelVersion, service)
+	if err != nil {
+		return 0, wrap(CategoryService, err, "retrieving data model definition")
+	}
+
+	db, err := database.OpenDatabase(dburi, searchPath)
+	if err != nil {
+		return 0, wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	return createNotValidConstraints(ctx, db, primarySchema(searchPath), foreignKeys(m))
+}
@@ -0,0 +1,18 @@
+// Package dataset validates data model datasets, loads them into and
+// constrains them in PostgreSQL databases and exports them back out. It holds
+// the work behind the infomodels validate, load, constrain and export commands,
+// returning errors and structured results instead of logging and exiting, so
+// that it can be used from other Go programs:
+//
+//	report, err := dataset.Validate(ctx, "/data/seattle", dataset.ValidateOptions{
+//		Service: "https://data-models-service.research.chop.edu",
+//		Jobs:    4,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//
+//	if !report.Valid() {
+//		...
+//	}
+package dataset
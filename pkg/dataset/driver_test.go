@@ -0,0 +1,138 @@
+package dataset
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver connection that records the statements run
+// on it and answers queries with the rows returned by its query function, so
+// that the SQL logic of the package can be tested without a database.
+type fakeDB struct {
+	mu    sync.Mutex
+	execs []string
+
+	// query returns the columns and rows of a query, and exec the error of
+	// a statement, if set.
+	query func(q string, args []driver.Value) ([]string, [][]driver.Value, error)
+	exec  func(q string, args []driver.Value) error
+}
+
+var (
+	fakeDBs  = make(map[string]*fakeDB)
+	fakeMu   sync.Mutex
+	fakeOnce sync.Once
+)
+
+// openFakeDB returns a *sql.DB backed by the fake.
+func openFakeDB(t *testing.T, f *fakeDB) *sql.DB {
+	fakeOnce.Do(func() {
+		sql.Register("dataset-fake", fakeDriver{})
+	})
+
+	fakeMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[name] = f
+	fakeMu.Unlock()
+
+	db, err := sql.Open("dataset-fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// executed returns the statements run so far.
+func (f *fakeDB) executed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.execs...)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+
+	return &fakeConn{db: fakeDBs[name]}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(q string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, q: q}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db *fakeDB
+	q  string
+}
+
+func (s *fakeStmt) Close() error { return nil }
+
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	s.db.execs = append(s.db.execs, s.q)
+	s.db.mu.Unlock()
+
+	if s.db.exec != nil {
+		if err := s.db.exec(s.q, args); err != nil {
+			return nil, err
+		}
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.db.query == nil {
+		return nil, fmt.Errorf("unexpected query: %s", s.q)
+	}
+
+	cols, rows, err := s.db.query(s.q, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeRows{cols: cols, rows: rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package dataset
+
+import "fmt"
+
+// Category classifies an error by its cause, so that a problem with the data
+// can be told apart from one with the options, the services it is checked
+// against or the database it is loaded into.
+type Category string
+
+const (
+	// CategoryUsage is an invalid or missing option or argument.
+	CategoryUsage Category = "usage"
+
+	// CategoryConfiguration is a setting that does not work, such as an
+	// unreadable key or settings file, or a model or model version the data
+	// models service does not know.
+	CategoryConfiguration Category = "configuration"
+
+	// CategoryService is a data models service that cannot be reached.
+	CategoryService Category = "service"
+
+	// CategoryChecksum is a file that does not match the checksum, size,
+	// statistics or signature recorded for it.
+	CategoryChecksum Category = "checksum"
+
+	// CategoryFormat is a data or metadata file that does not match the
+	// format prescribed for it.
+	CategoryFormat Category = "format"
+
+	// CategoryDatabase is a database that cannot be reached or a statement
+	// that fails in it.
+	CategoryDatabase Category = "database"
+
+	// CategoryOther is any other error, such as a file that cannot be read.
+	CategoryOther Category = "other"
+)
+
+// Error is an error of a category. The errors returned by the package are
+// Errors, except for the context's error when it is cancelled.
+type Error struct {
+	Category Category
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// CategoryOf returns the category of the error, or CategoryOther if it has
+// none.
+func CategoryOf(err error) Category {
+	if e, ok := err.(*Error); ok {
+		return e.Category
+	}
+
+	return CategoryOther
+}
+
+// newError returns an error of the category with the formatted message.
+func newError(c Category, format string, args ...interface{}) error {
+	return &Error{Category: c, Err: fmt.Errorf(format, args...)}
+}
+
+// wrap prefixes the message of err with msg, keeping the category of err if it
+// has one and using the category c otherwise.
+func wrap(c Category, err error, msg string) error {
+	if e, ok := err.(*Error); ok {
+		c = e.Category
+	}
+
+	return &Error{Category: c, Err: fmt.Errorf("%s: %s", msg, err)}
+}
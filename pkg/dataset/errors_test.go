@@ -0,0 +1,30 @@
+package dataset
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCategoryOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		category Category
+	}{
+		{"uncategorized", errors.New("permission denied"), CategoryOther},
+		{"new", newError(CategoryUsage, "a dburi is required"), CategoryUsage},
+		{"wrapped", wrap(CategoryDatabase, errors.New("connection refused"), "opening database"), CategoryDatabase},
+		{"rewrapped", wrap(CategoryService, newError(CategoryConfiguration, "unknown model"), "retrieving data model definition"), CategoryConfiguration},
+	}
+
+	for _, test := range tests {
+		if c := CategoryOf(test.err); c != test.category {
+			t.Errorf("%s: category is %s, expected %s", test.name, c, test.category)
+		}
+	}
+
+	err := wrap(CategoryDatabase, errors.New("connection refused"), "opening database")
+	if expected := "opening database: connection refused"; err.Error() != expected {
+		t.Errorf("message is %q, expected %q", err, expected)
+	}
+}
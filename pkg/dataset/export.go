@@ -0,0 +1,288 @@
+package dataset
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/database"
+)
+
+// ExportOptions controls how a data model instance is exported from a
+// database.
+type ExportOptions struct {
+	// DBURI is the database URI and SearchPath a PostgreSQL search_path
+	// value. The tables are exported from the first schema of the search
+	// path.
+	DBURI      string
+	SearchPath string
+
+	// Model and ModelVersion, if given, override those recorded in the
+	// version_history table.
+	Model        string
+	ModelVersion string
+
+	// Service is the URL of the data models service.
+	Service string
+
+	// Tables, if given, limits the export to these tables of the model.
+	Tables []string
+}
+
+// ExportResult describes a completed export.
+type ExportResult struct {
+	Model        string
+	ModelVersion string
+
+	// Duration is the time the export took.
+	Duration time.Duration
+
+	// Files are the names of the files written for each exported table, and
+	// Rows the rows written to them.
+	Files map[string]string
+	Rows  map[string]int64
+}
+
+// Export writes the tables of the model in the primary schema of the search
+// path to CSV files in dir named after them, each with a header of the table's
+// fields in model order. Values are written as PostgreSQL renders them as
+// text, as COPY does, and NULLs as empty fields. Tables of the model that are
+// not in the schema are skipped, unless they were asked for.
+//
+// If the context is cancelled, the query in progress is cancelled, the file
+// being written is removed and the context's error is returned. Other errors
+// are of the Category of their cause.
+func Export(ctx context.Context, dir string, opts ExportOptions) (*ExportResult, error) {
+	if opts.DBURI == "" {
+		return nil, newError(CategoryUsage, "a dburi is required")
+	}
+
+	if opts.SearchPath == "" {
+		return nil, newError(CategoryUsage, "a searchPath is required")
+	}
+
+	result := &ExportResult{
+		Model:        opts.Model,
+		ModelVersion: opts.ModelVersion,
+		Files:        make(map[string]string),
+		Rows:         make(map[string]int64),
+	}
+
+	if result.Model == "" || result.ModelVersion == "" {
+		model, modelVersion, err := ModelAndVersion(opts.DBURI, opts.SearchPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Model == "" {
+			result.Model = model
+		}
+
+		if result.ModelVersion == "" {
+			result.ModelVersion = modelVersion
+		}
+	}
+
+	m, err := FetchModel(result.Model, result.ModelVersion, opts.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := exportTables(m, opts.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	schema := primarySchema(opts.SearchPath)
+
+	existing, err := schemaTables(ctx, db, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	for _, table := range tables {
+		if !existing[table.Name] {
+			if len(opts.Tables) > 0 {
+				return nil, newError(CategoryDatabase, "table %s is not in schema %s", table.Name, schema)
+			}
+
+			log.WithFields(log.Fields{
+				"table":  table.Name,
+				"schema": schema,
+			}).Debug("skipping table not in schema")
+
+			continue
+		}
+
+		name := table.Name + ".csv"
+
+		rows, err := exportTable(ctx, db, schema, table, filepath.Join(dir, name))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			return nil, wrap(CategoryDatabase, err, fmt.Sprintf("exporting table %s", table.Name))
+		}
+
+		result.Files[table.Name] = name
+		result.Rows[table.Name] = rows
+
+		log.WithFields(log.Fields{
+			"table": table.Name,
+			"rows":  rows,
+		}).Info("exported table")
+	}
+
+	if len(result.Files) == 0 {
+		return nil, newError(CategoryDatabase, "no tables of %s/%s found in schema %s", result.Model, result.ModelVersion, schema)
+	}
+
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// exportTables returns the tables of the model to export: the named ones, or
+// all of them if none are named.
+func exportTables(m *dms.Model, names []string) ([]*dms.Table, error) {
+	if len(names) == 0 {
+		return m.Tables.List(), nil
+	}
+
+	var tables []*dms.Table
+
+	for _, name := range names {
+		table := m.Tables.Get(name)
+		if table == nil {
+			return nil, newError(CategoryUsage, "%s/%s has no table %s", m.Name, m.Version, name)
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+// schemaTables returns the names of the tables in the schema.
+func schemaTables(ctx context.Context, db *sql.DB, schema string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `select table_name from information_schema.tables where table_schema = $1`, schema)
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "listing tables")
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			return nil, wrap(CategoryDatabase, err, "listing tables")
+		}
+
+		tables[name] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, wrap(CategoryDatabase, err, "listing tables")
+	}
+
+	return tables, nil
+}
+
+// exportTable writes the rows of the table in the schema to a CSV file at
+// path, returning the number of rows written. The file is removed if the
+// export fails.
+func exportTable(ctx context.Context, db *sql.DB, schema string, table *dms.Table, path string) (n int64, err error) {
+	fields := table.Fields.Names()
+
+	cols := make([]string, len(fields))
+
+	for i, field := range fields {
+		cols[i] = quoteIdent(field) + "::text"
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`select %s from %s.%s`,
+		strings.Join(cols, ", "),
+		quoteIdent(schema),
+		quoteIdent(table.Name)))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	w := csv.NewWriter(f)
+
+	if err = w.Write(fields); err != nil {
+		return 0, err
+	}
+
+	var (
+		values = make([]sql.NullString, len(fields))
+		dest   = make([]interface{}, len(fields))
+		record = make([]string, len(fields))
+	)
+
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return n, err
+		}
+
+		for i, v := range values {
+			record[i] = v.String
+		}
+
+		if err = w.Write(record); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	if err = rows.Err(); err != nil {
+		return n, err
+	}
+
+	w.Flush()
+
+	return n, w.Error()
+}
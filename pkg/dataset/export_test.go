@@ -0,0 +1,151 @@
+package dataset
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+func TestExportTables(t *testing.T) {
+	var m dms.Model
+
+	if err := json.Unmarshal([]byte(frictionlessModel), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := exportTables(&m, nil)
+	if err != nil || len(tables) != 2 {
+		t.Errorf("all tables are %v, %v", tables, err)
+	}
+
+	tables, err = exportTables(&m, []string{"visit_occurrence"})
+	if err != nil || len(tables) != 1 || tables[0].Name != "visit_occurrence" {
+		t.Errorf("named tables are %v, %v", tables, err)
+	}
+
+	if _, err = exportTables(&m, []string{"observation"}); CategoryOf(err) != CategoryUsage {
+		t.Errorf("error %v for a table not in the model, expected a %s error", err, CategoryUsage)
+	}
+}
+
+func TestSchemaTables(t *testing.T) {
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			if args[0] != "nemours_pedsnet" {
+				t.Errorf("listed the tables of schema %v", args[0])
+			}
+
+			return []string{"table_name"}, [][]driver.Value{{"person"}, {"version_history"}}, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	tables, err := schemaTables(context.Background(), db, "nemours_pedsnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tables, map[string]bool{"person": true, "version_history": true}) {
+		t.Errorf("tables are %v", tables)
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m dms.Model
+
+	if err = json.Unmarshal([]byte(frictionlessModel), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	var query string
+
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			query = q
+
+			return []string{"visit_occurrence_id", "person_id", "visit_start_date"}, [][]driver.Value{
+				{"10", "1", "2017-01-02"},
+				{"11", "2", nil},
+				{"12", "3", "a \"quoted\", value"},
+			}, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	path := filepath.Join(dir, "visit_occurrence.csv")
+
+	n, err := exportTable(context.Background(), db, "nemours_pedsnet", m.Tables.Get("visit_occurrence"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `select "visit_occurrence_id"::text, "person_id"::text, "visit_start_date"::text from "nemours_pedsnet"."visit_occurrence"`
+	if query != expected {
+		t.Errorf("query is %q, expected %q", query, expected)
+	}
+
+	if n != 3 {
+		t.Errorf("%d rows written, expected 3", n)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "visit_occurrence_id,person_id,visit_start_date\n10,1,2017-01-02\n11,2,\n12,3,\"a \"\"quoted\"\", value\"\n"
+	if string(b) != data {
+		t.Errorf("file is %q, expected %q", b, data)
+	}
+
+	// The file of a failed export is removed.
+	f.query = func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return []string{"visit_occurrence_id", "person_id"}, [][]driver.Value{{"10", "1"}}, nil
+	}
+
+	if _, err = exportTable(context.Background(), db, "nemours_pedsnet", m.Tables.Get("visit_occurrence"), path); err == nil {
+		t.Errorf("error %v exporting mismatched columns", err)
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the file of a failed export was not removed")
+	}
+
+	f.query = func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return nil, nil, errors.New("relation does not exist")
+	}
+
+	if _, err = exportTable(context.Background(), db, "nemours_pedsnet", m.Tables.Get("person"), filepath.Join(dir, "person.csv")); err == nil {
+		t.Error("no error for a failed query")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "person.csv")); !os.IsNotExist(err) {
+		t.Error("a file was written for a failed query")
+	}
+}
+
+func TestExportRequired(t *testing.T) {
+	for _, opts := range []ExportOptions{{SearchPath: "nemours_pedsnet"}, {DBURI: "postgres://db/pedsnet"}} {
+		if _, err := Export(context.Background(), "", opts); CategoryOf(err) != CategoryUsage {
+			t.Errorf("%+v: error %v, expected a %s error", opts, err, CategoryUsage)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/datadirectory"
+)
+
+// DataPackageFile is the name of the Frictionless Data Package descriptor in
+// a data directory.
+const DataPackageFile = "datapackage.json"
+
+// frictionlessPackage is a Frictionless Tabular Data Package descriptor. The
+// dataset-level metadata values are kept in custom properties named after the
+// metadata file columns.
+type frictionlessPackage struct {
+	Profile      string                  `json:"profile"`
+	Name         string                  `json:"name,omitempty"`
+	Version      string                  `json:"version,omitempty"`
+	Organization string                  `json:"organization,omitempty"`
+	Cdm          string                  `json:"cdm,omitempty"`
+	CdmVersion   string                  `json:"cdm-version,omitempty"`
+	Etl          string                  `json:"etl,omitempty"`
+	Resources    []*frictionlessResource `json:"resources"`
+}
+
+// frictionlessHashes are the hash algorithms the Data Resource specification
+// allows in a resource's hash property.
+var frictionlessHashes = map[string]bool{
+	"md5":    true,
+	"sha1":   true,
+	"sha256": true,
+	"sha512": true,
+}
+
+// frictionlessResource is a Tabular Data Resource describing one data file.
+// Checksums by algorithms the specification does not allow, such as blake3,
+// are kept in the custom checksum and checksum-algorithm properties instead of
+// hash.
+type frictionlessResource struct {
+	Profile           string              `json:"profile"`
+	Name              string              `json:"name"`
+	Path              string              `json:"path"`
+	Format            string              `json:"format,omitempty"`
+	Encoding          string              `json:"encoding,omitempty"`
+	Bytes             int64               `json:"bytes,omitempty"`
+	Hash              string              `json:"hash,omitempty"`
+	Checksum          string              `json:"checksum,omitempty"`
+	ChecksumAlgorithm string              `json:"checksum-algorithm,omitempty"`
+	Table             string              `json:"table,omitempty"`
+	Rows              int64               `json:"rows,omitempty"`
+	Modified          string              `json:"modified,omitempty"`
+	Schema            *frictionlessSchema `json:"schema,omitempty"`
+}
+
+// frictionlessSchema is a Table Schema.
+type frictionlessSchema struct {
+	Fields      []*frictionlessField      `json:"fields"`
+	ForeignKeys []*frictionlessForeignKey `json:"foreignKeys,omitempty"`
+}
+
+type frictionlessField struct {
+	Name        string                  `json:"name"`
+	Type        string                  `json:"type"`
+	Description string                  `json:"description,omitempty"`
+	Constraints *frictionlessConstraint `json:"constraints,omitempty"`
+}
+
+type frictionlessConstraint struct {
+	Required  bool `json:"required,omitempty"`
+	MaxLength int  `json:"maxLength,omitempty"`
+}
+
+type frictionlessForeignKey struct {
+	Fields    string                 `json:"fields"`
+	Reference *frictionlessReference `json:"reference"`
+}
+
+type frictionlessReference struct {
+	Resource string `json:"resource"`
+	Fields   string `json:"fields"`
+}
+
+// frictionlessTypes maps data model field types to Table Schema types. Types
+// not listed are described as strings.
+var frictionlessTypes = map[string]string{
+	"integer":  "integer",
+	"bigint":   "integer",
+	"smallint": "integer",
+	"number":   "number",
+	"decimal":  "number",
+	"numeric":  "number",
+	"float":    "number",
+	"boolean":  "boolean",
+	"date":     "date",
+	"datetime": "datetime",
+	"time":     "time",
+}
+
+var invalidResourceChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// resourceName derives a valid, lower-case resource name from a file name.
+func resourceName(filename string) string {
+	name := strings.SplitN(filename, ".", 2)[0]
+	return strings.Trim(invalidResourceChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// tableSchema describes a model table as a Table Schema. Foreign keys refer to
+// the resources holding the referenced tables and are left out if the
+// referenced table is not in the package.
+func tableSchema(m *dms.Model, table *dms.Table, resources map[string]string) *frictionlessSchema {
+	schema := &frictionlessSchema{}
+
+	for _, f := range table.Fields.List() {
+		field := &frictionlessField{
+			Name:        f.Name,
+			Type:        "string",
+			Description: f.Description,
+		}
+
+		if t, ok := frictionlessTypes[strings.ToLower(f.Type)]; ok {
+			field.Type = t
+		}
+
+		if f.Required || (field.Type == "string" && f.Length > 0) {
+			field.Constraints = &frictionlessConstraint{Required: f.Required}
+
+			if field.Type == "string" {
+				field.Constraints.MaxLength = f.Length
+			}
+		}
+
+		schema.Fields = append(schema.Fields, field)
+	}
+
+	for _, fk := range foreignKeys(m) {
+		if fk.SourceTable != table.Name {
+			continue
+		}
+
+		target, ok := resources[fk.TargetTable]
+		if !ok {
+			continue
+		}
+
+		schema.ForeignKeys = append(schema.ForeignKeys, &frictionlessForeignKey{
+			Fields: fk.SourceField,
+			Reference: &frictionlessReference{
+				Resource: target,
+				Fields:   fk.TargetField,
+			},
+		})
+	}
+
+	return schema
+}
+
+// WriteDataPackage writes a datapackage.json descriptor for the records of the
+// DataDirectory, with table schemas derived from the model.
+func WriteDataPackage(d *datadirectory.DataDirectory, m *dms.Model) error {
+	if len(d.RecordMaps) == 0 {
+		return fmt.Errorf("no metadata records to describe")
+	}
+
+	first := d.RecordMaps[0]
+
+	pkg := &frictionlessPackage{
+		Profile:      "tabular-data-package",
+		Name:         resourceName(fmt.Sprintf("%s-%s", first["organization"], first["cdm"])),
+		Version:      first["data-version"],
+		Organization: first["organization"],
+		Cdm:          first["cdm"],
+		CdmVersion:   first["cdm-version"],
+		Etl:          first["etl"],
+	}
+
+	// Name the resources, making the names unique, and remember the first
+	// resource of each table as the target of foreign key references.
+	var (
+		names     = make(map[string]bool)
+		resources = make(map[string]string)
+	)
+
+	for _, record := range d.RecordMaps {
+		name := resourceName(record["filename"])
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", resourceName(record["filename"]), i)
+		}
+
+		names[name] = true
+
+		if _, ok := resources[record["table"]]; !ok {
+			resources[record["table"]] = name
+		}
+
+		r := &frictionlessResource{
+			Profile:  "tabular-data-resource",
+			Name:     name,
+			Path:     record["filename"],
+			Format:   "csv",
+			Encoding: record["encoding"],
+			Table:    record["table"],
+			Modified: record["modified"],
+		}
+
+		if r.Encoding == "ascii" || r.Encoding == "utf-8-bom" {
+			r.Encoding = "utf-8"
+		}
+
+		if record["checksum"] != "" {
+			if alg := recordChecksumAlgorithm(record); frictionlessHashes[alg] {
+				r.Hash = fmt.Sprintf("%s:%s", alg, record["checksum"])
+			} else {
+				r.Checksum = record["checksum"]
+				r.ChecksumAlgorithm = alg
+			}
+		}
+
+		r.Bytes, _ = strconv.ParseInt(record["bytes"], 10, 64)
+		r.Rows, _ = strconv.ParseInt(record["rows"], 10, 64)
+
+		pkg.Resources = append(pkg.Resources, r)
+	}
+
+	for _, r := range pkg.Resources {
+		if table := m.Tables.Get(r.Table); table != nil {
+			r.Schema = tableSchema(m, table, resources)
+		}
+	}
+
+	b, err := json.MarshalIndent(pkg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(d.DirPath, DataPackageFile), append(b, '\n'), 0644)
+}
+
+// readDataPackage fills the records of the DataDirectory from the
+// datapackage.json descriptor in its directory. Resources without a table
+// property are assumed to hold the table named like the resource.
+func readDataPackage(d *datadirectory.DataDirectory) error {
+	b, err := ioutil.ReadFile(filepath.Join(d.DirPath, DataPackageFile))
+	if err != nil {
+		return err
+	}
+
+	var pkg frictionlessPackage
+
+	if err = json.Unmarshal(b, &pkg); err != nil {
+		return fmt.Errorf("parsing %s: %s", DataPackageFile, err)
+	}
+
+	var records []map[string]string
+
+	for _, r := range pkg.Resources {
+		if r.Path == "" {
+			return fmt.Errorf("resource '%s' has no path", r.Name)
+		}
+
+		record := map[string]string{
+			"organization": pkg.Organization,
+			"filename":     r.Path,
+			"cdm":          pkg.Cdm,
+			"cdm-version":  pkg.CdmVersion,
+			"table":        r.Table,
+			"data-version": pkg.Version,
+			"etl":          pkg.Etl,
+		}
+
+		if record["table"] == "" {
+			record["table"] = r.Name
+		}
+
+		// Hashes without an algorithm prefix are MD5 by the specification.
+		if r.Hash != "" {
+			if i := strings.Index(r.Hash, ":"); i >= 0 {
+				record["checksum-algorithm"] = strings.ToLower(r.Hash[:i])
+				record["checksum"] = r.Hash[i+1:]
+			} else {
+				record["checksum-algorithm"] = "md5"
+				record["checksum"] = r.Hash
+			}
+		} else if r.Checksum != "" {
+			record["checksum-algorithm"] = strings.ToLower(r.ChecksumAlgorithm)
+			record["checksum"] = r.Checksum
+		}
+
+		if r.Bytes > 0 {
+			record["bytes"] = strconv.FormatInt(r.Bytes, 10)
+		}
+
+		if r.Rows > 0 {
+			record["rows"] = strconv.FormatInt(r.Rows, 10)
+		}
+
+		if r.Modified != "" {
+			record["modified"] = r.Modified
+		}
+
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return fmt.Errorf("%s describes no resources", DataPackageFile)
+	}
+
+	d.RecordMaps = records
+
+	return nil
+}
+
+// MetadataPath returns the path of the file the DataDirectory's metadata is
+// read from: its metadata file or, if there is none, its datapackage.json
+// descriptor.
+func MetadataPath(d *datadirectory.DataDirectory) string {
+	if _, err := os.Stat(d.FilePath); os.IsNotExist(err) {
+		descriptor := filepath.Join(d.DirPath, DataPackageFile)
+
+		if _, err = os.Stat(descriptor); err == nil {
+			return descriptor
+		}
+	}
+
+	return d.FilePath
+}
+
+// ReadMetadata fills the records of the DataDirectory from its metadata file
+// or, if there is none, from its datapackage.json descriptor.
+func ReadMetadata(d *datadirectory.DataDirectory) error {
+	if MetadataPath(d) != d.FilePath {
+		return readDataPackage(d)
+	}
+
+	return d.ReadMetadataFromFile()
+}
@@ -0,0 +1,200 @@
+package dataset
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/datadirectory"
+)
+
+const frictionlessModel = `{
+	"name": "pedsnet",
+	"version": "2.3.0",
+	"tables": [
+		{"name": "person", "fields": [
+			{"name": "person_id", "type": "integer", "required": true},
+			{"name": "gender_source_value", "type": "string", "length": 256}
+		]},
+		{"name": "visit_occurrence", "fields": [
+			{"name": "visit_occurrence_id", "type": "integer", "required": true},
+			{"name": "person_id", "type": "integer", "required": true},
+			{"name": "visit_start_date", "type": "date"}
+		]}
+	],
+	"schema": {"constraints": {"foreignkeys": [
+		{"name": "fk_visit_person", "sourcetable": "visit_occurrence", "sourcefield": "person_id", "targettable": "person", "targetfield": "person_id"}
+	]}}
+}`
+
+func TestResourceName(t *testing.T) {
+	tests := map[string]string{
+		"person.csv":              "person",
+		"Visit_Occurrence.csv.gz": "visit_occurrence",
+		"drug exposure (1).csv":   "drug-exposure-1",
+	}
+
+	for filename, name := range tests {
+		if n := resourceName(filename); n != name {
+			t.Errorf("resourceName(%q) = %q, expected %q", filename, n, name)
+		}
+	}
+}
+
+func TestDataPackageRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m dms.Model
+
+	if err = json.Unmarshal([]byte(frictionlessModel), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := map[string]string{
+		"organization": "seattle",
+		"cdm":          "pedsnet",
+		"cdm-version":  "2.3.0",
+		"data-version": "1.0.0",
+		"etl":          "https://example.org/etl",
+	}
+
+	records := []map[string]string{
+		{
+			"filename":           "person.csv",
+			"table":              "person",
+			"checksum":           "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+			"checksum-algorithm": "sha256",
+			"rows":               "2",
+			"bytes":              "36",
+			"modified":           "2016-07-18T12:00:00Z",
+		},
+		{
+			"filename":           "visit_occurrence.csv",
+			"table":              "visit_occurrence",
+			"checksum":           "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+			"checksum-algorithm": "blake3",
+			"rows":               "1",
+			"bytes":              "12",
+		},
+	}
+
+	for _, record := range records {
+		for key, value := range attrs {
+			record[key] = value
+		}
+	}
+
+	d := &datadirectory.DataDirectory{
+		DirPath:    dir,
+		FilePath:   filepath.Join(dir, "metadata.csv"),
+		RecordMaps: records,
+	}
+
+	if err = WriteDataPackage(d, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, DataPackageFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pkg frictionlessPackage
+
+	if err = json.Unmarshal(b, &pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pkg.Resources) != 2 {
+		t.Fatalf("%d resources, expected 2", len(pkg.Resources))
+	}
+
+	person, visit := pkg.Resources[0], pkg.Resources[1]
+
+	// Only the algorithms allowed by the specification are written as hash.
+	if person.Hash != "sha256:"+records[0]["checksum"] || person.Checksum != "" {
+		t.Errorf("person hash is %q and checksum %q", person.Hash, person.Checksum)
+	}
+
+	if visit.Hash != "" || visit.ChecksumAlgorithm != "blake3" {
+		t.Errorf("visit hash is %q and checksum algorithm %q", visit.Hash, visit.ChecksumAlgorithm)
+	}
+
+	if person.Schema == nil || len(person.Schema.Fields) != 2 {
+		t.Fatalf("person schema is %+v", person.Schema)
+	}
+
+	if f := person.Schema.Fields[1]; f.Type != "string" || f.Constraints == nil || f.Constraints.MaxLength != 256 {
+		t.Errorf("gender_source_value field is %+v", f)
+	}
+
+	if visit.Schema == nil || len(visit.Schema.ForeignKeys) != 1 || visit.Schema.ForeignKeys[0].Reference.Resource != "person" {
+		t.Errorf("visit schema is %+v", visit.Schema)
+	}
+
+	// Without a metadata file the records are read from the descriptor.
+	if MetadataPath(d) != filepath.Join(dir, DataPackageFile) {
+		t.Errorf("metadata path is %s, expected the descriptor", MetadataPath(d))
+	}
+
+	read := &datadirectory.DataDirectory{DirPath: dir, FilePath: d.FilePath}
+
+	if err = ReadMetadata(read); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(read.RecordMaps, records) {
+		t.Errorf("records read back are\n%v\nexpected\n%v", read.RecordMaps, records)
+	}
+}
+
+func TestReadDataPackageHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	descriptor := `{"profile": "tabular-data-package", "resources": [
+		{"name": "person", "path": "person.csv", "hash": "900150983cd24fb0d6963f7d28e17f72"},
+		{"name": "visit", "path": "visit.csv", "table": "visit_occurrence", "hash": "SHA512:abc"}
+	]}`
+
+	if err = ioutil.WriteFile(filepath.Join(dir, DataPackageFile), []byte(descriptor), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &datadirectory.DataDirectory{DirPath: dir}
+
+	if err = readDataPackage(d); err != nil {
+		t.Fatal(err)
+	}
+
+	person, visit := d.RecordMaps[0], d.RecordMaps[1]
+
+	// Hashes without an algorithm are MD5 and the table defaults to the
+	// resource name.
+	if person["checksum-algorithm"] != "md5" || person["table"] != "person" {
+		t.Errorf("person record is %v", person)
+	}
+
+	if visit["checksum-algorithm"] != "sha512" || visit["checksum"] != "abc" || visit["table"] != "visit_occurrence" {
+		t.Errorf("visit record is %v", visit)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, DataPackageFile), []byte(`{"resources": [{"name": "person"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = readDataPackage(d); err == nil {
+		t.Error("no error reading a resource without a path")
+	}
+}
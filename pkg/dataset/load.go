@@ -0,0 +1,455 @@
+package dataset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/database"
+	"github.com/infomodels/datadirectory"
+)
+
+// LoadOptions controls how a dataset is loaded into a database.
+type LoadOptions struct {
+	// DBURI is the database URI and SearchPath a PostgreSQL search_path
+	// value. The first schema of the search path is the one the tables are
+	// created in; others may be needed for the constraints.
+	DBURI      string
+	SearchPath string
+
+	// Model and ModelVersion, if given, override those of the metadata file.
+	// E.g. the non-vocabulary `pedsnet` data model is ordinarily loaded as
+	// `pedsnet-core`, and the vocabulary as `pedsnet-vocab`.
+	Model        string
+	ModelVersion string
+
+	// Service and DMSAService are the URLs of the data models service and
+	// its SQLAlchemy service.
+	Service     string
+	DMSAService string
+
+	// SkipIndexes and SkipConstraints leave out adding the indexes or
+	// constraints after loading.
+	SkipIndexes     bool
+	SkipConstraints bool
+
+	// NotValid creates the foreign key constraints as NOT VALID, to be
+	// validated afterwards with ValidateConstraints.
+	NotValid bool
+
+	// OnFile, if set, is called with each file as soon as it is loaded, so
+	// that what was loaded is known even if the load then fails.
+	OnFile func(f *LoadedFile)
+}
+
+// LoadedFile describes a data file loaded into its table.
+type LoadedFile struct {
+	Filename string
+	Table    string
+
+	// Rows are the rows copied from the file and Bytes its size.
+	Rows  int64
+	Bytes int64
+}
+
+// LoadResult describes a completed load.
+type LoadResult struct {
+	Model        string
+	ModelVersion string
+
+	// Duration is the time the whole load took, and LoadDuration,
+	// IndexesDuration and ConstraintsDuration the time its steps took.
+	Duration            time.Duration
+	LoadDuration        time.Duration
+	IndexesDuration     time.Duration
+	ConstraintsDuration time.Duration
+
+	// Rows and Bytes are the rows copied into each table and the bytes of
+	// the files loaded into it.
+	Rows  map[string]int64
+	Bytes map[string]int64
+}
+
+// openLoad reads the metadata of the dataset in dir and opens the database it
+// is loaded into using dburi, returning the data directory, the database and
+// the model and model version used.
+func openLoad(dir string, opts *LoadOptions, dburi string) (*datadirectory.DataDirectory, *database.Database, *LoadResult, error) {
+	if opts.DBURI == "" {
+		return nil, nil, nil, newError(CategoryUsage, "a dburi is required")
+	}
+
+	if opts.SearchPath == "" {
+		return nil, nil, nil, newError(CategoryUsage, "a searchPath is required")
+	}
+
+	d, err := datadirectory.New(&datadirectory.Config{DataDirPath: dir})
+	if err != nil {
+		return nil, nil, nil, wrap(CategoryOther, err, "reading data directory")
+	}
+
+	if err = ReadMetadata(d); err != nil {
+		return nil, nil, nil, wrap(CategoryFormat, err, "reading metadata file")
+	}
+
+	result := &LoadResult{
+		Model:        d.Model,
+		ModelVersion: d.ModelVersion,
+	}
+
+	if opts.Model != "" {
+		result.Model = opts.Model
+	}
+
+	if opts.ModelVersion != "" {
+		result.ModelVersion = opts.ModelVersion
+	}
+
+	db, err := database.Open(result.Model, result.ModelVersion, dburi, opts.SearchPath, opts.DMSAService, "", "")
+	if err != nil {
+		return nil, nil, nil, wrap(CategoryDatabase, err, "opening database")
+	}
+
+	return d, db, result, nil
+}
+
+// Load loads the dataset in dir into the database, using the metadata to
+// determine which file to load into which table. The model tables are created,
+// the data loaded, and then, unless skipped, the indexes and constraints
+// added. The sizes and headers of the files recorded in the metadata, if any,
+// are checked before any tables are created and the recorded row counts are
+// used to log the progress of the load.
+//
+// The files are loaded one at a time, each by its own COPY, after which the
+// rows copied are counted in its table and passed to OnFile. If the context is
+// cancelled while they are, the COPY in progress is cancelled, rolling back
+// that file alone, no other file is loaded, an aborted entry is recorded in
+// the version_history table and the tables that were not in the schema before
+// the load are dropped, so that it can be run again. Once the files are
+// loaded, a cancellation only records the aborted entry: the loaded tables are
+// kept and their indexes and constraints can be added afterwards. The
+// context's error is then returned. Other errors are of the Category of their
+// cause.
+func Load(ctx context.Context, dir string, opts LoadOptions) (*LoadResult, error) {
+	dburi, session := taggedURI(opts.DBURI)
+
+	d, db, result, err := openLoad(dir, &opts, dburi)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkLoadFiles(d); err != nil {
+		return nil, wrap(CategoryOther, err, "checking data files")
+	}
+
+	sizes, err := fileSizes(d)
+	if err != nil {
+		return nil, wrap(CategoryOther, err, "checking data files")
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logFields := log.Fields{
+		"DataModel":    result.Model,
+		"ModelVersion": result.ModelVersion,
+		"SearchPath":   opts.SearchPath,
+	}
+
+	// Note the tables already in the schema, so that an interrupted load only
+	// drops those it created.
+	existing, err := existingTables(ctx, &opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	stopCancel := cancelTagged(ctx, opts.DBURI, opts.SearchPath, session)
+	defer stopCancel()
+
+	// From here on an interruption leaves tables behind to clean up, until
+	// the files are loaded.
+	loaded := false
+
+	fail := func(step string, err error) (*LoadResult, error) {
+		if ctx.Err() != nil {
+			return nil, abortLoad(ctx, &opts, result, existing, loaded)
+		}
+
+		return nil, wrap(CategoryDatabase, err, step)
+	}
+
+	start := time.Now()
+
+	if err = db.CreateTables("strict"); err != nil {
+		return fail("creating tables", err)
+	}
+
+	// Report progress against the row counts recorded by annotate while the
+	// data is copied in.
+	rows, totalRows := expectedRows(d)
+	stopProgress := make(chan struct{})
+
+	if totalRows > 0 {
+		progressDb, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+		if err == nil {
+			defer progressDb.Close()
+			go reportLoadProgress(progressDb, rows, totalRows, stopProgress)
+		}
+	}
+
+	// The rows copied are counted on a tagged connection, so that an
+	// interruption cancels the count too.
+	countDb, err := database.OpenDatabase(dburi, opts.SearchPath)
+	if err != nil {
+		close(stopProgress)
+		return fail("opening database", err)
+	}
+	defer countDb.Close()
+
+	schema := primarySchema(opts.SearchPath)
+	result.Rows = make(map[string]int64)
+	result.Bytes = make(map[string]int64)
+
+	err = loadFiles(ctx, d, func(file *datadirectory.DataDirectory) error {
+		if err := db.Load(file); err != nil {
+			return err
+		}
+
+		record := file.RecordMaps[0]
+
+		loaded, err := countLoaded(ctx, countDb, schema, record["table"], result.Rows)
+		if err != nil {
+			return err
+		}
+
+		f := &LoadedFile{
+			Filename: record["filename"],
+			Table:    record["table"],
+			Rows:     loaded,
+			Bytes:    sizes[record["filename"]],
+		}
+
+		result.Bytes[f.Table] += f.Bytes
+
+		log.WithFields(log.Fields{
+			"file":  f.Filename,
+			"table": f.Table,
+			"rows":  f.Rows,
+		}).Info("loaded file")
+
+		if opts.OnFile != nil {
+			opts.OnFile(f)
+		}
+
+		return nil
+	})
+	close(stopProgress)
+	if err != nil || ctx.Err() != nil {
+		return fail("loading data", err)
+	}
+
+	loaded = true
+
+	result.LoadDuration = time.Since(start)
+	logFields["durationMinutes"] = result.LoadDuration.Minutes()
+	log.WithFields(logFields).Info("Loaded.")
+
+	if !opts.SkipIndexes {
+		log.WithFields(logFields).Info("Beginning to add indexes.")
+
+		indexesStart := time.Now()
+		if err = db.CreateIndexes("strict"); err != nil || ctx.Err() != nil {
+			return fail("adding indexes", err)
+		}
+
+		result.IndexesDuration = time.Since(indexesStart)
+		logFields["durationMinutes"] = result.IndexesDuration.Minutes()
+		log.WithFields(logFields).Info("Indexes added.")
+	}
+
+	if !opts.SkipConstraints {
+		constraintsStart := time.Now()
+
+		if opts.NotValid {
+			_, err = addNotValidConstraints(ctx, opts.DBURI, opts.SearchPath, result.Model, result.ModelVersion, opts.Service)
+		} else {
+			err = db.CreateConstraints("strict")
+		}
+
+		if err != nil || ctx.Err() != nil {
+			return fail("adding constraints", err)
+		}
+
+		result.ConstraintsDuration = time.Since(constraintsStart)
+	}
+
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// loadFiles loads the files of the data directory one at a time, each with a
+// copy of the directory holding its record alone, stopping before the next
+// file once the context is done.
+func loadFiles(ctx context.Context, d *datadirectory.DataDirectory, load func(*datadirectory.DataDirectory) error) error {
+	for _, record := range d.RecordMaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		file := *d
+		file.RecordMaps = []map[string]string{record}
+
+		if err := load(&file); err != nil {
+			return fmt.Errorf("loading '%s' into %s: %s", record["filename"], record["table"], err)
+		}
+	}
+
+	return nil
+}
+
+// countLoaded counts the rows of the table in the schema and returns how many
+// more there are than those counted before, updating the counts. The table's
+// files are each loaded by a single COPY, so the difference after one of them
+// is loaded is the rows copied from it.
+func countLoaded(ctx context.Context, db *sql.DB, schema string, table string, counts map[string]int64) (int64, error) {
+	var n int64
+
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`select count(*) from %s.%s`, quoteIdent(schema), quoteIdent(table))).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("counting the rows of %s: %s", table, err)
+	}
+
+	loaded := n - counts[table]
+	counts[table] = n
+
+	return loaded, nil
+}
+
+// existingTables returns the names of the tables in the primary schema of the
+// search path.
+func existingTables(ctx context.Context, opts *LoadOptions) (map[string]bool, error) {
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err != nil {
+		return nil, wrap(CategoryDatabase, err, "opening database")
+	}
+	defer db.Close()
+
+	return schemaTables(ctx, db, primarySchema(opts.SearchPath))
+}
+
+// abortLoad cleans up after an interrupted load by recording an aborted entry
+// in the version_history table and, unless its files were all loaded,
+// dropping the tables it created: those of the schema that are not among the
+// existing ones. It returns the context's error.
+func abortLoad(ctx context.Context, opts *LoadOptions, result *LoadResult, existing map[string]bool, loaded bool) error {
+	logFields := log.Fields{
+		"DataModel":    result.Model,
+		"ModelVersion": result.ModelVersion,
+		"SearchPath":   opts.SearchPath,
+	}
+
+	if err := recordAborted(opts.DBURI, opts.SearchPath, result.Model, result.ModelVersion); err != nil {
+		logFields["err"] = err.Error()
+		log.WithFields(logFields).Warn("error recording aborted load in version_history")
+		delete(logFields, "err")
+	}
+
+	if loaded {
+		log.WithFields(logFields).Warn("load interrupted after loading the data, keeping the loaded tables")
+		return ctx.Err()
+	}
+
+	log.WithFields(logFields).Warn("load interrupted, dropping the tables it created")
+
+	// The cleanup uses connections that are not tagged, so that they are not
+	// cancelled too.
+	db, err := database.OpenDatabase(opts.DBURI, opts.SearchPath)
+	if err == nil {
+		defer db.Close()
+
+		var dropped []string
+
+		dropped, err = dropCreated(db, primarySchema(opts.SearchPath), existing)
+		logFields["tables"] = dropped
+	}
+
+	if err != nil {
+		logFields["err"] = err.Error()
+		log.WithFields(logFields).Warn("error dropping the tables of the interrupted load")
+	}
+
+	return ctx.Err()
+}
+
+// dropCreated drops the tables of the schema that are not among the existing
+// ones, other than version_history, which keeps the record of the aborted
+// load, and returns their names.
+func dropCreated(db *sql.DB, schema string, existing map[string]bool) ([]string, error) {
+	tables, err := schemaTables(context.Background(), db, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []string
+
+	for table := range tables {
+		if !existing[table] && table != "version_history" {
+			created = append(created, table)
+		}
+	}
+
+	sort.Strings(created)
+
+	var dropped []string
+
+	for _, table := range created {
+		if _, err = db.Exec(fmt.Sprintf(`drop table if exists %s.%s`, quoteIdent(schema), quoteIdent(table))); err != nil {
+			return dropped, wrap(CategoryDatabase, err, fmt.Sprintf("dropping table %s", table))
+		}
+
+		dropped = append(dropped, table)
+	}
+
+	return dropped, nil
+}
+
+// dropLoaded drops the constraints, indexes and tables of the model, ignoring
+// those that do not exist.
+func dropLoaded(db *database.Database) error {
+	if err := db.DropConstraints("normal"); err != nil {
+		return wrap(CategoryDatabase, err, "dropping constraints")
+	}
+
+	if err := db.DropIndexes("normal"); err != nil {
+		return wrap(CategoryDatabase, err, "dropping indexes")
+	}
+
+	if err := db.DropTables("normal"); err != nil {
+		return wrap(CategoryDatabase, err, "dropping tables")
+	}
+
+	return nil
+}
+
+// Unload drops the constraints, indexes and tables of the dataset in dir from
+// the database, ignoring those that do not exist.
+func Unload(ctx context.Context, dir string, opts LoadOptions) error {
+	_, db, _, err := openLoad(dir, &opts, opts.DBURI)
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return dropLoaded(db)
+}
@@ -0,0 +1,171 @@
+package dataset
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/infomodels/datadirectory"
+)
+
+func TestLoadFiles(t *testing.T) {
+	d := &datadirectory.DataDirectory{
+		DirPath: "/data/seattle",
+		RecordMaps: []map[string]string{
+			{"filename": "person.csv", "table": "person"},
+			{"filename": "visit_1.csv", "table": "visit_occurrence"},
+			{"filename": "visit_2.csv", "table": "visit_occurrence"},
+		},
+	}
+
+	var files []string
+
+	load := func(file *datadirectory.DataDirectory) error {
+		if file.DirPath != d.DirPath || len(file.RecordMaps) != 1 {
+			t.Errorf("loaded %+v", file)
+		}
+
+		files = append(files, file.RecordMaps[0]["filename"])
+
+		return nil
+	}
+
+	if err := loadFiles(context.Background(), d, load); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"person.csv", "visit_1.csv", "visit_2.csv"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("loaded %q, expected %q", files, expected)
+	}
+
+	if len(d.RecordMaps) != 3 {
+		t.Errorf("the data directory was changed to %+v", d)
+	}
+
+	// A cancellation stops the load before the next file.
+	ctx, cancel := context.WithCancel(context.Background())
+	files = nil
+
+	err := loadFiles(ctx, d, func(file *datadirectory.DataDirectory) error {
+		files = append(files, file.RecordMaps[0]["filename"])
+		cancel()
+
+		return nil
+	})
+
+	if err != context.Canceled || len(files) != 1 {
+		t.Errorf("cancelled load returned %v after loading %q", err, files)
+	}
+
+	err = loadFiles(context.Background(), d, func(file *datadirectory.DataDirectory) error {
+		if file.RecordMaps[0]["filename"] == "visit_1.csv" {
+			return errors.New("invalid input syntax")
+		}
+
+		return nil
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "'visit_1.csv' into visit_occurrence") {
+		t.Errorf("failed load returned %v", err)
+	}
+}
+
+func TestDropCreated(t *testing.T) {
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			return []string{"table_name"}, [][]driver.Value{
+				{"visit_occurrence"},
+				{"person"},
+				{"version_history"},
+				{"care_site"},
+			}, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	existing := map[string]bool{"care_site": true}
+
+	dropped, err := dropCreated(db, "nemours_pedsnet", existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"person", "visit_occurrence"}; !reflect.DeepEqual(dropped, expected) {
+		t.Errorf("dropped %q, expected %q", dropped, expected)
+	}
+
+	expected := []string{
+		`drop table if exists "nemours_pedsnet"."person"`,
+		`drop table if exists "nemours_pedsnet"."visit_occurrence"`,
+	}
+
+	if execs := f.executed(); !reflect.DeepEqual(execs, expected) {
+		t.Errorf("executed %q, expected %q", execs, expected)
+	}
+}
+
+func TestDropCreatedFails(t *testing.T) {
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			return []string{"table_name"}, [][]driver.Value{{"person"}, {"visit_occurrence"}}, nil
+		},
+		exec: func(q string, args []driver.Value) error {
+			if strings.Contains(q, "visit_occurrence") {
+				return errors.New("lock timeout")
+			}
+
+			return nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	dropped, err := dropCreated(db, "nemours_pedsnet", nil)
+
+	if CategoryOf(err) != CategoryDatabase || !reflect.DeepEqual(dropped, []string{"person"}) {
+		t.Errorf("dropCreated() = %q, %v", dropped, err)
+	}
+}
+
+func TestCountLoaded(t *testing.T) {
+	counts := []int64{5, 12}
+
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			if q != `select count(*) from "nemours_pedsnet"."visit_occurrence"` {
+				t.Errorf("counted with %q", q)
+			}
+
+			n := counts[0]
+			counts = counts[1:]
+
+			return []string{"count"}, [][]driver.Value{{n}}, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	loaded := map[string]int64{"person": 2}
+
+	for _, expected := range []int64{5, 7} {
+		n, err := countLoaded(context.Background(), db, "nemours_pedsnet", "visit_occurrence", loaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != expected {
+			t.Errorf("countLoaded() = %d, expected %d", n, expected)
+		}
+	}
+
+	if !reflect.DeepEqual(loaded, map[string]int64{"person": 2, "visit_occurrence": 12}) {
+		t.Errorf("counts are %v", loaded)
+	}
+}
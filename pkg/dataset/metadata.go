@@ -0,0 +1,141 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/datadirectory"
+)
+
+// MetadataFile is the name of the metadata file in a data directory.
+const MetadataFile = "metadata.csv"
+
+// Attrs holds the dataset-level values recorded for every file in the
+// metadata file.
+type Attrs struct {
+	Site         string
+	Model        string
+	ModelVersion string
+	DataVersion  string
+	Etl          string
+}
+
+// Fields maps the metadata file columns to the values of the attributes.
+func (a Attrs) Fields() map[string]string {
+	return map[string]string{
+		"organization": a.Site,
+		"cdm":          a.Model,
+		"cdm-version":  a.ModelVersion,
+		"data-version": a.DataVersion,
+		"etl":          a.Etl,
+	}
+}
+
+// FormatModTime formats a file modification time for the metadata file.
+func FormatModTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ChecksumRecords calculates the checksums of the records' files, hashing up
+// to `jobs` files concurrently with the algorithm (sha256 if empty), and
+// records them along with the algorithm and the files' modification times,
+// row counts, sizes, header columns and encodings. The modification time is
+// taken before hashing, so that a file changed meanwhile is hashed again by
+// the next update.
+func ChecksumRecords(ctx context.Context, d *datadirectory.DataDirectory, records []map[string]string, algorithm string, jobs int) error {
+	if algorithm == "" {
+		algorithm = DefaultChecksumAlgorithm
+	}
+
+	checks := make([]*checksumJob, len(records))
+
+	for i, record := range records {
+		log.WithFields(log.Fields{
+			"file":      record["filename"],
+			"algorithm": algorithm,
+		}).Debug("calculating checksum")
+
+		checks[i] = &checksumJob{
+			Path:         filepath.Join(d.DirPath, record["filename"]),
+			Algorithm:    algorithm,
+			CollectStats: true,
+		}
+
+		info, err := os.Stat(checks[i].Path)
+		if err != nil {
+			return err
+		}
+
+		record["modified"] = FormatModTime(info.ModTime())
+	}
+
+	if err := checksumFiles(ctx, checks, jobs); err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		record["checksum"] = checks[i].Checksum
+		record["checksum-algorithm"] = algorithm
+
+		if err := recordStats(record, checks[i].Size, checks[i].Stats); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyMetadata checks the dataset values given in the attributes against
+// each metadata record and the checksum and any statistics of each record
+// against its file, hashing up to `jobs` files concurrently with the algorithm
+// named in each record.
+func VerifyMetadata(ctx context.Context, d *datadirectory.DataDirectory, attrs Attrs, jobs int) error {
+	for _, record := range d.RecordMaps {
+		for key, value := range attrs.Fields() {
+			if value != "" && record[key] != value {
+				return newError(CategoryFormat, "%s of '%s' is '%s' in the metadata file, expected '%s'", key, record["filename"], record[key], value)
+			}
+		}
+	}
+
+	checks := make([]*checksumJob, len(d.RecordMaps))
+
+	for i, record := range d.RecordMaps {
+		checks[i] = &checksumJob{
+			Path:         filepath.Join(d.DirPath, record["filename"]),
+			Algorithm:    recordChecksumAlgorithm(record),
+			CollectStats: hasStats(record),
+		}
+	}
+
+	if err := checksumFiles(ctx, checks, jobs); err != nil {
+		return err
+	}
+
+	var mismatched []string
+
+	for i, record := range d.RecordMaps {
+		if !strings.EqualFold(checks[i].Checksum, record["checksum"]) {
+			mismatched = append(mismatched, fmt.Sprintf("%s: checksum mismatch", record["filename"]))
+		}
+
+		if checks[i].Stats == nil {
+			continue
+		}
+
+		for _, diff := range compareStats(record, checks[i].Size, checks[i].Stats) {
+			mismatched = append(mismatched, fmt.Sprintf("%s: %s", record["filename"], diff))
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return newError(CategoryChecksum, "metadata does not match data: %s", strings.Join(mismatched, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package dataset
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infomodels/datadirectory"
+)
+
+func TestChecksumRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"person.csv": "person_id,year_of_birth\n1,2001\n2,2003\n",
+		"visit.csv":  "visit_id,person_id\n10,1\n",
+	}
+
+	d := &datadirectory.DataDirectory{DirPath: dir}
+
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d.RecordMaps = append(d.RecordMaps, map[string]string{
+			"organization": "seattle",
+			"filename":     name,
+			"table":        strings.TrimSuffix(name, ".csv"),
+		})
+	}
+
+	if err = ChecksumRecords(context.Background(), d, d.RecordMaps, "", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range d.RecordMaps {
+		if record["checksum-algorithm"] != DefaultChecksumAlgorithm || len(record["checksum"]) != 64 {
+			t.Errorf("%s: checksum is %s:%s", record["filename"], record["checksum-algorithm"], record["checksum"])
+		}
+
+		if record["modified"] == "" || record["columns"] == "" || record["encoding"] != "ascii" {
+			t.Errorf("%s: statistics are missing from %v", record["filename"], record)
+		}
+	}
+
+	if err = VerifyMetadata(context.Background(), d, Attrs{Site: "seattle"}, 2); err != nil {
+		t.Errorf("unexpected error verifying unchanged files: %s", err)
+	}
+
+	if err = VerifyMetadata(context.Background(), d, Attrs{Site: "boston"}, 2); err == nil || !strings.Contains(err.Error(), "expected 'boston'") {
+		t.Errorf("error %v verifying a different site", err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "visit.csv"), []byte("visit_id,person_id\n10,1\n11,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifyMetadata(context.Background(), d, Attrs{}, 2)
+	if err == nil {
+		t.Fatal("no error verifying a changed file")
+	}
+
+	for _, diff := range []string{"visit.csv: checksum mismatch", "visit.csv: rows is 2, expected 1"} {
+		if !strings.Contains(err.Error(), diff) {
+			t.Errorf("error %q does not contain %q", err, diff)
+		}
+	}
+
+	if strings.Contains(err.Error(), "person.csv") {
+		t.Errorf("error %q reports the unchanged file", err)
+	}
+}
+
+func TestReportValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []*FileReport
+		valid bool
+	}{
+		{"no files", nil, true},
+		{"checked", []*FileReport{{Filename: "person.csv"}}, true},
+		{
+			"unchecked",
+			[]*FileReport{
+				{Filename: "person.csv"},
+				{Filename: "visit.csv", Err: errors.New("unknown table 'visits'")},
+			},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		r := &Report{Files: test.files}
+
+		if valid := r.Valid(); valid != test.valid {
+			t.Errorf("%s: Valid() = %t, expected %t", test.name, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package dataset
+
+import (
+	"database/sql"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	"github.com/infomodels/database"
+)
+
+// FetchModel retrieves the definition of a model version from the data models
+// service, or of the latest version of the model if no version is given. A
+// service that cannot be reached is an error of CategoryService, and an
+// unknown model or version one of CategoryConfiguration.
+func FetchModel(modelName string, versionName string, service string) (*dms.Model, error) {
+	// Initialize data models client for service.
+	c, err := dms.New(service)
+
+	if err != nil {
+		return nil, &Error{Category: CategoryConfiguration, Err: err}
+	}
+
+	if err = c.Ping(); err != nil {
+		return nil, &Error{Category: CategoryService, Err: err}
+	}
+
+	// The service answered, so the model is the problem.
+	revisions, err := c.ModelRevisions(modelName)
+
+	if err != nil {
+		return nil, &Error{Category: CategoryConfiguration, Err: err}
+	}
+
+	var model *dms.Model
+
+	// Get the latest version.
+	if versionName == "" {
+		model = revisions.Latest()
+	} else {
+
+		var (
+			versions []string
+			_model   *dms.Model
+		)
+
+		for _, _model = range revisions.List() {
+			if _model.Version == versionName {
+				model = _model
+				break
+			}
+
+			versions = append(versions, _model.Version)
+		}
+
+		if model == nil {
+			return nil, newError(CategoryConfiguration, "Invalid version for '%s'. Choose from: %s\n", modelName, strings.Join(versions, ", "))
+		}
+	}
+
+	log.Infof("Using model '%s/%s'", model.Name, model.Version)
+
+	return model, nil
+}
+
+// ModelAndVersion returns the model and model version of the tables loaded in
+// the primary schema of the search path, as recorded in version_history.
+func ModelAndVersion(dburi string, searchPath string) (model string, modelVersion string, err error) {
+	var (
+		db *sql.DB
+	)
+
+	db, err = database.OpenDatabase(dburi, searchPath)
+	if err != nil {
+		err = &Error{Category: CategoryDatabase, Err: err}
+		return
+	}
+	defer db.Close()
+
+	// From the version_history table, return the model and
+	// model_version from the last 'create tables' entry such that there
+	// is no 'drop tables' entry after the final 'create tables' entry.
+	query := `
+with last_create as
+(select * from version_history
+where operation = 'create tables'
+order by datetime desc
+limit 1),
+last_drop as
+(select * from version_history
+where operation = 'drop tables'
+order by datetime desc
+limit 1)
+select model, model_version from
+(select last_create.model, last_create.model_version, last_create.datetime as last_create_time, last_drop.datetime as last_drop_time from last_create
+left join last_drop on 1 = 1) q
+where case when last_drop_time is null then true when last_create_time > last_drop_time then true else false end;
+  `
+	err = db.QueryRow(query).Scan(&model, &modelVersion)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = newError(CategoryDatabase, "Can't determine model and version because no active 'create tables' operation in version_history table (search_path %s)", searchPath)
+		} else {
+			err = &Error{Category: CategoryDatabase, Err: err}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,161 @@
+package dataset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+// PendingConstraint is a foreign key constraint that has been created as
+// NOT VALID and has not yet been validated.
+type PendingConstraint struct {
+	Table string
+	Name  string
+}
+
+// primarySchema returns the first schema of a search path, which is the
+// schema tables are loaded into and constraints are added in.
+func primarySchema(searchPath string) string {
+	return strings.TrimSpace(strings.Split(searchPath, ",")[0])
+}
+
+// createNotValidConstraints adds the model's foreign keys to the tables in the
+// primary schema without checking the existing rows, which only needs a brief
+// lock on each table. Constraints that already exist are skipped, so a failed
+// run can simply be repeated. The number of constraints added is returned.
+func createNotValidConstraints(ctx context.Context, db *sql.DB, schema string, fks []*dms.ForeignKey) (int, error) {
+	var added int
+
+	for _, fk := range fks {
+		exists, _, err := constraintState(ctx, db, schema, fk.Name)
+		if err != nil {
+			return added, err
+		}
+
+		if exists {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`alter table %s.%s add constraint %s foreign key (%s) references %s (%s) not valid`,
+			quoteIdent(schema),
+			quoteIdent(fk.SourceTable),
+			quoteIdent(fk.Name),
+			quoteIdent(fk.SourceField),
+			quoteIdent(fk.TargetTable),
+			quoteIdent(fk.TargetField)))
+		if err != nil {
+			return added, fmt.Errorf("adding constraint %s: %s", fk.Name, err)
+		}
+
+		added++
+	}
+
+	return added, nil
+}
+
+// constraintState reports whether the named constraint exists in the schema
+// and, if it does, whether it has been validated against the existing rows.
+func constraintState(ctx context.Context, db *sql.DB, schema string, name string) (exists bool, validated bool, err error) {
+	err = db.QueryRowContext(ctx, `select c.convalidated from pg_constraint c
+join pg_namespace n on n.oid = c.connamespace
+where n.nspname = $1 and c.conname = $2`, schema, name).Scan(&validated)
+
+	switch err {
+	case nil:
+		return true, validated, nil
+	case sql.ErrNoRows:
+		return false, false, nil
+	default:
+		return false, false, err
+	}
+}
+
+// listPending lists the foreign key constraints in the schema that are
+// not yet validated. Because validated constraints drop out of this list, it
+// is what makes validation resumable.
+func listPending(ctx context.Context, db *sql.DB, schema string) ([]PendingConstraint, error) {
+	rows, err := db.QueryContext(ctx, `select quote_ident(n.nspname) || '.' || quote_ident(r.relname), c.conname
+from pg_constraint c
+join pg_class r on r.oid = c.conrelid
+join pg_namespace n on n.oid = c.connamespace
+where c.contype = 'f' and not c.convalidated and n.nspname = $1
+order by r.relname, c.conname`, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []PendingConstraint
+
+	for rows.Next() {
+		var p PendingConstraint
+
+		if err = rows.Scan(&p.Table, &p.Name); err != nil {
+			return nil, err
+		}
+
+		pending = append(pending, p)
+	}
+
+	return pending, rows.Err()
+}
+
+// validatePending validates the pending constraints using the given
+// number of concurrent workers. VALIDATE CONSTRAINT only takes a SHARE UPDATE
+// EXCLUSIVE lock, so the tables stay readable and writable meanwhile. The
+// done callback is called, serially, as each constraint finishes; the first
+// error is returned after all workers have stopped.
+func validatePending(ctx context.Context, db *sql.DB, pending []PendingConstraint, workers int, done func(p PendingConstraint, err error)) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		queue    = make(chan PendingConstraint)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for p := range queue {
+				_, err := db.ExecContext(ctx, fmt.Sprintf(`alter table %s validate constraint %s`, p.Table, quoteIdent(p.Name)))
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("validating constraint %s: %s", p.Name, err)
+				}
+				done(p, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Stop handing out constraints once the context is cancelled; those
+	// being validated are cancelled by it too.
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+
+		queue <- p
+	}
+
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return firstErr
+}
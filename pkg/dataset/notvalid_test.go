@@ -0,0 +1,148 @@
+package dataset
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+func TestPrimarySchema(t *testing.T) {
+	for searchPath, expected := range map[string]string{
+		"nemours_pedsnet":                 "nemours_pedsnet",
+		"nemours_pedsnet, vocabulary":     "nemours_pedsnet",
+		" nemours_pedsnet ,vocabulary,pg": "nemours_pedsnet",
+	} {
+		if schema := primarySchema(searchPath); schema != expected {
+			t.Errorf("primarySchema(%q) = %q, expected %q", searchPath, schema, expected)
+		}
+	}
+}
+
+func TestCreateNotValidConstraints(t *testing.T) {
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			// Only fk_visit_person exists already.
+			if args[1] == "fk_visit_person" {
+				return []string{"convalidated"}, [][]driver.Value{{false}}, nil
+			}
+
+			return []string{"convalidated"}, nil, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	fks := []*dms.ForeignKey{
+		{Name: "fk_visit_person", SourceTable: "visit_occurrence", SourceField: "person_id", TargetTable: "person", TargetField: "person_id"},
+		{Name: "fk_drug_visit", SourceTable: "drug_exposure", SourceField: "visit_occurrence_id", TargetTable: "visit_occurrence", TargetField: "visit_occurrence_id"},
+	}
+
+	added, err := createNotValidConstraints(context.Background(), db, "nemours_pedsnet", fks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added != 1 {
+		t.Errorf("%d constraints added, expected 1", added)
+	}
+
+	execs := f.executed()
+	expected := `alter table "nemours_pedsnet"."drug_exposure" add constraint "fk_drug_visit" foreign key ("visit_occurrence_id") references "visit_occurrence" ("visit_occurrence_id") not valid`
+
+	if len(execs) != 1 || execs[0] != expected {
+		t.Errorf("executed %q, expected %q", execs, expected)
+	}
+}
+
+func TestValidatePending(t *testing.T) {
+	f := &fakeDB{
+		exec: func(q string, args []driver.Value) error {
+			if strings.Contains(q, "fk_drug_visit") {
+				return errors.New("insert or update violates foreign key constraint")
+			}
+
+			return nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	pending := []PendingConstraint{
+		{Table: `"s"."visit_occurrence"`, Name: "fk_visit_person"},
+		{Table: `"s"."drug_exposure"`, Name: "fk_drug_visit"},
+		{Table: `"s"."condition_occurrence"`, Name: "fk_condition_person"},
+	}
+
+	done := make(map[string]error)
+
+	err := validatePending(context.Background(), db, pending, 2, func(p PendingConstraint, err error) {
+		done[p.Name] = err
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "validating constraint fk_drug_visit") {
+		t.Errorf("error %v, expected the failure of fk_drug_visit", err)
+	}
+
+	if len(done) != len(pending) {
+		t.Errorf("done called for %d constraints, expected %d", len(done), len(pending))
+	}
+
+	if done["fk_visit_person"] != nil || done["fk_drug_visit"] == nil {
+		t.Errorf("unexpected results %v", done)
+	}
+
+	if n := len(f.executed()); n != len(pending) {
+		t.Errorf("%d statements executed, expected %d", n, len(pending))
+	}
+}
+
+func TestValidatePendingCancelled(t *testing.T) {
+	f := &fakeDB{}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := validatePending(ctx, db, []PendingConstraint{{Table: `"s"."person"`, Name: "fk_person_location"}}, 1, func(PendingConstraint, error) {})
+	if err != context.Canceled {
+		t.Errorf("error %v, expected %v", err, context.Canceled)
+	}
+
+	if n := len(f.executed()); n != 0 {
+		t.Errorf("%d statements executed after cancelling", n)
+	}
+}
+
+func TestListPending(t *testing.T) {
+	f := &fakeDB{
+		query: func(q string, args []driver.Value) ([]string, [][]driver.Value, error) {
+			if args[0] != "nemours_pedsnet" {
+				t.Errorf("listed constraints of schema %v", args[0])
+			}
+
+			return []string{"table", "conname"}, [][]driver.Value{
+				{`"nemours_pedsnet"."visit_occurrence"`, "fk_visit_person"},
+			}, nil
+		},
+	}
+
+	db := openFakeDB(t, f)
+	defer db.Close()
+
+	pending, err := listPending(context.Background(), db, "nemours_pedsnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 || pending[0].Name != "fk_visit_person" || pending[0].Table != `"nemours_pedsnet"."visit_occurrence"` {
+		t.Errorf("pending constraints are %v", pending)
+	}
+}
@@ -0,0 +1,126 @@
+package dataset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+// OrphanReport describes the rows of a table that would violate a foreign key
+// constraint if it were added.
+type OrphanReport struct {
+	ForeignKey *dms.ForeignKey
+	Count      int64
+	Samples    []string
+}
+
+// foreignKeys returns the foreign key constraints defined by the model.
+func foreignKeys(m *dms.Model) []*dms.ForeignKey {
+	if m.Schema == nil || m.Schema.Constraints == nil {
+		return nil
+	}
+
+	return m.Schema.Constraints.ForeignKeys
+}
+
+// quoteIdent quotes a PostgreSQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// orphanCondition returns the anti-join predicate matching rows of the
+// foreign key's source table (aliased as `s`) that have no referenced row.
+func orphanCondition(fk *dms.ForeignKey) string {
+	return fmt.Sprintf(`s.%s is not null and not exists (select 1 from %s t where t.%s = s.%s)`,
+		quoteIdent(fk.SourceField),
+		quoteIdent(fk.TargetTable),
+		quoteIdent(fk.TargetField),
+		quoteIdent(fk.SourceField))
+}
+
+// findOrphans counts the rows violating the foreign key and collects up to
+// `samples` distinct offending key values.
+func findOrphans(ctx context.Context, db *sql.DB, fk *dms.ForeignKey, samples int) (*OrphanReport, error) {
+	var (
+		report = &OrphanReport{ForeignKey: fk}
+		cond   = orphanCondition(fk)
+		table  = quoteIdent(fk.SourceTable)
+	)
+
+	query := fmt.Sprintf(`select count(*) from %s s where %s`, table, cond)
+
+	if err := db.QueryRowContext(ctx, query).Scan(&report.Count); err != nil {
+		return nil, err
+	}
+
+	if report.Count == 0 || samples <= 0 {
+		return report, nil
+	}
+
+	query = fmt.Sprintf(`select distinct s.%s::text from %s s where %s order by 1 limit %d`,
+		quoteIdent(fk.SourceField), table, cond, samples)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		report.Samples = append(report.Samples, key)
+	}
+
+	return report, rows.Err()
+}
+
+// quarantineTable returns the name of the side table that orphaned rows of
+// the given table are moved into.
+func quarantineTable(table string) string {
+	return table + "_orphans"
+}
+
+// quarantineOrphans moves the rows violating the foreign key out of the
+// source table and into its quarantine table, creating the quarantine table
+// in the primary schema if necessary. The number of rows moved is returned.
+func quarantineOrphans(ctx context.Context, db *sql.DB, fk *dms.ForeignKey) (int64, error) {
+	var (
+		table = quoteIdent(fk.SourceTable)
+		side  = quoteIdent(quarantineTable(fk.SourceTable))
+	)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// The quarantine table mirrors the source table's columns but none of
+	// its constraints, so that any orphaned row can be stored in it.
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s as select * from %s where false`, side, table)); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(`with moved as (delete from %s s where %s returning s.*) insert into %s select * from moved`,
+		table, orphanCondition(fk), side))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
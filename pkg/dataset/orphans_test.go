@@ -0,0 +1,61 @@
+package dataset
+
+import (
+	"testing"
+
+	dms "github.com/chop-dbhi/data-models-service/client"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	tests := map[string]string{
+		"person":     `"person"`,
+		"Visit Type": `"Visit Type"`,
+		`odd"name`:   `"odd""name"`,
+	}
+
+	for name, expected := range tests {
+		if quoted := quoteIdent(name); quoted != expected {
+			t.Errorf("quoteIdent(%q) = %s, expected %s", name, quoted, expected)
+		}
+	}
+}
+
+func TestOrphanCondition(t *testing.T) {
+	fk := &dms.ForeignKey{
+		Name:        "fk_visit_person",
+		SourceTable: "visit_occurrence",
+		SourceField: "person_id",
+		TargetTable: "person",
+		TargetField: "person_id",
+	}
+
+	expected := `s."person_id" is not null and not exists (select 1 from "person" t where t."person_id" = s."person_id")`
+
+	if cond := orphanCondition(fk); cond != expected {
+		t.Errorf("condition is\n%s\nexpected\n%s", cond, expected)
+	}
+
+	if side := quarantineTable(fk.SourceTable); side != "visit_occurrence_orphans" {
+		t.Errorf("quarantine table is %s", side)
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	fk := &dms.ForeignKey{Name: "fk_visit_person"}
+
+	tests := []struct {
+		name  string
+		model *dms.Model
+		count int
+	}{
+		{"no schema", &dms.Model{}, 0},
+		{"no constraints", &dms.Model{Schema: &dms.Schema{}}, 0},
+		{"foreign keys", &dms.Model{Schema: &dms.Schema{Constraints: &dms.Constraints{ForeignKeys: []*dms.ForeignKey{fk}}}}, 1},
+	}
+
+	for _, test := range tests {
+		if fks := foreignKeys(test.model); len(fks) != test.count {
+			t.Errorf("%s: %d foreign keys, expected %d", test.name, len(fks), test.count)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package dataset
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/infomodels/datadirectory"
+)
+
+// progressInterval is how often load progress is reported.
+const progressInterval = 30 * time.Second
+
+// expectedRows returns the row counts recorded in the metadata, by table, and
+// their total. Tables without a recorded row count are omitted.
+func expectedRows(d *datadirectory.DataDirectory) (map[string]int64, int64) {
+	var (
+		rows  = make(map[string]int64)
+		total int64
+	)
+
+	for _, record := range d.RecordMaps {
+		n, err := strconv.ParseInt(record["rows"], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		rows[record["table"]] += n
+		total += n
+	}
+
+	return rows, total
+}
+
+// fileSizes returns the sizes of the data files by file name.
+func fileSizes(d *datadirectory.DataDirectory) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+
+	for _, record := range d.RecordMaps {
+		info, err := os.Stat(filepath.Join(d.DirPath, record["filename"]))
+		if err != nil {
+			return nil, err
+		}
+
+		sizes[record["filename"]] = info.Size()
+	}
+
+	return sizes, nil
+}
+
+// checkLoadFiles cheaply verifies the recorded byte size and header columns
+// of each data file before loading it. Row counts and encodings require
+// reading the whole file and are left to validate.
+func checkLoadFiles(d *datadirectory.DataDirectory) error {
+	var problems []string
+
+	for _, record := range d.RecordMaps {
+		filePath := filepath.Join(d.DirPath, record["filename"])
+
+		if record["bytes"] != "" {
+			info, err := os.Stat(filePath)
+			if err != nil {
+				return err
+			}
+
+			if size := strconv.FormatInt(info.Size(), 10); size != record["bytes"] {
+				problems = append(problems, fmt.Sprintf("%s: bytes is %s, expected %s", record["filename"], size, record["bytes"]))
+			}
+		}
+
+		if record["columns"] != "" {
+			header, err := ReadHeader(filePath)
+			if err != nil {
+				return fmt.Errorf("reading header of '%s': %s", record["filename"], err)
+			}
+
+			if cols := strings.Join(header, " "); cols != record["columns"] {
+				problems = append(problems, fmt.Sprintf("%s: columns are '%s', expected '%s'", record["filename"], cols, record["columns"]))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return newError(CategoryChecksum, "metadata does not match data: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// reportLoadProgress periodically logs the progress of the COPY commands
+// running in the database against the row counts expected from the metadata,
+// until the stop channel is closed. It relies on the pg_stat_progress_copy
+// view (PostgreSQL 14 and later) and stops quietly if it is unavailable.
+func reportLoadProgress(db *sql.DB, rows map[string]int64, total int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var (
+			table  string
+			copied int64
+		)
+
+		err := db.QueryRow(`select c.relname, p.tuples_processed
+from pg_stat_progress_copy p
+join pg_class c on c.oid = p.relid
+where p.datname = current_database()
+order by p.pid
+limit 1`).Scan(&table, &copied)
+
+		if err == sql.ErrNoRows {
+			continue
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Debug("load progress unavailable")
+			return
+		}
+
+		fields := log.Fields{
+			"table":      table,
+			"rowsCopied": copied,
+			"totalRows":  total,
+		}
+
+		if expected := rows[table]; expected > 0 {
+			fields["tableRows"] = expected
+			fields["tablePercent"] = fmt.Sprintf("%.1f", 100*float64(copied)/float64(expected))
+		}
+
+		log.WithFields(fields).Info("loading")
+	}
+}
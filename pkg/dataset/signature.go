@@ -0,0 +1,45 @@
+package dataset
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// SignatureExt is appended to the path of a file to name its detached
+// signature.
+const SignatureExt = ".sig"
+
+// VerifySignature checks the ascii armored detached signature next to the file
+// against the keyring, returning the signer. A signature that does not match
+// is an error of CategoryChecksum.
+func VerifySignature(filePath string, keyring openpgp.EntityList) (*openpgp.Entity, error) {
+	signed, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer signed.Close()
+
+	sig, err := os.Open(filePath + SignatureExt)
+	if err != nil {
+		return nil, err
+	}
+	defer sig.Close()
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, signed, sig)
+	if err != nil {
+		return nil, newError(CategoryChecksum, "bad signature for %s: %s", filePath, err)
+	}
+
+	return signer, nil
+}
+
+// EntityName returns the first identity name of a key, or its key ID.
+func EntityName(e *openpgp.Entity) string {
+	for name := range e.Identities {
+		return name
+	}
+
+	return strings.ToUpper(e.PrimaryKey.KeyIdString())
+}
@@ -0,0 +1,250 @@
+package dataset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxHeaderBytes limits how much of the first line is kept to parse the
+// header columns.
+const maxHeaderBytes = 1 << 20
+
+// ReadHeader returns the lower-cased column names from the first row of a CSV
+// file, which may be gzip compressed.
+func ReadHeader(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+
+	if strings.HasSuffix(filePath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	header, err := csv.NewReader(r).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, col := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(col))
+	}
+
+	// Drop a UTF-8 byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	return header, nil
+}
+
+// fileStats is an io.Writer that collects the row count, header columns and
+// encoding of CSV data written to it in a single pass.
+type fileStats struct {
+	n        int64
+	lines    int64
+	inQuote  bool
+	last     byte
+	header   []byte
+	headDone bool
+	prefix   []byte
+	partial  []byte
+	ascii    bool
+	utf8     bool
+}
+
+func newFileStats() *fileStats {
+	return &fileStats{ascii: true, utf8: true}
+}
+
+func (s *fileStats) Write(p []byte) (int, error) {
+	s.n += int64(len(p))
+
+	if len(s.prefix) < 3 {
+		n := 3 - len(s.prefix)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.prefix = append(s.prefix, p[:n]...)
+	}
+
+	// Count line breaks outside quoted values, so that values containing
+	// newlines do not count as rows.
+	for i, b := range p {
+		switch b {
+		case '"':
+			s.inQuote = !s.inQuote
+		case '\n':
+			if !s.inQuote {
+				s.lines++
+
+				if !s.headDone {
+					s.addHeader(p[:i])
+					s.headDone = true
+				}
+			}
+		}
+
+		if b >= utf8.RuneSelf {
+			s.ascii = false
+		}
+	}
+
+	if !s.headDone {
+		s.addHeader(p)
+	}
+
+	if len(p) > 0 {
+		s.last = p[len(p)-1]
+	}
+
+	if s.utf8 {
+		s.checkUTF8(p)
+	}
+
+	return len(p), nil
+}
+
+// addHeader appends to the bytes of the first line, up to maxHeaderBytes.
+func (s *fileStats) addHeader(p []byte) {
+	if n := maxHeaderBytes - len(s.header); n < len(p) {
+		p = p[:n]
+	}
+
+	s.header = append(s.header, p...)
+}
+
+// checkUTF8 validates the bytes as UTF-8, carrying an incomplete trailing
+// rune over to the next write.
+func (s *fileStats) checkUTF8(p []byte) {
+	buf := p
+	if len(s.partial) > 0 {
+		buf = append(s.partial, p...)
+	}
+
+	// Find the start of the last rune and hold it back if incomplete.
+	i := len(buf) - 1
+	for i > 0 && len(buf)-i < utf8.UTFMax && !utf8.RuneStart(buf[i]) {
+		i--
+	}
+
+	if i >= 0 && !utf8.FullRune(buf[i:]) {
+		s.partial = append([]byte(nil), buf[i:]...)
+		buf = buf[:i]
+	} else {
+		s.partial = nil
+	}
+
+	if !utf8.Valid(buf) {
+		s.utf8 = false
+	}
+}
+
+// Rows returns the number of data rows, excluding the header.
+func (s *fileStats) Rows() int64 {
+	lines := s.lines
+
+	// Count a last line without a trailing newline.
+	if s.n > 0 && s.last != '\n' {
+		lines++
+	}
+
+	if lines == 0 {
+		return 0
+	}
+
+	return lines - 1
+}
+
+// Columns returns the lower-cased column names of the header.
+func (s *fileStats) Columns() ([]string, error) {
+	header := bytes.TrimPrefix(s.header, []byte("\xef\xbb\xbf"))
+
+	cols, err := csv.NewReader(bytes.NewReader(header)).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, col := range cols {
+		cols[i] = strings.ToLower(strings.TrimSpace(col))
+	}
+
+	return cols, nil
+}
+
+// Encoding returns the detected character encoding of the data: ascii,
+// utf-8, utf-8-bom, utf-16le, utf-16be or unknown.
+func (s *fileStats) Encoding() string {
+	switch {
+	case bytes.HasPrefix(s.prefix, []byte("\xef\xbb\xbf")):
+		return "utf-8-bom"
+	case bytes.HasPrefix(s.prefix, []byte("\xff\xfe")):
+		return "utf-16le"
+	case bytes.HasPrefix(s.prefix, []byte("\xfe\xff")):
+		return "utf-16be"
+	case s.ascii:
+		return "ascii"
+	case s.utf8 && len(s.partial) == 0:
+		return "utf-8"
+	}
+
+	return "unknown"
+}
+
+// recordStats stores the statistics in a metadata record.
+func recordStats(record map[string]string, size int64, s *fileStats) error {
+	cols, err := s.Columns()
+	if err != nil {
+		return fmt.Errorf("reading header of '%s': %s", record["filename"], err)
+	}
+
+	record["rows"] = strconv.FormatInt(s.Rows(), 10)
+	record["bytes"] = strconv.FormatInt(size, 10)
+	record["columns"] = strings.Join(cols, " ")
+	record["encoding"] = s.Encoding()
+
+	return nil
+}
+
+// hasStats reports whether a metadata record includes file statistics.
+func hasStats(record map[string]string) bool {
+	return record["rows"] != "" || record["bytes"] != "" || record["columns"] != "" || record["encoding"] != ""
+}
+
+// compareStats checks the statistics in a metadata record against those
+// collected from its file, returning a description of each difference.
+func compareStats(record map[string]string, size int64, s *fileStats) []string {
+	var diffs []string
+
+	check := func(key string, actual string) {
+		if expected := record[key]; expected != "" && expected != actual {
+			diffs = append(diffs, fmt.Sprintf("%s is %s, expected %s", key, actual, expected))
+		}
+	}
+
+	check("rows", strconv.FormatInt(s.Rows(), 10))
+	check("bytes", strconv.FormatInt(size, 10))
+	check("encoding", s.Encoding())
+
+	if cols, err := s.Columns(); err != nil {
+		diffs = append(diffs, fmt.Sprintf("header could not be read: %s", err))
+	} else {
+		check("columns", strings.Join(cols, " "))
+	}
+
+	return diffs
+}
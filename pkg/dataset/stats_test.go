@@ -0,0 +1,165 @@
+package dataset
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// collectStats writes the data to new statistics in chunks of the given size.
+func collectStats(data string, chunk int) *fileStats {
+	s := newFileStats()
+	b := []byte(data)
+
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+
+		s.Write(b[:n])
+		b = b[n:]
+	}
+
+	return s
+}
+
+func TestFileStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		rows     int64
+		columns  []string
+		encoding string
+	}{
+		{"empty", "", 0, nil, "ascii"},
+		{"header only", "id,name\n", 0, []string{"id", "name"}, "ascii"},
+		{"rows", "ID, Name\n1,a\n2,b\n", 2, []string{"id", "name"}, "ascii"},
+		{"no trailing newline", "id,name\n1,a\n2,b", 2, []string{"id", "name"}, "ascii"},
+		{"quoted newline", "id,note\n1,\"two\nlines\"\n2,x\n", 2, []string{"id", "note"}, "ascii"},
+		{"utf-8", "id,name\n1,Zoë\n", 1, []string{"id", "name"}, "utf-8"},
+		{"byte order mark", "\xef\xbb\xbfid,name\n1,a\n", 1, []string{"id", "name"}, "utf-8-bom"},
+		{"utf-16le", "\xff\xfei\x00d\x00\n", 0, nil, "utf-16le"},
+		{"latin-1", "id,name\n1,Zo\xeb\n", 1, []string{"id", "name"}, "unknown"},
+		{"truncated rune", "id,name\n1,Zo\xc3", 1, []string{"id", "name"}, "unknown"},
+	}
+
+	for _, test := range tests {
+
+		// Runes and lines split across writes are counted the same.
+		for _, chunk := range []int{1, 2, 5, 1 << 16} {
+			s := collectStats(test.data, chunk)
+
+			if rows := s.Rows(); rows != test.rows {
+				t.Errorf("%s, %d byte writes: %d rows, expected %d", test.name, chunk, rows, test.rows)
+			}
+
+			if encoding := s.Encoding(); encoding != test.encoding {
+				t.Errorf("%s, %d byte writes: encoding is %s, expected %s", test.name, chunk, encoding, test.encoding)
+			}
+
+			if test.columns == nil {
+				continue
+			}
+
+			if cols, err := s.Columns(); err != nil {
+				t.Errorf("%s, %d byte writes: unexpected error: %s", test.name, chunk, err)
+			} else if !reflect.DeepEqual(cols, test.columns) {
+				t.Errorf("%s, %d byte writes: columns are %v, expected %v", test.name, chunk, cols, test.columns)
+			}
+		}
+	}
+}
+
+func TestCompareStats(t *testing.T) {
+	data := "id,name\n1,a\n2,b\n"
+	s := collectStats(data, len(data))
+
+	record := map[string]string{"filename": "person.csv"}
+
+	if err := recordStats(record, int64(len(data)), s); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"filename": "person.csv",
+		"rows":     "2",
+		"bytes":    "16",
+		"columns":  "id name",
+		"encoding": "ascii",
+	}
+
+	if !reflect.DeepEqual(record, expected) {
+		t.Errorf("recorded statistics are %v, expected %v", record, expected)
+	}
+
+	if diffs := compareStats(record, int64(len(data)), s); len(diffs) != 0 {
+		t.Errorf("differences %v for the same data", diffs)
+	}
+
+	changed := "id,name,year\n1,a,2001\n"
+
+	diffs := compareStats(record, int64(len(changed)), collectStats(changed, len(changed)))
+
+	for _, diff := range []string{"rows is 1, expected 2", "bytes is 22, expected 16", "columns is id name year, expected id name"} {
+		found := false
+
+		for _, d := range diffs {
+			if d == diff {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("differences %v do not include %q", diffs, diff)
+		}
+	}
+
+	// Statistics missing from a record are not compared.
+	if diffs := compareStats(map[string]string{"rows": "1"}, int64(len(changed)), collectStats(changed, len(changed))); len(diffs) != 0 {
+		t.Errorf("differences %v for statistics not in the record", diffs)
+	}
+
+	if !hasStats(record) || hasStats(map[string]string{"filename": "person.csv"}) {
+		t.Error("hasStats does not match the recorded statistics")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "person.csv")
+
+	if err = ioutil.WriteFile(plain, []byte("\xef\xbb\xbfPerson_ID, Year_Of_Birth\n1,2001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := filepath.Join(dir, "person.csv.gz")
+
+	f, err := os.Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("person_id,year_of_birth\n"))
+	gz.Close()
+	f.Close()
+
+	for _, path := range []string{plain, compressed} {
+		header, err := ReadHeader(path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", path, err)
+		} else if strings.Join(header, " ") != "person_id year_of_birth" {
+			t.Errorf("%s: header is %v", path, header)
+		}
+	}
+}
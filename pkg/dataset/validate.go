@@ -0,0 +1,277 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	dms "github.com/chop-dbhi/data-models-service/client"
+	validator "github.com/chop-dbhi/data-models-validator"
+	"github.com/infomodels/datadirectory"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ValidateOptions controls how a dataset is validated.
+type ValidateOptions struct {
+	// Attrs are checked against every metadata record, except for empty
+	// ones. A model and model version given here are also used for the format
+	// validation instead of those in the metadata file.
+	Attrs Attrs
+
+	// Service is the data models service the model definition is retrieved
+	// from.
+	Service string
+
+	// Jobs is the number of files checksummed concurrently.
+	Jobs int
+
+	// Keyring, if not empty, holds the public keys the detached signature of
+	// the metadata file is checked against before the file is read.
+	Keyring openpgp.EntityList
+
+	// SkipFormat leaves out the format validation, so that only the metadata
+	// and checksums are verified.
+	SkipFormat bool
+
+	// OnFile, if set, is called with the report of each file as soon as its
+	// format has been validated.
+	OnFile func(f *FileReport)
+}
+
+// Report is the result of validating a dataset. Problems with the metadata
+// file or checksums are returned as errors by Validate instead.
+type Report struct {
+	Dir          string
+	Model        string
+	ModelVersion string
+
+	// Signer is the key the metadata file was signed with, if a keyring was
+	// given.
+	Signer *openpgp.Entity
+
+	// Files holds the format validation report of each file, in the order of
+	// the metadata records.
+	Files []*FileReport
+}
+
+// Valid reports whether no file had any format issues.
+func (r *Report) Valid() bool {
+	for _, f := range r.Files {
+		if !f.Valid() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FileReport is the result of validating the format of a data file against
+// its table.
+type FileReport struct {
+	Filename string
+	Table    string
+
+	// Err is set if the file could not be checked, or only partly, because
+	// its table is unknown or it could not be opened or read.
+	Err error
+
+	// Header and Result are the columns of the file and the issues found in
+	// it, once its header could be read.
+	Header []string
+	Result *validator.Result
+
+	// Rows and Bytes are the data rows, excluding the header, and the
+	// uncompressed bytes read from the file.
+	Rows  int64
+	Bytes int64
+}
+
+// Valid reports whether the file was checked and no issues were found.
+func (f *FileReport) Valid() bool {
+	if f.Err != nil {
+		return false
+	}
+
+	if f.Result == nil {
+		return true
+	}
+
+	if len(f.Result.LineErrors()) > 0 {
+		return false
+	}
+
+	for _, field := range f.Header {
+		if len(f.Result.FieldErrors(field)) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate validates the dataset in dir: it checks the signature of the
+// metadata file if a keyring is given, the attributes given against the
+// metadata file, each checksum, row count, byte size, header and encoding in
+// the metadata file against the appropriate file and, unless skipped, each
+// file against the format prescribed for its table in the model definition.
+// The format issues are returned in the report; the other problems as errors of
+// the Category of their cause.
+func Validate(ctx context.Context, dir string, opts ValidateOptions) (*Report, error) {
+	d, err := datadirectory.New(&datadirectory.Config{
+		DataDirPath:  dir,
+		DataVersion:  opts.Attrs.DataVersion,
+		Etl:          opts.Attrs.Etl,
+		Model:        opts.Attrs.Model,
+		ModelVersion: opts.Attrs.ModelVersion,
+		Service:      opts.Service,
+		Site:         opts.Attrs.Site,
+	})
+	if err != nil {
+		return nil, wrap(CategoryOther, err, "creating DataDirectory object")
+	}
+
+	report := &Report{Dir: dir}
+
+	// Check the metadata file signature, if requested, before trusting the
+	// checksums in it.
+	if len(opts.Keyring) > 0 {
+		if report.Signer, err = VerifySignature(MetadataPath(d), opts.Keyring); err != nil {
+			return nil, wrap(CategoryOther, err, "verifying metadata file signature")
+		}
+	}
+
+	if err = ReadMetadata(d); err != nil {
+		return nil, wrap(CategoryFormat, err, "reading metadata file")
+	}
+
+	if len(d.RecordMaps) == 0 {
+		return nil, newError(CategoryFormat, "reading metadata file: no records found")
+	}
+
+	// The model given overrides the one in the metadata file.
+	if d.Model == "" {
+		d.Model = d.RecordMaps[0]["cdm"]
+	}
+	if d.ModelVersion == "" {
+		d.ModelVersion = d.RecordMaps[0]["cdm-version"]
+	}
+
+	report.Model = d.Model
+	report.ModelVersion = d.ModelVersion
+
+	if err = VerifyMetadata(ctx, d, opts.Attrs, opts.Jobs); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, wrap(CategoryOther, err, "validating checksums and metadata file")
+	}
+
+	if opts.SkipFormat {
+		return report, nil
+	}
+
+	m, err := FetchModel(d.Model, d.ModelVersion, opts.Service)
+	if err != nil {
+		return nil, wrap(CategoryService, err, "retrieving data model definition")
+	}
+
+	report.ModelVersion = m.Version
+
+	if err = validateFormat(ctx, d, m, report, opts.OnFile); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// validateFormat validates each file of the DataDirectory against the format
+// prescribed for its table in the model, adding the report of each file to the
+// dataset's report and passing it to onFile, if set.
+func validateFormat(ctx context.Context, d *datadirectory.DataDirectory, m *dms.Model, report *Report, onFile func(f *FileReport)) error {
+	var rowsDone int64
+
+	// The row counts recorded by annotate, if any, are used to report
+	// progress.
+	_, totalRows := expectedRows(d)
+
+	for _, record := range d.RecordMaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if totalRows > 0 {
+			log.Infof("* Evaluating '%s' table in '%s' (%.1f%% of %d rows done)...", record["table"], record["filename"], 100*float64(rowsDone)/float64(totalRows), totalRows)
+
+			if n, err := strconv.ParseInt(record["rows"], 10, 64); err == nil {
+				rowsDone += n
+			}
+		} else {
+			log.Infof("* Evaluating '%s' table in '%s'...", record["table"], record["filename"])
+		}
+
+		f := validateFile(ctx, d, m, record)
+
+		// A file interrupted part way is not reported.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		report.Files = append(report.Files, f)
+
+		if onFile != nil {
+			onFile(f)
+		}
+	}
+
+	return nil
+}
+
+// validateFile validates a data file against the format of its table, until
+// the context is cancelled.
+func validateFile(ctx context.Context, d *datadirectory.DataDirectory, m *dms.Model, record map[string]string) *FileReport {
+	f := &FileReport{
+		Filename: record["filename"],
+		Table:    record["table"],
+	}
+
+	table := m.Tables.Get(record["table"])
+	if table == nil {
+		f.Err = fmt.Errorf("unknown table '%s', choices are: %s", record["table"], strings.Join(m.Tables.Names(), ", "))
+		return f
+	}
+
+	reader, err := validator.Open(path.Join(d.DirPath, record["filename"]), "")
+	if err != nil {
+		f.Err = fmt.Errorf("could not open file: %s", err)
+		return f
+	}
+	defer reader.Close()
+
+	// The rows and bytes are counted as the validator reads the file.
+	stats := newFileStats()
+	defer func() {
+		f.Rows = stats.Rows()
+		f.Bytes = stats.n
+	}()
+
+	v := validator.New(ContextReader(ctx, io.TeeReader(reader, stats)), table)
+
+	if err = v.Init(); err != nil {
+		f.Err = fmt.Errorf("problem reading CSV header: %s", err)
+		return f
+	}
+
+	if err = v.Run(); err != nil {
+		f.Err = fmt.Errorf("problem reading CSV data: %s", err)
+	}
+
+	f.Header = v.Header
+	f.Result = v.Result()
+
+	return f
+}
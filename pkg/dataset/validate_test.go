@@ -0,0 +1,120 @@
+package dataset
+
+import (
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infomodels/datadirectory"
+)
+
+// writeTestDataset writes the data files and a metadata file recording their
+// checksums and statistics to a new directory, returning its path.
+func writeTestDataset(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dataset-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &datadirectory.DataDirectory{DirPath: dir}
+
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d.RecordMaps = append(d.RecordMaps, map[string]string{
+			"organization": "seattle",
+			"filename":     name,
+			"cdm":          "pedsnet",
+			"cdm-version":  "2.3.0",
+			"table":        name[:len(name)-len(filepath.Ext(name))],
+		})
+	}
+
+	if err = ChecksumRecords(context.Background(), d, d.RecordMaps, "", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	header := []string{"organization", "filename", "cdm", "cdm-version", "table", "checksum", "checksum-algorithm", "rows", "bytes", "columns", "encoding", "modified"}
+
+	f, err := os.Create(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write(header)
+
+	for _, record := range d.RecordMaps {
+		row := make([]string, len(header))
+
+		for i, col := range header {
+			row[i] = record[col]
+		}
+
+		w.Write(row)
+	}
+
+	w.Flush()
+
+	if err = w.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestValidateChecksums(t *testing.T) {
+	dir := writeTestDataset(t, map[string]string{
+		"person.csv": "person_id,year_of_birth\n1,2001\n2,2003\n",
+		"visit.csv":  "visit_id,person_id\n10,1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := ValidateOptions{Jobs: 2, SkipFormat: true}
+
+	report, err := Validate(context.Background(), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Model != "pedsnet" || report.ModelVersion != "2.3.0" || !report.Valid() {
+		t.Errorf("report is %+v", report)
+	}
+
+	opts.Attrs.Site = "boston"
+
+	if _, err = Validate(context.Background(), dir, opts); CategoryOf(err) != CategoryFormat {
+		t.Errorf("error %v validating a different site, expected a %s error", err, CategoryFormat)
+	}
+
+	opts.Attrs.Site = ""
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "visit.csv"), []byte("visit_id,person_id\n10,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Validate(context.Background(), dir, opts); CategoryOf(err) != CategoryChecksum {
+		t.Errorf("error %v validating a changed file, expected a %s error", err, CategoryChecksum)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = Validate(ctx, dir, opts); err != context.Canceled {
+		t.Errorf("error %v validating with a cancelled context, expected %v", err, context.Canceled)
+	}
+
+	if err = os.Remove(filepath.Join(dir, MetadataFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Validate(context.Background(), dir, opts); CategoryOf(err) != CategoryFormat {
+		t.Errorf("error %v validating without a metadata file, expected a %s error", err, CategoryFormat)
+	}
+}